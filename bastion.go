@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshKeepaliveInterval is how often the bastion connection is checked, so a
+// dead one is noticed and replaced before a request needs it.
+const sshKeepaliveInterval = 30 * time.Second
+
+// sshBastion dials through an SSH connection to a bastion host, for API
+// servers only reachable through one. The connection is made on first use,
+// and again after it fails.
+type sshBastion struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// newSSHBastion returns a bastion at addr, host or host:port, authenticating
+// as user with the private key in keyFile. The bastion's host key is checked
+// against knownHostsFile, or ~/.ssh/known_hosts if it's empty.
+func newSSHBastion(addr, user, keyFile, knownHostsFile string) (*sshBastion, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("key %s is encrypted, which isn't supported", keyFile)
+	} else if err != nil {
+		return nil, fmt.Errorf("parsing key %s: %v", keyFile, err)
+	}
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("finding known hosts: %v", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %v", err)
+	}
+	return &sshBastion{addr: addr, config: &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}}, nil
+}
+
+// DialContext dials addr from the bastion, for rest.Config.Dial.
+func (b *sshBastion) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := b.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s through bastion %s: %v", addr, b.addr, err)
+	}
+	return conn, nil
+}
+
+// connect returns the connection to the bastion, making it if there isn't
+// one.
+func (b *sshBastion) connect(ctx context.Context) (*ssh.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errors.New("bastion connection is closed")
+	}
+	if b.client != nil {
+		return b.client, nil
+	}
+
+	conn, err := (&net.Dialer{Timeout: b.config.Timeout}).DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to bastion %s: %v", b.addr, err)
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, b.addr, b.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to bastion %s: %v", b.addr, err)
+	}
+	c := ssh.NewClient(sc, chans, reqs)
+	b.client = c
+	slog.Info("Connected to SSH bastion", "addr", b.addr)
+	go b.keepalive(c)
+	return c, nil
+}
+
+// keepalive checks c every sshKeepaliveInterval, closing it if it fails, and
+// drops it once it's closed so the next dial reconnects.
+func (b *sshBastion) keepalive(c *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(sshKeepaliveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if _, _, err := c.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}()
+
+	err := c.Wait()
+	close(done)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == c {
+		b.client = nil
+		if !b.closed {
+			slog.Warn("Lost connection to SSH bastion, reconnecting on the next request", "addr", b.addr, "error", err)
+		}
+	}
+}
+
+// Close closes the connection to the bastion, and stops it reconnecting.
+func (b *sshBastion) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.client == nil {
+		return nil
+	}
+	return b.client.Close()
+}
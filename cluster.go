@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// clustersFile is the -clusters-file format, mapping the host and path prefix
+// each cluster is served under to how to reach its API server.
+type clustersFile struct {
+	Clusters []clusterConfig `json:"clusters"`
+}
+
+type clusterConfig struct {
+	// Name identifies the cluster in logs and status.
+	Name string `json:"name"`
+	// Host is the host the cluster's documents are served for. If empty,
+	// they are served for any host.
+	Host string `json:"host"`
+	// PathPrefix is the path the cluster's documents are served under, e.g.
+	// /cluster-a. If empty, -serve-issuer-path applies.
+	PathPrefix string `json:"pathPrefix"`
+	// Kubeconfig is the path to the cluster's kubeconfig, or a list of them
+	// to merge. If empty, KUBECONFIG is used, then the in-cluster config.
+	Kubeconfig string `json:"kubeconfig"`
+	// Context is the kubeconfig context to use, rather than the current
+	// context.
+	Context string `json:"context"`
+}
+
+// loadClustersFile reads and validates the clusters file at path.
+func loadClustersFile(path string) ([]clusterConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f clustersFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(f.Clusters) == 0 {
+		return nil, fmt.Errorf("%s has no clusters", path)
+	}
+
+	names := map[string]bool{}
+	for i := range f.Clusters {
+		c := &f.Clusters[i]
+		if c.Name == "" {
+			return nil, fmt.Errorf("cluster %d has no name", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate cluster name %q", c.Name)
+		}
+		names[c.Name] = true
+
+		// hosts are case insensitive, and the mux matches them exactly.
+		c.Host = strings.ToLower(c.Host)
+		if strings.ContainsAny(c.Host, ":/") {
+			return nil, fmt.Errorf("cluster %s: host %q must be a bare host name, without a scheme, port or path", c.Name, c.Host)
+		}
+		if c.PathPrefix != "" && (!strings.HasPrefix(c.PathPrefix, "/") || strings.HasSuffix(c.PathPrefix, "/")) {
+			return nil, fmt.Errorf("cluster %s: pathPrefix %q must start with, and not end with, /", c.Name, c.PathPrefix)
+		}
+	}
+	return f.Clusters, nil
+}
+
+// cluster is an API server whose documents we publish, and where they are
+// served.
+type cluster struct {
+	name string
+	// host and pathPrefix select which requests are served this cluster's
+	// documents. An empty host matches any host.
+	host       string
+	pathPrefix string
+	// mappedPaths are where the documents are served instead, if set by
+	// -path-map-file for the cluster's issuer.
+	mappedPaths *issuerPaths
+
+	pub *publisher
+	// sink serves the documents over HTTP, if enabled.
+	sink *httpSink
+}
+
+// warmupClusters warms up every cluster's publisher concurrently, failing if
+// any of them do.
+func warmupClusters(ctx context.Context, clusters []*cluster, timeout time.Duration) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(clusters))
+	)
+	for i, c := range clusters {
+		wg.Go(func() {
+			if err := c.pub.warmup(ctx, timeout); err != nil {
+				errs[i] = fmt.Errorf("cluster %s: %v", c.name, err)
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// checkClusterRoutes checks that no two clusters' documents are served from
+// the same host and path.
+func checkClusterRoutes(clusters []*cluster) error {
+	seen := map[string]string{}
+	for _, c := range clusters {
+		for _, rt := range c.sink.routes(c.name, c.host, c.pathPrefix, c.mappedPaths) {
+			key := rt.host + rt.path
+			if other, ok := seen[key]; ok && other != c.name {
+				return fmt.Errorf("clusters %s and %s are both served at %q", other, c.name, key)
+			}
+			seen[key] = c.name
+		}
+	}
+	return nil
+}
+
+// checkJWKSURIServed checks the jwks_uri each cluster publishes is served
+// there, for its host if it has one, catching a path prefix or host that
+// doesn't match the issuer. Clusters in the path map are skipped, as their
+// documents are deliberately served somewhere other than their URLs.
+func checkJWKSURIServed(clusters []*cluster) error {
+	for _, c := range clusters {
+		if c.mappedPaths != nil {
+			continue
+		}
+		c.sink.mu.RLock()
+		md := c.sink.metadata
+		c.sink.mu.RUnlock()
+		if md == nil {
+			return fmt.Errorf("cluster %s: nothing has been published", c.name)
+		}
+		u, err := url.Parse(md.JWKSURI)
+		if err != nil {
+			return fmt.Errorf("cluster %s: parsing jwks_uri %q: %v", c.name, md.JWKSURI, err)
+		}
+		_, jwksPath := documentPaths(c.pathPrefix, nil)
+		if u.Path != jwksPath {
+			return fmt.Errorf("cluster %s: jwks_uri %s has path %q, but the key set is served at %q, check -serve-issuer-path or the cluster's pathPrefix", c.name, md.JWKSURI, u.Path, jwksPath)
+		}
+		// the mux matches hosts exactly, so one in another case isn't served.
+		if c.host != "" && u.Host != c.host {
+			return fmt.Errorf("cluster %s: jwks_uri %s has host %q, but the key set is only served for %q", c.name, md.JWKSURI, u.Host, c.host)
+		}
+	}
+	return nil
+}
+
+// readyFileInterval is how often the ready file is brought up to date.
+const readyFileInterval = 5 * time.Second
+
+// maintainReadyFile keeps a file at path that exists only while ready reports
+// we're ready to serve, checking every interval until ctx is cancelled. The
+// file is removed on return, so it's gone as soon as shutdown starts.
+func maintainReadyFile(ctx context.Context, path string, interval time.Duration, ready func() bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	// a previous run may have left the file behind.
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Failed to remove ready file", "path", path, "error", err)
+	}
+	exists := false
+	for {
+		ready := ready()
+		switch {
+		case ready && !exists:
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				slog.Error("Failed to create ready file", "path", path, "error", err)
+			} else {
+				exists = true
+			}
+		case !ready && exists:
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("Failed to remove ready file", "path", path, "error", err)
+			} else {
+				exists = false
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("Failed to remove ready file", "path", path, "error", err)
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
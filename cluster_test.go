@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyToServe(t *testing.T) {
+	st := staleness{staleAfter: time.Hour}
+	for _, tc := range []struct {
+		name string
+		// setup adjusts a server with one cluster that has published its
+		// documents.
+		setup func(s *httpServer, c *cluster)
+		want  bool
+	}{
+		{name: "ready", want: true},
+		{name: "initializing", setup: func(s *httpServer, c *cluster) { c.pub.lastDiscovery = time.Time{} }},
+		{name: "stale", setup: func(s *httpServer, c *cluster) { c.pub.lastDiscovery = time.Now().Add(-2 * time.Hour) }},
+		{name: "maintenance", setup: func(s *httpServer, c *cluster) { s.maintenance.Store(true) }},
+		{name: "shutting down", setup: func(s *httpServer, c *cluster) { s.shuttingDown.Store(true) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+			c.sink.staleness = st
+			s := &httpServer{clusters: []*cluster{c}}
+			if tc.setup != nil {
+				tc.setup(s, c)
+			}
+
+			if got := s.readyToServe(s.clusters, st); got != tc.want {
+				t.Errorf("readyToServe = %t, want %t", got, tc.want)
+			}
+			// /readyz must agree.
+			w := get(s.handler(), "/readyz")
+			if (w.Code == http.StatusOK) != tc.want {
+				t.Errorf("/readyz = %d, want ready %t: %s", w.Code, tc.want, w.Body)
+			}
+		})
+	}
+
+	t.Run("nothing served over HTTP", func(t *testing.T) {
+		c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+		var s *httpServer
+		if !s.readyToServe([]*cluster{c}, st) {
+			t.Error("not ready without an HTTP server")
+		}
+	})
+}
+
+func TestMaintainReadyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ready")
+	// a previous run's file is removed until we're ready.
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var ready atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		maintainReadyFile(ctx, path, time.Millisecond, ready.Load)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	exists := func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	waitFor(t, "the leftover ready file to be removed", func() bool { return !exists() })
+	ready.Store(true)
+	waitFor(t, "the ready file to be created", exists)
+	ready.Store(false)
+	waitFor(t, "the ready file to be removed", func() bool { return !exists() })
+	ready.Store(true)
+	waitFor(t, "the ready file to be created again", exists)
+
+	// shutting down removes it straight away, whatever ready says.
+	cancel()
+	<-done
+	if exists() {
+		t.Error("ready file left behind on shutdown")
+	}
+}
+
+func TestCheckJWKSURIServed(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		issuer     string
+		host       string
+		pathPrefix string
+		mapped     *issuerPaths
+		// unpublished has nothing published yet.
+		unpublished bool
+		wantErr     string
+	}{
+		{name: "served at the root", issuer: "https://example.com"},
+		{name: "served under the issuer's path", issuer: "https://example.com/clusters/foo", pathPrefix: "/clusters/foo"},
+		{name: "served for the issuer's host", issuer: "https://oidc.example.com", host: "oidc.example.com"},
+		{name: "host in another case", issuer: "https://OIDC.example.com", host: "oidc.example.com", wantErr: `has host "OIDC.example.com"`},
+		{name: "issuer path not served", issuer: "https://example.com/clusters/foo", wantErr: `has path "/clusters/foo/.well-known/jwks.json", but the key set is served at "/.well-known/jwks.json"`},
+		{name: "served under another path", issuer: "https://example.com/clusters/foo", pathPrefix: "/clusters/bar", wantErr: "but the key set is served at"},
+		{name: "prefix the issuer doesn't have", issuer: "https://example.com", pathPrefix: "/clusters/foo", wantErr: "but the key set is served at"},
+		{name: "served for another host", issuer: "https://other.example.com", host: "oidc.example.com", wantErr: `has host "other.example.com", but the key set is only served for "oidc.example.com"`},
+		{name: "mapped paths are skipped", issuer: "https://example.com/clusters/foo", mapped: &issuerPaths{Issuer: "https://example.com/clusters/foo", MetadataPath: "/foo/openid-configuration", JWKSPath: "/foo/jwks"}},
+		{name: "nothing published", issuer: "https://example.com", unpublished: true, wantErr: "nothing has been published"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "foo", tc.issuer, testKey(t, "a"))
+			c.host, c.pathPrefix, c.mappedPaths = tc.host, tc.pathPrefix, tc.mapped
+			if tc.unpublished {
+				c.sink.metadata = nil
+			}
+			// another cluster that's fine, so the one checked is named.
+			ok := newTestCluster(t, "ok", "https://ok.example.com")
+			ok.host = "ok.example.com"
+
+			err := checkJWKSURIServed([]*cluster{ok, c})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) || !strings.HasPrefix(err.Error(), "cluster foo: ") {
+					t.Fatalf("error = %v, want cluster foo: ...%s", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v, want none", err)
+			}
+			if tc.mapped != nil {
+				return
+			}
+			// passing the check means relying parties really get the
+			// key set from the jwks_uri.
+			s := &httpServer{clusters: []*cluster{ok, c}}
+			jwksURI := c.sink.metadata.JWKSURI
+			if w := get(s.handler(), jwksURI); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"kid":"a"`) {
+				t.Errorf("GET %s = %d %s, want the key set", jwksURI, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// combinedJWKS serves the union of every cluster's published keys at a single
+// path, for relying parties that deliberately trust all of them through one
+// key set. It's served for any host, separately from the clusters' own
+// endpoints.
+type combinedJWKS struct {
+	path     string
+	clusters []*cluster
+
+	mu sync.Mutex
+	// sources are the key set documents doc was built from, in cluster
+	// order, so it's only rebuilt when one of them changes.
+	sources []*document
+	doc     *document
+}
+
+// route returns the endpoint serving the combined key set.
+func (c *combinedJWKS) route() route {
+	return route{
+		method:      http.MethodGet,
+		path:        c.path,
+		description: "JSON Web Key Set combining every cluster's keys, deduplicated by kid",
+		handler:     c.serve,
+	}
+}
+
+// checkCombinedRoute checks the combined key set isn't served at a path one
+// of the clusters' documents are.
+func checkCombinedRoute(c *combinedJWKS) error {
+	for _, cl := range c.clusters {
+		for _, rt := range cl.sink.routes(cl.name, cl.host, cl.pathPrefix, cl.mappedPaths) {
+			if rt.path == c.path {
+				return fmt.Errorf("cluster %s is already served at %q", cl.name, rt.host+rt.path)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *combinedJWKS) serve(w http.ResponseWriter, r *http.Request) {
+	// the serving options come from flags, so are the same for every
+	// cluster's sink.
+	sink := c.clusters[0].sink
+
+	doc, err := c.document()
+	if err != nil {
+		slog.Error("Failed to build combined key set", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	if doc == nil {
+		c.setRetryAfter(w)
+		if !slices.ContainsFunc(c.clusters, func(cl *cluster) bool { return !cl.pub.lastSuccess().IsZero() }) {
+			writeJSON(w, sink.initializingStatus, map[string]string{"error": "not ready", "state": documentStateInitializing})
+			return
+		}
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "not ready", "state": documentStateStale})
+		return
+	}
+	sink.writeDocument(w, r, sink.jwksContentType, doc, "")
+}
+
+// document returns the combined key set, built from the clusters whose key
+// sets are fit to serve, or nil if there are none.
+func (c *combinedJWKS) document() (*document, error) {
+	var (
+		sources []*document
+		sets    []*jose.JSONWebKeySet
+		names   []string
+	)
+	for _, cl := range c.clusters {
+		h := cl.sink
+		h.mu.RLock()
+		doc, ks := h.ksDoc, h.keySet
+		h.mu.RUnlock()
+		if doc == nil {
+			continue
+		}
+		if _, stale := h.documentsStale(h.state); stale && !h.failOpen {
+			continue
+		}
+		sources = append(sources, doc)
+		sets = append(sets, ks)
+		names = append(names, cl.name)
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slices.Equal(sources, c.sources) {
+		return c.doc, nil
+	}
+
+	type keptKey struct {
+		key jose.JSONWebKey
+		// cluster is the index of the cluster it was taken from.
+		cluster int
+	}
+	combined := &jose.JSONWebKeySet{}
+	kept := map[string]keptKey{}
+	for i, ks := range sets {
+		for _, k := range ks.Keys {
+			prev, ok := kept[k.KeyID]
+			if !ok {
+				kept[k.KeyID] = keptKey{key: k, cluster: i}
+				combined.Keys = append(combined.Keys, k)
+				continue
+			}
+			// clusters sharing a signing key publish it under the same
+			// kid, which is what deduplicating is for.
+			if !sameKeyMaterial(prev.key, k) {
+				slog.Warn("Clusters publish different keys with the same kid, keeping the first in the combined key set", "kid", k.KeyID, "kept", names[prev.cluster], "dropped", names[i])
+			}
+		}
+	}
+
+	sink := c.clusters[0].sink
+	doc, err := newDocument(keySetJSON(combined, sink.canonicalKeys), sink.pretty, sink.gzip)
+	if err != nil {
+		return nil, err
+	}
+	c.sources, c.doc = sources, doc
+	return doc, nil
+}
+
+// setRetryAfter sets the Retry-After for a 503 to when the next refresh of
+// any cluster is due.
+func (c *combinedJWKS) setRetryAfter(w http.ResponseWriter) {
+	var next time.Time
+	for _, cl := range c.clusters {
+		if n := cl.sink.state.nextRefresh(); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	wait := max(time.Until(next), minRetryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// sameKeyMaterial reports whether a and b are the same key, by their RFC 7638
+// thumbprints.
+func sameKeyMaterial(a, b jose.JSONWebKey) bool {
+	at, aerr := a.Thumbprint(crypto.SHA256)
+	bt, berr := b.Thumbprint(crypto.SHA256)
+	return aerr == nil && berr == nil && bytes.Equal(at, bt)
+}
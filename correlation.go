@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	correlationPerRefresh = "refresh"
+	correlationPerRun     = "run"
+)
+
+type correlationIDKey struct{}
+
+// correlationIDs tags our requests upstream with an ID in a header, so they
+// can be matched with the API server's audit log. The API server records an
+// Audit-ID it's sent as the event's auditID.
+type correlationIDs struct {
+	header string
+	// runID is used for every request if set, rather than one ID per
+	// refresh.
+	runID string
+}
+
+// newCorrelationIDs returns IDs sent in header, one per refresh or one for
+// the whole run depending on per.
+func newCorrelationIDs(header, per string) *correlationIDs {
+	c := &correlationIDs{header: header}
+	if per == correlationPerRun {
+		c.runID = uuid.NewString()
+	}
+	return c
+}
+
+// start returns ctx carrying the ID for a refresh's requests. A new ID is
+// logged to log, the run's ID is logged once at startup.
+func (c *correlationIDs) start(ctx context.Context, log *slog.Logger) context.Context {
+	if c == nil || c.runID != "" {
+		return ctx
+	}
+	id := uuid.NewString()
+	log.Info("Refreshing discovery documents", "correlation-header", c.header, "correlation-id", id)
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// wrap returns rt, setting the header to the run's ID, or the ID in the
+// context of requests made during a refresh.
+func (c *correlationIDs) wrap(rt http.RoundTripper) http.RoundTripper {
+	return correlationTransport{ids: c, next: rt}
+}
+
+type correlationTransport struct {
+	ids  *correlationIDs
+	next http.RoundTripper
+}
+
+func (t correlationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id, _ := req.Context().Value(correlationIDKey{}).(string)
+	if id == "" {
+		id = t.ids.runID
+	}
+	if id != "" {
+		// round trippers mustn't modify the caller's request.
+		req = req.Clone(req.Context())
+		req.Header.Set(t.ids.header, id)
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (t correlationTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.next
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"lds.li/oauth2ext/oidc"
+)
+
+// metadataDefaults are values for metadata fields that some clusters omit but
+// strict relying parties require. They're only used when the upstream
+// metadata leaves the field out, so the upstream stays the authority.
+type metadataDefaults struct {
+	scopes       []string
+	claims       []string
+	subjectTypes []string
+}
+
+// subjectTypes are the subject identifier types defined by OpenID Connect.
+var subjectTypes = []string{"public", "pairwise"}
+
+// parseMetadataDefaults parses and validates the comma separated defaults.
+func parseMetadataDefaults(scopes, claims, subjects string) (metadataDefaults, error) {
+	var (
+		d   metadataDefaults
+		err error
+	)
+	if d.scopes, err = parseMetadataValues(scopes); err != nil {
+		return d, fmt.Errorf("scopes: %v", err)
+	}
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+	if d.scopes != nil && !slices.Contains(d.scopes, "openid") {
+		return d, fmt.Errorf("scopes must include openid")
+	}
+	if d.claims, err = parseMetadataValues(claims); err != nil {
+		return d, fmt.Errorf("claims: %v", err)
+	}
+	if d.subjectTypes, err = parseMetadataValues(subjects); err != nil {
+		return d, fmt.Errorf("subject types: %v", err)
+	}
+	for _, st := range d.subjectTypes {
+		if !slices.Contains(subjectTypes, st) {
+			return d, fmt.Errorf("subject type %q must be one of %s", st, strings.Join(subjectTypes, ", "))
+		}
+	}
+	return d, nil
+}
+
+// parseMetadataValues splits a comma separated list of metadata values,
+// returning nil for an empty list.
+func parseMetadataValues(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var vals []string
+	for v := range strings.SplitSeq(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.ContainsFunc(v, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+			return nil, fmt.Errorf("invalid value %q", v)
+		}
+		if !slices.Contains(vals, v) {
+			vals = append(vals, v)
+		}
+	}
+	return vals, nil
+}
+
+// apply sets the defaults on md for fields it omits, returning the names of
+// the fields that were injected.
+func (d metadataDefaults) apply(md *oidc.ProviderMetadata) []string {
+	var injected []string
+	if len(md.ScopesSupported) == 0 && d.scopes != nil {
+		md.ScopesSupported = d.scopes
+		injected = append(injected, "scopes_supported")
+	}
+	if len(md.ClaimsSupported) == 0 && d.claims != nil {
+		md.ClaimsSupported = d.claims
+		injected = append(injected, "claims_supported")
+	}
+	if len(md.SubjectTypesSupported) == 0 && d.subjectTypes != nil {
+		md.SubjectTypesSupported = d.subjectTypes
+		injected = append(injected, "subject_types_supported")
+	}
+	return injected
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+	"k8s.io/client-go/rest"
+	"lds.li/oauth2ext/oidc"
+)
+
+// defaultDiscoveryPath is where the API server serves its discovery document.
+const defaultDiscoveryPath = "/.well-known/openid-configuration"
+
+// defaultDiscoveryAccept is the Accept header the discovery document and key
+// set are requested with, so content negotiation can't pick another format.
+const defaultDiscoveryAccept = "application/json"
+
+// discoverySource fetches the upstream discovery document and key set that we
+// republish.
+type discoverySource interface {
+	// discover returns the discovery document, parsed and as fetched.
+	discover(ctx context.Context) (*oidc.ProviderMetadata, []byte, error)
+	// jwks returns the key set at jwksURI, from the discovery document.
+	jwks(ctx context.Context, jwksURI string) (*jose.JSONWebKeySet, error)
+}
+
+// inlineKeysSource is a discoverySource whose discovery document may embed the
+// key set, rather than pointing to it.
+type inlineKeysSource interface {
+	discoverySource
+	// inlineJWKS returns the key set embedded in the discovery document
+	// mdraw, or nil if there isn't one.
+	inlineJWKS(mdraw []byte) (*jose.JSONWebKeySet, error)
+}
+
+// apiServerSource discovers from a Kubernetes API server, authenticating with
+// the REST client's credentials.
+type apiServerSource struct {
+	cl *rest.RESTClient
+	// path is where the discovery document is fetched from.
+	path string
+	// accept is the Accept header for the discovery requests.
+	accept string
+	// dropInvalid drops unusable keys from the set, rather than failing.
+	dropInvalid bool
+	// serviceAccount is the in-cluster service account we authenticate as,
+	// in namespace:name form, if known. It's used to explain missing RBAC.
+	serviceAccount string
+}
+
+func (s *apiServerSource) discover(ctx context.Context) (*oidc.ProviderMetadata, []byte, error) {
+	md, mdraw, err := discoverAPIServerOIDC(ctx, s.cl, s.path, s.accept)
+	return md, mdraw, s.annotate(err)
+}
+
+func (s *apiServerSource) jwks(ctx context.Context, jwksURI string) (*jose.JSONWebKeySet, error) {
+	ks, err := (&k8sAPIJWKSSource{cl: s.cl, url: jwksURI, accept: s.accept, dropInvalid: s.dropInvalid}).GetJWKS(ctx)
+	return ks, s.annotate(err)
+}
+
+// annotate adds the service account to RBAC failures.
+func (s *apiServerSource) annotate(err error) error {
+	var fe *forbiddenError
+	if errors.As(err, &fe) {
+		fe.serviceAccount = s.serviceAccount
+	}
+	return err
+}
+
+// issuerSource discovers from an arbitrary OIDC issuer over plain HTTP(S), for
+// republishing issuers that aren't Kubernetes API servers.
+type issuerSource struct {
+	client *http.Client
+	// issuer is the issuer URL, which the discovery document must match.
+	issuer string
+	// path is where the discovery document is fetched from, relative to
+	// issuer.
+	path string
+	// accept is the Accept header for the discovery requests.
+	accept string
+	// dropInvalid drops unusable keys from the set, rather than failing.
+	dropInvalid bool
+	// externalRetry is how fetching a key set hosted somewhere other than the
+	// issuer, e.g. a CDN, is retried. Its failures have little to do with
+	// the issuer's, so it gets its own policy.
+	externalRetry retryPolicy
+}
+
+func (s *issuerSource) discover(ctx context.Context) (*oidc.ProviderMetadata, []byte, error) {
+	u, err := url.JoinPath(s.issuer, s.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("building discovery URL for %q: %v", s.issuer, err)
+	}
+	mdraw, contentType, err := s.get(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md := oidc.ProviderMetadata{}
+	if err := unmarshalJSONResponse(contentType, mdraw, &md); err != nil {
+		return nil, nil, fmt.Errorf("unmarshaling discovery response: %v", err)
+	}
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation
+	if strings.TrimSuffix(md.Issuer, "/") != strings.TrimSuffix(s.issuer, "/") {
+		return nil, nil, fmt.Errorf("discovery document at %s is for issuer %q, not %q", u, md.Issuer, s.issuer)
+	}
+
+	return &md, mdraw, nil
+}
+
+func (s *issuerSource) jwks(ctx context.Context, jwksURI string) (*jose.JSONWebKeySet, error) {
+	var (
+		raw rawJWKS
+		err error
+	)
+	if s.external(jwksURI) {
+		var decodeErr error
+		err = s.externalRetry.do(ctx, func() error {
+			decodeErr, raw = nil, rawJWKS{}
+			err := s.fetchJWKS(ctx, jwksURI, &raw)
+			// a response that doesn't decode won't change by fetching it
+			// again, anything else is left to retryable.
+			var de *jwksDecodeError
+			if errors.As(err, &de) {
+				decodeErr = err
+				return nil
+			}
+			return err
+		})
+		if err == nil {
+			err = decodeErr
+		}
+	} else {
+		err = s.fetchJWKS(ctx, jwksURI, &raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ks, err := parseJWKS(raw, s.dropInvalid)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key set from %s: %v", jwksURI, err)
+	}
+	return ks, nil
+}
+
+// inlineJWKS returns the key set embedded in the discovery document mdraw as
+// its jwks member, which some providers use instead of a jwks_uri. It returns
+// a nil set if there isn't one.
+func (s *issuerSource) inlineJWKS(mdraw []byte) (*jose.JSONWebKeySet, error) {
+	var doc struct {
+		JWKS *rawJWKS `json:"jwks"`
+	}
+	if err := json.Unmarshal(mdraw, &doc); err != nil {
+		return nil, fmt.Errorf("unmarshaling discovery response: %v", err)
+	}
+	if doc.JWKS == nil {
+		return nil, nil
+	}
+	ks, err := parseJWKS(*doc.JWKS, s.dropInvalid)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key set from the discovery document: %v", err)
+	}
+	return ks, nil
+}
+
+// external reports whether jwksURI is hosted somewhere other than the issuer.
+func (s *issuerSource) external(jwksURI string) bool {
+	iu, err := url.Parse(s.issuer)
+	if err != nil {
+		return false
+	}
+	ju, err := url.Parse(jwksURI)
+	if err != nil {
+		return false
+	}
+	return !strings.EqualFold(iu.Host, ju.Host)
+}
+
+// get fetches u, returning the body and its content type. Anything but a 200
+// is an error.
+func (s *issuerSource) get(ctx context.Context, u string) (_ []byte, contentType string, _ error) {
+	resp, err := s.open(ctx, u)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading %s: %v", u, err)
+	}
+	return b, resp.Header.Get("Content-Type"), nil
+}
+
+// fetchJWKS fetches the key set at u in to raw, decoding it as it's read.
+func (s *issuerSource) fetchJWKS(ctx context.Context, u string, raw *rawJWKS) error {
+	resp, err := s.open(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := decodeJWKSResponse(resp.Header.Get("Content-Type"), resp.Body, raw); err != nil {
+		return newJWKSDecodeError(u, err)
+	}
+	return nil
+}
+
+// open requests u, returning the response if it's a 200. Anything else is an
+// error.
+func (s *issuerSource) open(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request for %s: %v", u, err)
+	}
+	req.Header.Set("Accept", s.accept)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting %s: %v", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", u, err)
+		}
+		return nil, &statusError{op: "getting", url: u, status: resp.Status, code: resp.StatusCode, body: b}
+	}
+	return resp, nil
+}
+
+// maxRedirects is how many redirects a discovery request follows, e.g. an
+// ingress normalizing a trailing slash.
+const maxRedirects = 5
+
+// checkRedirect returns the redirect policy for discovery requests. Redirects
+// are followed up to maxRedirects, but never from https to http. If
+// sameOrigin is set they must also stay on the original scheme and host,
+// which the API server client needs as its credentials are added by the
+// transport, and so would be sent to wherever we're redirected.
+func checkRedirect(sameOrigin bool) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		orig := via[0].URL
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects from %s", maxRedirects, orig)
+		}
+		if orig.Scheme == "https" && req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect from %s to insecure %s", orig, req.URL)
+		}
+		if sameOrigin && (!strings.EqualFold(orig.Scheme, req.URL.Scheme) || !strings.EqualFold(orig.Host, req.URL.Host)) {
+			return fmt.Errorf("refusing redirect from %s to another origin, %s", orig, req.URL)
+		}
+		return nil
+	}
+}
+
+// discoverAPIServerOIDC fetches the API server's discovery document from
+// path, requesting the accept content type, and returns it parsed and as
+// fetched.
+func discoverAPIServerOIDC(ctx context.Context, cl *rest.RESTClient, path, accept string) (*oidc.ProviderMetadata, []byte, error) {
+	var (
+		contentType string
+		code        int
+	)
+	res := cl.Get().RequestURI(path).SetHeader("Accept", accept).Do(ctx).ContentType(&contentType).StatusCode(&code)
+
+	mdraw, err := res.Raw()
+	if err != nil {
+		return nil, nil, requestError(path, code, res.Error())
+	}
+
+	md := oidc.ProviderMetadata{}
+	if err := unmarshalJSONResponse(contentType, mdraw, &md); err != nil {
+		return nil, nil, fmt.Errorf("unmarshaling discovery response: %v", err)
+	}
+
+	return &md, mdraw, nil
+}
+
+type k8sAPIJWKSSource struct {
+	cl  *rest.RESTClient
+	url string
+	// accept is the Accept header for the request.
+	accept string
+	// dropInvalid drops unusable keys from the set, rather than failing.
+	dropInvalid bool
+}
+
+// GetJWKS fetches the key set from the API server, decoding it as it's read
+// so an oversized response fails without being buffered. Every key must be a
+// usable public key, see parseJWKS.
+func (s *k8sAPIJWKSSource) GetJWKS(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	// the REST client only hands over buffered bodies, so make the request
+	// with its HTTP client, which carries its credentials.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cl.Get().RequestURI(s.url).URL().String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request for %s: %v", s.url, err)
+	}
+	req.Header.Set("Accept", s.accept)
+
+	// going around the REST client skips its throttling, so wait our turn
+	// here, keeping the key set within -kube-qps and -kube-burst.
+	if rl := s.cl.GetRateLimiter(); rl != nil {
+		if err := rl.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("waiting to get %s: %v", s.url, err)
+		}
+	}
+	resp, err := s.cl.Client.Do(req)
+	if err != nil {
+		return nil, requestError(s.url, 0, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+		return nil, requestError(s.url, resp.StatusCode, fmt.Errorf("unexpected status %s, body: %s", resp.Status, bodySnippet(b)))
+	}
+
+	var raw rawJWKS
+	if err := decodeJWKSResponse(resp.Header.Get("Content-Type"), resp.Body, &raw); err != nil {
+		return nil, newJWKSDecodeError(s.url, err)
+	}
+
+	ks, err := parseJWKS(raw, s.dropInvalid)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key set from %s: %v", s.url, err)
+	}
+	return ks, nil
+}
+
+// requestError builds the error for a failed request to the API server. Auth
+// failures get an explanation of the RBAC needed, as the discovery endpoints
+// are only open to the system:service-account-issuer-discovery ClusterRole,
+// which by default is only bound to service accounts.
+func requestError(path string, code int, err error) error {
+	switch code {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("getting %s: %v. The API server did not accept our credentials, "+
+			"check the kubeconfig or service account token is valid for this cluster", path, err)
+	case http.StatusForbidden:
+		return &forbiddenError{path: path, err: err}
+	}
+	return fmt.Errorf("getting %s: %v", path, err)
+}
+
+// forbiddenError is a discovery request the API server refused, because we
+// lack the RBAC for it.
+type forbiddenError struct {
+	path string
+	err  error
+	// serviceAccount is the in-cluster service account we run as, in
+	// namespace:name form, if known.
+	serviceAccount string
+}
+
+func (e *forbiddenError) Error() string {
+	subject := "--serviceaccount=<namespace>:<name> (or --user=<name> when using a kubeconfig)"
+	if e.serviceAccount != "" {
+		subject = "--serviceaccount=" + e.serviceAccount
+	}
+	return fmt.Sprintf("getting %s: %v. Access to discovery requires the system:service-account-issuer-discovery ClusterRole, "+
+		"bind it to the identity we run as with e.g. "+
+		"kubectl create clusterrolebinding k8soidcpublisher-issuer-discovery "+
+		"--clusterrole=system:service-account-issuer-discovery %s", e.path, e.err, subject)
+}
+
+// rbacManifest returns the ClusterRoleBinding granting the service account
+// access to discovery.
+func (e *forbiddenError) rbacManifest() string {
+	ns, name, _ := strings.Cut(e.serviceAccount, ":")
+	return fmt.Sprintf(`apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: k8soidcpublisher-issuer-discovery
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: system:service-account-issuer-discovery
+subjects:
+- kind: ServiceAccount
+  name: %s
+  namespace: %s
+`, name, ns)
+}
+
+// maxBodySnippet bounds how much of an unexpected response body is included in
+// an error.
+const maxBodySnippet = 256
+
+// unmarshalJSONResponse unmarshals body in to v. If the response isn't JSON,
+// e.g. an HTML error page from a proxy between us and the API server, the
+// error includes the start of the body to make it clear what was returned.
+func unmarshalJSONResponse(contentType string, body []byte, v any) error {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil &&
+		mt != "application/json" && !strings.HasSuffix(mt, "+json") {
+		return fmt.Errorf("unexpected content type %q, body: %s", contentType, bodySnippet(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%v, content type %q, body: %s", err, contentType, bodySnippet(body))
+	}
+	return nil
+}
+
+// maxJWKSBytes bounds the size of a key set response. Key sets are a few
+// kilobytes, so one this large is broken or hostile.
+const maxJWKSBytes = 1 << 20
+
+// decodeJWKSResponse decodes a key set from body in to raw as it's read,
+// rather than buffering it first, failing as soon as it's over maxJWKSBytes.
+// It checks the content type and reports errors with the start of the body as
+// unmarshalJSONResponse does. A body that fails to be read is a
+// *bodyReadError, as fetching it again may work.
+func decodeJWKSResponse(contentType string, body io.Reader, raw *rawJWKS) error {
+	start := &prefixWriter{max: maxBodySnippet}
+	cr := &cappedReader{r: io.TeeReader(body, start), remaining: maxJWKSBytes}
+
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil &&
+		mt != "application/json" && !strings.HasSuffix(mt, "+json") {
+		_, _ = io.CopyN(io.Discard, cr, maxBodySnippet+1)
+		return fmt.Errorf("unexpected content type %q, body: %s", contentType, start.snippet())
+	}
+
+	dec := json.NewDecoder(cr)
+	err := dec.Decode(raw)
+	// like json.Unmarshal, only whitespace may follow the key set.
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the key set")
+	}
+	switch {
+	case cr.exceeded:
+		return fmt.Errorf("key set is over the %d byte limit", maxJWKSBytes)
+	case cr.err != nil && !errors.Is(cr.err, io.EOF):
+		return &bodyReadError{err: cr.err}
+	case err != nil:
+		return fmt.Errorf("%v, content type %q, body: %s", err, contentType, start.snippet())
+	}
+	return nil
+}
+
+// bodyReadError is a response body that couldn't be read, likely because of
+// the network.
+type bodyReadError struct {
+	url string
+	err error
+}
+
+func (e *bodyReadError) Error() string {
+	return fmt.Sprintf("reading %s: %v", e.url, e.err)
+}
+
+func (e *bodyReadError) Unwrap() error { return e.err }
+
+// jwksDecodeError is a key set response that was read but doesn't decode.
+type jwksDecodeError struct {
+	url string
+	err error
+}
+
+func (e *jwksDecodeError) Error() string {
+	return fmt.Sprintf("unmarshaling %s response: %v", e.url, e.err)
+}
+
+// newJWKSDecodeError describes err from decodeJWKSResponse, for the key set at
+// u. A *bodyReadError is kept as one, as it may be worth retrying.
+func newJWKSDecodeError(u string, err error) error {
+	if re, ok := err.(*bodyReadError); ok {
+		re.url = u
+		return re
+	}
+	return &jwksDecodeError{url: u, err: err}
+}
+
+// cappedReader reads from r until remaining runs out, after which it fails.
+// It records the first error it returns.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+	err       error
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining <= 0 {
+		// see if there's anything past the limit.
+		var b [1]byte
+		if n, _ := c.r.Read(b[:]); n > 0 {
+			c.exceeded, c.err = true, errors.New("body too large")
+			return 0, c.err
+		}
+		c.err = io.EOF
+		return 0, c.err
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// prefixWriter keeps the first max bytes written to it, counting the rest.
+type prefixWriter struct {
+	max int
+	b   []byte
+	n   int
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if room := w.max - len(w.b); room > 0 {
+		w.b = append(w.b, p[:min(room, len(p))]...)
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+// snippet is bodySnippet for the bytes written so far.
+func (w *prefixWriter) snippet() string {
+	b := bytes.TrimSpace(w.b)
+	if w.n > len(w.b) {
+		return fmt.Sprintf("%q (truncated, %d bytes read)", b, w.n)
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+// bodySnippet returns a quoted, truncated form of body suitable for including
+// in errors.
+func bodySnippet(body []byte) string {
+	b := bytes.TrimSpace(body)
+	if len(b) > maxBodySnippet {
+		return fmt.Sprintf("%q (truncated, %d bytes total)", b[:maxBodySnippet], len(body))
+	}
+	return fmt.Sprintf("%q", b)
+}
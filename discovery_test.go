@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"k8s.io/client-go/rest"
+)
+
+// testKey returns a new EC public key with kid.
+func testKey(t testing.TB, kid string) jose.JSONWebKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose.JSONWebKey{Key: &k.PublicKey, KeyID: kid, Algorithm: "ES256", Use: "sig"}
+}
+
+// testKeySetJSON returns keys encoded as a key set.
+func testKeySetJSON(t testing.TB, keys ...jose.JSONWebKey) []byte {
+	t.Helper()
+	b, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testMetadataJSON returns a discovery document for issuer, as an API server
+// serves it.
+func testMetadataJSON(t testing.TB, issuer, jwksURI string) []byte {
+	t.Helper()
+	b, err := json.Marshal(map[string]any{
+		"issuer":                                issuer,
+		"jwks_uri":                              jwksURI,
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// serveJSON returns a handler serving b as JSON.
+func serveJSON(b []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	}
+}
+
+// newTestIssuer starts an issuer serving its discovery document, pointing at
+// the key set at jwksURI, and returns it with a source discovering from it.
+func newTestIssuer(t *testing.T, jwksURI func(issuer string) string) (*httptest.Server, *issuerSource) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.Handle("GET /.well-known/openid-configuration", serveJSON(testMetadataJSON(t, srv.URL, jwksURI(srv.URL))))
+	return srv, &issuerSource{
+		client: srv.Client(),
+		issuer: srv.URL,
+		path:   defaultDiscoveryPath,
+		accept: defaultDiscoveryAccept,
+		externalRetry: retryPolicy{
+			attempts:   3,
+			backoff:    time.Millisecond,
+			maxBackoff: time.Millisecond,
+		},
+	}
+}
+
+func TestIssuerSourceExternalJWKSRetry(t *testing.T) {
+	key := testKey(t, "a")
+	for _, tc := range []struct {
+		name string
+		// fail is the response to each attempt before the key set is
+		// served, as a status, or -1 to drop the connection.
+		fail      []int
+		wantHits  int32
+		wantError string
+	}{
+		{name: "first attempt", wantHits: 1},
+		{name: "503 then 200", fail: []int{http.StatusServiceUnavailable}, wantHits: 2},
+		{name: "429 then 200", fail: []int{http.StatusTooManyRequests}, wantHits: 2},
+		{name: "connection reset then 200", fail: []int{-1}, wantHits: 2},
+		{name: "404 isn't retried", fail: []int{http.StatusNotFound}, wantHits: 1, wantError: "unexpected status 404"},
+		{name: "gives up after the attempts", fail: []int{503, 503, 503}, wantHits: 3, wantError: "unexpected status 503"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits atomic.Int32
+			cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(hits.Add(1))
+				if n > len(tc.fail) {
+					serveJSON(testKeySetJSON(t, key))(w, r)
+					return
+				}
+				if tc.fail[n-1] == -1 {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err == nil {
+						conn.Close()
+					}
+					return
+				}
+				w.WriteHeader(tc.fail[n-1])
+			}))
+			defer cdn.Close()
+			_, src := newTestIssuer(t, func(string) string { return cdn.URL + "/keys" })
+
+			st := &captureSink{}
+			p := &publisher{src: src, log: slog.Default()}
+			p.addSink("capture", st)
+			err := p.refresh(context.Background())
+
+			if got := hits.Load(); got != tc.wantHits {
+				t.Errorf("key set fetched %d times, want %d", got, tc.wantHits)
+			}
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("refresh error = %v, want one containing %q", err, tc.wantError)
+				}
+				if st.ks != nil {
+					t.Error("key set was published despite failing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("refresh: %v", err)
+			}
+			if st.ks == nil || len(st.ks.Key("a")) != 1 {
+				t.Fatalf("published key set = %+v, want key a", st.ks)
+			}
+		})
+	}
+}
+
+func TestIssuerSourceExternalJWKSDecodeNotRetried(t *testing.T) {
+	var hits atomic.Int32
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		serveJSON([]byte(`{"keys": [`))(w, r)
+	}))
+	defer cdn.Close()
+	_, src := newTestIssuer(t, func(string) string { return cdn.URL + "/keys" })
+
+	_, err := src.jwks(context.Background(), cdn.URL+"/keys")
+	if err == nil || !strings.Contains(err.Error(), "unmarshaling") {
+		t.Fatalf("jwks error = %v, want an unmarshaling error", err)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("key set fetched %d times, want 1", got)
+	}
+}
+
+func TestIssuerSourceSameHostJWKSNotRetried(t *testing.T) {
+	var hits atomic.Int32
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	src := &issuerSource{client: srv.Client(), issuer: srv.URL, accept: defaultDiscoveryAccept, externalRetry: retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}}
+
+	if _, err := src.jwks(context.Background(), srv.URL+"/keys"); err == nil {
+		t.Fatal("jwks succeeded, want an error")
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("key set fetched %d times, want 1, as the issuer's own failures aren't retried here", got)
+	}
+}
+
+// infiniteKeySet streams a key set that never ends.
+type infiniteKeySet struct {
+	read int64
+}
+
+func (r *infiniteKeySet) Read(p []byte) (int, error) {
+	const start, key = `{"keys":[`, `{"kty":"oct","k":"AAAA"},`
+	for i := range p {
+		if r.read < int64(len(start)) {
+			p[i] = start[r.read]
+		} else {
+			p[i] = key[(r.read-int64(len(start)))%int64(len(key))]
+		}
+		r.read++
+	}
+	return len(p), nil
+}
+
+func TestDecodeJWKSResponseSizeCap(t *testing.T) {
+	body := &infiniteKeySet{}
+	var raw rawJWKS
+	err := decodeJWKSResponse("application/json", body, &raw)
+	if err == nil || !strings.Contains(err.Error(), "byte limit") {
+		t.Fatalf("decode error = %v, want the size limit", err)
+	}
+	// the decoder reads ahead a little, but must stop around the limit.
+	if body.read > 2*maxJWKSBytes {
+		t.Errorf("read %d bytes of the stream, want it to stop near %d", body.read, maxJWKSBytes)
+	}
+}
+
+func TestDecodeJWKSResponse(t *testing.T) {
+	big := make([]jose.JSONWebKey, 0, 200)
+	for i := range 200 {
+		big = append(big, testKey(t, fmt.Sprint(i)))
+	}
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		wantKeys    int
+		wantError   string
+	}{
+		{name: "key set", contentType: "application/json", body: string(testKeySetJSON(t, testKey(t, "a"))), wantKeys: 1},
+		{name: "jwk-set content type", contentType: "application/jwk-set+json", body: string(testKeySetJSON(t, testKey(t, "a"))), wantKeys: 1},
+		{name: "large streamed key set under the cap", contentType: "application/json", body: string(testKeySetJSON(t, big...)), wantKeys: 200},
+		{name: "trailing whitespace", contentType: "application/json", body: `{"keys":[]}` + "\n\n", wantKeys: 0},
+		{name: "trailing data", contentType: "application/json", body: `{"keys":[]}{}`, wantError: "unexpected data after the key set"},
+		{name: "html error page", contentType: "text/html", body: "<html><body>502 Bad Gateway</body></html>", wantError: `unexpected content type "text/html", body: "<html><body>502 Bad Gateway`},
+		{name: "truncated", contentType: "application/json", body: `{"keys":[`, wantError: "unexpected EOF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var raw rawJWKS
+			err := decodeJWKSResponse(tc.contentType, strings.NewReader(tc.body), &raw)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("decode error = %v, want one containing %q", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(raw.Keys) != tc.wantKeys {
+				t.Errorf("decoded %d keys, want %d", len(raw.Keys), tc.wantKeys)
+			}
+		})
+	}
+}
+
+// countingLimiter is a rate limiter that allows everything, counting the
+// requests it was asked about.
+type countingLimiter struct {
+	waits atomic.Int32
+}
+
+func (l *countingLimiter) TryAccept() bool            { return true }
+func (l *countingLimiter) Accept()                    { l.waits.Add(1) }
+func (l *countingLimiter) Stop()                      {}
+func (l *countingLimiter) QPS() float32               { return 0 }
+func (l *countingLimiter) Wait(context.Context) error { l.waits.Add(1); return nil }
+
+// newTestAPIServer starts a fake API server serving its discovery document and
+// key set, and returns a client for it throttled by rl.
+func newTestAPIServer(t *testing.T, keys []byte, rl *countingLimiter) (*httptest.Server, *rest.RESTClient) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.Handle("GET /.well-known/openid-configuration", serveJSON(testMetadataJSON(t, "https://kubernetes.default.svc", srv.URL+"/openid/v1/jwks")))
+	mux.Handle("GET /openid/v1/jwks", serveJSON(keys))
+
+	config := &rest.Config{Host: srv.URL}
+	if rl != nil {
+		config.RateLimiter = rl
+	}
+	cl, err := apiServerClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, cl
+}
+
+func TestAPIServerJWKSRateLimited(t *testing.T) {
+	rl := &countingLimiter{}
+	srv, cl := newTestAPIServer(t, testKeySetJSON(t, testKey(t, "a")), rl)
+
+	src := &apiServerSource{cl: cl, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}
+	ks, err := src.jwks(context.Background(), srv.URL+"/openid/v1/jwks")
+	if err != nil {
+		t.Fatalf("jwks: %v", err)
+	}
+	if len(ks.Keys) != 1 {
+		t.Errorf("got %d keys, want 1", len(ks.Keys))
+	}
+	if got := rl.waits.Load(); got != 1 {
+		t.Errorf("rate limiter consulted %d times for the key set, want 1", got)
+	}
+}
+
+func TestAPIServerJWKSStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = io.WriteString(w, "upstream down")
+	}))
+	defer srv.Close()
+	cl, err := apiServerClient(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&apiServerSource{cl: cl, accept: defaultDiscoveryAccept}).jwks(context.Background(), "/openid/v1/jwks")
+	if err == nil || !strings.Contains(err.Error(), "502") || !strings.Contains(err.Error(), "upstream down") {
+		t.Fatalf("jwks error = %v, want the status and body", err)
+	}
+}
+
+func TestAPIServerDiscoveryAuthFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		code           int
+		serviceAccount string
+		want           []string
+		wantForbidden  bool
+	}{
+		{
+			name: "unauthorized",
+			code: http.StatusUnauthorized,
+			want: []string{"did not accept our credentials", "token"},
+		},
+		{
+			name:          "forbidden",
+			code:          http.StatusForbidden,
+			wantForbidden: true,
+			want: []string{
+				"system:service-account-issuer-discovery ClusterRole",
+				"kubectl create clusterrolebinding k8soidcpublisher-issuer-discovery --clusterrole=system:service-account-issuer-discovery --serviceaccount=<namespace>:<name>",
+			},
+		},
+		{
+			name:           "forbidden in cluster",
+			code:           http.StatusForbidden,
+			serviceAccount: "oidc:publisher",
+			wantForbidden:  true,
+			want: []string{
+				"kubectl create clusterrolebinding k8soidcpublisher-issuer-discovery --clusterrole=system:service-account-issuer-discovery --serviceaccount=oidc:publisher",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.code)
+				_, _ = fmt.Fprintf(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":%q,"code":%d}`, http.StatusText(tc.code), tc.code)
+			}))
+			defer srv.Close()
+			cl, err := apiServerClient(&rest.Config{Host: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := &apiServerSource{cl: cl, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept, serviceAccount: tc.serviceAccount}
+			_, _, err = src.discover(context.Background())
+			if err == nil {
+				t.Fatal("discovery succeeded")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+
+			var fe *forbiddenError
+			if errors.As(err, &fe) != tc.wantForbidden {
+				t.Fatalf("error is a forbiddenError: %t, want %t", !tc.wantForbidden, tc.wantForbidden)
+			}
+			if tc.serviceAccount != "" {
+				m := fe.rbacManifest()
+				for _, want := range []string{"name: system:service-account-issuer-discovery", "kind: ServiceAccount", "name: publisher", "namespace: oidc"} {
+					if !strings.Contains(m, want) {
+						t.Errorf("RBAC manifest doesn't contain %q:\n%s", want, m)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoveryAcceptHeader(t *testing.T) {
+	for _, accept := range []string{defaultDiscoveryAccept, "application/jwk-set+json, application/json;q=0.9"} {
+		t.Run(accept, func(t *testing.T) {
+			var (
+				mu  sync.Mutex
+				got = map[string]string{}
+			)
+			record := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					got[r.URL.Path] = r.Header.Get("Accept")
+					mu.Unlock()
+					next.ServeHTTP(w, r)
+				})
+			}
+			accepted := func(path string) string {
+				mu.Lock()
+				defer mu.Unlock()
+				return got[path]
+			}
+
+			t.Run("API server", func(t *testing.T) {
+				mux := http.NewServeMux()
+				srv := httptest.NewServer(record(mux))
+				defer srv.Close()
+				mux.Handle("GET /.well-known/openid-configuration", serveJSON(testMetadataJSON(t, "https://kubernetes.default.svc", srv.URL+"/openid/v1/jwks")))
+				mux.Handle("GET /openid/v1/jwks", serveJSON(testKeySetJSON(t, testKey(t, "a"))))
+				cl, err := apiServerClient(&rest.Config{Host: srv.URL})
+				if err != nil {
+					t.Fatal(err)
+				}
+				p := &publisher{src: &apiServerSource{cl: cl, path: defaultDiscoveryPath, accept: accept}, log: slog.Default()}
+				p.addSink("capture", &captureSink{})
+				if err := p.refresh(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				for _, path := range []string{"/.well-known/openid-configuration", "/openid/v1/jwks"} {
+					if got := accepted(path); got != accept {
+						t.Errorf("%s requested with Accept %q, want %q", path, got, accept)
+					}
+				}
+			})
+
+			t.Run("issuer", func(t *testing.T) {
+				mux := http.NewServeMux()
+				srv := httptest.NewServer(record(mux))
+				defer srv.Close()
+				mux.Handle("GET /.well-known/openid-configuration", serveJSON(testMetadataJSON(t, srv.URL, srv.URL+"/keys")))
+				mux.Handle("GET /keys", serveJSON(testKeySetJSON(t, testKey(t, "a"))))
+				p := &publisher{src: &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: accept}, log: slog.Default()}
+				p.addSink("capture", &captureSink{})
+				if err := p.refresh(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				for _, path := range []string{"/.well-known/openid-configuration", "/keys"} {
+					if got := accepted(path); got != accept {
+						t.Errorf("%s requested with Accept %q, want %q", path, got, accept)
+					}
+				}
+			})
+		})
+	}
+}
+
+// badGatewayPage is the error page a proxy in front of the upstream may serve.
+const badGatewayPage = "<html>\n<head><title>502 Bad Gateway</title></head>\n<body><center><h1>502 Bad Gateway</h1></center></body>\n</html>\n"
+
+func TestUnmarshalJSONResponse(t *testing.T) {
+	long := "<html>" + strings.Repeat("x", 2*maxBodySnippet) + "</html>"
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		wantError   []string
+	}{
+		{name: "json", contentType: "application/json", body: `{"issuer":"https://example.com"}`},
+		{name: "json with charset", contentType: "application/json; charset=utf-8", body: `{"issuer":"https://example.com"}`},
+		{name: "+json suffix", contentType: "application/jwk-set+json", body: `{"issuer":"https://example.com"}`},
+		{name: "no content type", body: `{"issuer":"https://example.com"}`},
+		{name: "html error page", contentType: "text/html", body: badGatewayPage, wantError: []string{`unexpected content type "text/html"`, "502 Bad Gateway"}},
+		{name: "html served as json", contentType: "application/json", body: badGatewayPage, wantError: []string{"invalid character '<'", "502 Bad Gateway"}},
+		{name: "long body truncated", contentType: "text/html", body: long, wantError: []string{"truncated", "bytes total"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var md struct {
+				Issuer string `json:"issuer"`
+			}
+			err := unmarshalJSONResponse(tc.contentType, []byte(tc.body), &md)
+			if tc.wantError == nil {
+				if err != nil {
+					t.Fatalf("unmarshal: %v", err)
+				}
+				if md.Issuer != "https://example.com" {
+					t.Errorf("issuer = %q, want https://example.com", md.Issuer)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("unmarshal succeeded, want an error")
+			}
+			for _, want := range tc.wantError {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+			if len(err.Error()) > 2*maxBodySnippet+200 {
+				t.Errorf("error is %d bytes long, want the body truncated", len(err.Error()))
+			}
+		})
+	}
+}
+
+// htmlProxy serves an HTML error page with status in place of the upstream.
+func htmlProxy(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, badGatewayPage)
+	}
+}
+
+func TestDiscoverHTMLErrorPage(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusOK} {
+		t.Run(fmt.Sprint(status), func(t *testing.T) {
+			srv := httptest.NewServer(htmlProxy(status))
+			defer srv.Close()
+			cl, err := apiServerClient(&rest.Config{Host: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, src := range map[string]discoverySource{
+				"api server": &apiServerSource{cl: cl, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept},
+				"issuer":     &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept},
+			} {
+				_, _, err := src.discover(context.Background())
+				if err == nil {
+					t.Fatalf("%s: discover succeeded, want an error", name)
+				}
+				if !strings.Contains(err.Error(), "502 Bad Gateway") {
+					t.Errorf("%s: error %q doesn't include the page", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshKeepsPublishedOnHTMLErrorPage(t *testing.T) {
+	var proxyBroken atomic.Bool
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proxyBroken.Load() {
+			htmlProxy(http.StatusBadGateway)(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	mux.Handle("GET /.well-known/openid-configuration", serveJSON(testMetadataJSON(t, srv.URL, srv.URL+"/keys")))
+	mux.Handle("GET /keys", serveJSON(testKeySetJSON(t, testKey(t, "a"))))
+
+	st := &captureSink{}
+	p := &publisher{src: &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}, log: slog.Default()}
+	p.addSink("capture", st)
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	md, ks, upstream := st.md, st.ks, p.lastUpstream()
+
+	proxyBroken.Store(true)
+	if err := p.refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "502 Bad Gateway") {
+		t.Fatalf("refresh error = %v, want one including the error page", err)
+	}
+	if st.md != md || st.ks != ks {
+		t.Error("sink was updated by a failed refresh")
+	}
+	if !bytes.Equal(p.lastUpstream(), upstream) {
+		t.Errorf("last upstream document = %s, want what was last discovered", p.lastUpstream())
+	}
+	if !p.failing() {
+		t.Error("publisher isn't failing after the refresh failed")
+	}
+}
+
+func TestInlineJWKS(t *testing.T) {
+	inline, fetched := testKey(t, "inline"), testKey(t, "fetched")
+	for _, tc := range []struct {
+		name string
+		// jwks is the discovery document's jwks member, if set.
+		jwks      json.RawMessage
+		wantKID   string
+		wantHits  int32
+		wantError string
+	}{
+		{name: "inline", jwks: testKeySetJSON(t, inline), wantKID: "inline"},
+		{name: "no inline keys", wantKID: "fetched", wantHits: 1},
+		// an empty set is used, not fetched, so it's refused as degraded.
+		{name: "empty inline set", jwks: json.RawMessage(`{"keys":[]}`), wantError: "key set has no keys"},
+		{name: "malformed inline key", jwks: json.RawMessage(`{"keys":[{"kty":"EC","kid":"bad","crv":"P-256","x":"AQ","y":"AQ"}]}`), wantError: `kid "bad"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits atomic.Int32
+			mux := http.NewServeMux()
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			doc := map[string]any{}
+			if err := json.Unmarshal(testMetadataJSON(t, srv.URL, srv.URL+"/keys"), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if tc.jwks != nil {
+				doc["jwks"] = tc.jwks
+			}
+			b, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux.Handle("GET /.well-known/openid-configuration", serveJSON(b))
+			mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				serveJSON(testKeySetJSON(t, fetched))(w, r)
+			})
+
+			st := &captureSink{}
+			p := &publisher{src: &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}, log: slog.Default()}
+			p.addSink("capture", st)
+			err = p.refresh(context.Background())
+			if got := hits.Load(); got != tc.wantHits {
+				t.Errorf("jwks_uri fetched %d times, want %d", got, tc.wantHits)
+			}
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("refresh error = %v, want one containing %q", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("refresh: %v", err)
+			}
+			var kids []string
+			for _, k := range st.ks.Keys {
+				kids = append(kids, k.KeyID)
+			}
+			if strings.Join(kids, ",") != tc.wantKID {
+				t.Errorf("published keys %q, want %q", kids, tc.wantKID)
+			}
+		})
+	}
+}
+
+func TestAPIServerDiscoveryRedirect(t *testing.T) {
+	var elsewhereHits atomic.Int32
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhereHits.Add(1)
+		serveJSON(testMetadataJSON(t, "https://kubernetes.default.svc", "https://kubernetes.default.svc/openid/v1/jwks"))(w, r)
+	}))
+	defer elsewhere.Close()
+
+	for _, tc := range []struct {
+		name string
+		// location is where discovery is redirected, relative to the API
+		// server.
+		location  func(apiServer string) string
+		code      int
+		wantError string
+	}{
+		{name: "301 to a trailing slash", code: http.StatusMovedPermanently, location: func(string) string { return "/.well-known/openid-configuration/" }},
+		{name: "308 on the same origin", code: http.StatusPermanentRedirect, location: func(s string) string { return s + "/.well-known/openid-configuration/" }},
+		{name: "302 to another origin", code: http.StatusFound, location: func(string) string { return elsewhere.URL + "/.well-known/openid-configuration" }, wantError: "another origin"},
+		{name: "redirect loop", code: http.StatusMovedPermanently, location: func(string) string { return "/.well-known/openid-configuration" }, wantError: "stopped after 5 redirects"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, tc.location(srv.URL), tc.code)
+			})
+			mux.Handle("GET /.well-known/openid-configuration/", serveJSON(testMetadataJSON(t, "https://kubernetes.default.svc", "https://kubernetes.default.svc/openid/v1/jwks")))
+			cl, err := apiServerClient(&rest.Config{Host: srv.URL, BearerToken: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			md, _, err := (&apiServerSource{cl: cl, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}).discover(context.Background())
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("discover error = %v, want one containing %q", err, tc.wantError)
+				}
+				// the credentials mustn't follow us elsewhere.
+				if got := elsewhereHits.Load(); got != 0 {
+					t.Errorf("redirected to another origin %d times", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discover: %v", err)
+			}
+			if md.Issuer != "https://kubernetes.default.svc" {
+				t.Errorf("discovered issuer %q", md.Issuer)
+			}
+		})
+	}
+}
+
+func TestIssuerDiscoveryRedirect(t *testing.T) {
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	for _, tc := range []struct {
+		name string
+		// location is where discovery is redirected, given the issuer and
+		// another server.
+		location  func(issuer, other string) string
+		wantError string
+	}{
+		{name: "same origin", location: func(issuer, _ string) string { return issuer + "/moved" }},
+		{name: "another origin", location: func(_, other string) string { return other + "/moved" }},
+		{name: "https to http", location: func(string, string) string { return plain.URL + "/moved" }, wantError: "refusing redirect"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			srv := httptest.NewTLSServer(mux)
+			defer srv.Close()
+			issuer := srv.URL
+			other := httptest.NewTLSServer(serveJSON(testMetadataJSON(t, issuer, issuer+"/keys")))
+			defer other.Close()
+			mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, tc.location(issuer, other.URL), http.StatusMovedPermanently)
+			})
+			mux.Handle("GET /moved", serveJSON(testMetadataJSON(t, issuer, issuer+"/keys")))
+
+			// both test servers share a certificate, so either client
+			// trusts both.
+			client := srv.Client()
+			client.CheckRedirect = checkRedirect(false)
+			_, _, err := (&issuerSource{client: client, issuer: issuer, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}).discover(context.Background())
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("discover error = %v, want one containing %q", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discover: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: discoverypb/discovery.proto
+
+package discoverypb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GetDocumentRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// cluster is the name of the cluster in -clusters-file to return the
+	// document for. It can be empty when a single cluster is published.
+	Cluster       string `protobuf:"bytes,1,opt,name=cluster,proto3" json:"cluster,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetDocumentRequest) Reset() {
+	*x = GetDocumentRequest{}
+	mi := &file_discoverypb_discovery_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetDocumentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetDocumentRequest) ProtoMessage() {}
+
+func (x *GetDocumentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_discoverypb_discovery_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetDocumentRequest.ProtoReflect.Descriptor instead.
+func (*GetDocumentRequest) Descriptor() ([]byte, []int) {
+	return file_discoverypb_discovery_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GetDocumentRequest) GetCluster() string {
+	if x != nil {
+		return x.Cluster
+	}
+	return ""
+}
+
+type Document struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// json is the document, encoded as it's served over HTTP.
+	Json []byte `protobuf:"bytes,1,opt,name=json,proto3" json:"json,omitempty"`
+	// content_hash identifies the published documents, as served in
+	// X-Content-Hash and the k8soidcpublisher_content_info metric.
+	ContentHash   string `protobuf:"bytes,2,opt,name=content_hash,json=contentHash,proto3" json:"content_hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Document) Reset() {
+	*x = Document{}
+	mi := &file_discoverypb_discovery_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Document) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Document) ProtoMessage() {}
+
+func (x *Document) ProtoReflect() protoreflect.Message {
+	mi := &file_discoverypb_discovery_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Document.ProtoReflect.Descriptor instead.
+func (*Document) Descriptor() ([]byte, []int) {
+	return file_discoverypb_discovery_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Document) GetJson() []byte {
+	if x != nil {
+		return x.Json
+	}
+	return nil
+}
+
+func (x *Document) GetContentHash() string {
+	if x != nil {
+		return x.ContentHash
+	}
+	return ""
+}
+
+var File_discoverypb_discovery_proto protoreflect.FileDescriptor
+
+const file_discoverypb_discovery_proto_rawDesc = "" +
+	"\n" +
+	"\x1bdiscoverypb/discovery.proto\x12\x13k8soidcpublisher.v1\".\n" +
+	"\x12GetDocumentRequest\x12\x18\n" +
+	"\acluster\x18\x01 \x01(\tR\acluster\"A\n" +
+	"\bDocument\x12\x12\n" +
+	"\x04json\x18\x01 \x01(\fR\x04json\x12!\n" +
+	"\fcontent_hash\x18\x02 \x01(\tR\vcontentHash2\xb5\x01\n" +
+	"\tDiscovery\x12U\n" +
+	"\vGetMetadata\x12'.k8soidcpublisher.v1.GetDocumentRequest\x1a\x1d.k8soidcpublisher.v1.Document\x12Q\n" +
+	"\aGetJWKS\x12'.k8soidcpublisher.v1.GetDocumentRequest\x1a\x1d.k8soidcpublisher.v1.DocumentB0Z.github.com/lstoll/k8soidcpublisher/discoverypbb\x06proto3"
+
+var (
+	file_discoverypb_discovery_proto_rawDescOnce sync.Once
+	file_discoverypb_discovery_proto_rawDescData []byte
+)
+
+func file_discoverypb_discovery_proto_rawDescGZIP() []byte {
+	file_discoverypb_discovery_proto_rawDescOnce.Do(func() {
+		file_discoverypb_discovery_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_discoverypb_discovery_proto_rawDesc), len(file_discoverypb_discovery_proto_rawDesc)))
+	})
+	return file_discoverypb_discovery_proto_rawDescData
+}
+
+var file_discoverypb_discovery_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_discoverypb_discovery_proto_goTypes = []any{
+	(*GetDocumentRequest)(nil), // 0: k8soidcpublisher.v1.GetDocumentRequest
+	(*Document)(nil),           // 1: k8soidcpublisher.v1.Document
+}
+var file_discoverypb_discovery_proto_depIdxs = []int32{
+	0, // 0: k8soidcpublisher.v1.Discovery.GetMetadata:input_type -> k8soidcpublisher.v1.GetDocumentRequest
+	0, // 1: k8soidcpublisher.v1.Discovery.GetJWKS:input_type -> k8soidcpublisher.v1.GetDocumentRequest
+	1, // 2: k8soidcpublisher.v1.Discovery.GetMetadata:output_type -> k8soidcpublisher.v1.Document
+	1, // 3: k8soidcpublisher.v1.Discovery.GetJWKS:output_type -> k8soidcpublisher.v1.Document
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_discoverypb_discovery_proto_init() }
+func file_discoverypb_discovery_proto_init() {
+	if File_discoverypb_discovery_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_discoverypb_discovery_proto_rawDesc), len(file_discoverypb_discovery_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_discoverypb_discovery_proto_goTypes,
+		DependencyIndexes: file_discoverypb_discovery_proto_depIdxs,
+		MessageInfos:      file_discoverypb_discovery_proto_msgTypes,
+	}.Build()
+	File_discoverypb_discovery_proto = out.File
+	file_discoverypb_discovery_proto_goTypes = nil
+	file_discoverypb_discovery_proto_depIdxs = nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// eksCompatKeySet rewrites ks to match the key set served by EKS's OIDC
+// endpoints, which is what AWS IAM expects of an OIDC provider used for IAM
+// roles for service accounts. Every key is an RSA or EC signing key with kty,
+// use, kid and alg set, and nothing else beyond the key's parameters. Keys IAM
+// can't use are dropped with a warning.
+func eksCompatKeySet(ks *jose.JSONWebKeySet, log *slog.Logger) (*jose.JSONWebKeySet, error) {
+	out := &jose.JSONWebKeySet{}
+	for _, k := range ks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			log.Warn("Dropping key not used for signatures, for -eks-compat", "kid", k.KeyID, "use", k.Use)
+			continue
+		}
+		alg := eksKeyAlgorithm(k)
+		if alg == "" {
+			log.Warn("Dropping key with a type AWS IAM doesn't support, for -eks-compat", "kid", k.KeyID, "kty", keyType(k))
+			continue
+		}
+
+		ek := jose.JSONWebKey{Key: k.Key, KeyID: k.KeyID, Algorithm: k.Algorithm, Use: "sig"}
+		if ek.Algorithm == "" {
+			ek.Algorithm = alg
+		}
+		if ek.KeyID == "" {
+			kid, err := eksKeyID(k)
+			if err != nil {
+				return nil, fmt.Errorf("deriving kid: %v", err)
+			}
+			ek.KeyID = kid
+		}
+		out.Keys = append(out.Keys, ek)
+	}
+	return out, nil
+}
+
+// eksKeyAlgorithm returns the signature algorithm EKS publishes for k's type,
+// or an empty string if IAM doesn't support it.
+func eksKeyAlgorithm(k jose.JSONWebKey) string {
+	switch pub := k.Key.(type) {
+	case *rsa.PublicKey:
+		return string(jose.RS256)
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return string(jose.ES256)
+		case elliptic.P384():
+			return string(jose.ES384)
+		case elliptic.P521():
+			return string(jose.ES512)
+		}
+	}
+	return ""
+}
+
+// eksKeyID derives a kid for k the same way the API server does for its
+// service account keys, as the unpadded base64url SHA-256 of the public key's
+// PKIX encoding.
+func eksKeyID(k jose.JSONWebKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(k.Key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
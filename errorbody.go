@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// errorBodyStatuses are the statuses whose bodies errorBodies replaces.
+var errorBodyStatuses = []int{http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusServiceUnavailable}
+
+// errorBodies replaces the bodies of 404, 405 and 503 responses to relying
+// parties, for clients that only handle errors of a particular shape. Our own
+// endpoints' responses are left alone.
+type errorBodies struct {
+	// tmpl renders the bodies. If nil, only the mux's plain text 404s and
+	// 405s are replaced, with JSON like the rest of our errors.
+	tmpl        *template.Template
+	contentType string
+}
+
+// errorBodyData is what the error body template is executed with.
+type errorBodyData struct {
+	Status     int
+	StatusText string
+	Method     string
+	Path       string
+}
+
+// loadErrorBodies parses the template in path for bodies served as
+// contentType. It's executed for each status up front, so a broken template
+// or one rendering invalid JSON for a JSON content type fails at startup
+// rather than on a request.
+func loadErrorBodies(path, contentType string) (*errorBodies, error) {
+	if err := validateMIMEType(contentType); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(path).Funcs(template.FuncMap{"json": jsonString}).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	isJSON := mt == "application/json" || strings.HasSuffix(mt, "+json")
+	for _, status := range errorBodyStatuses {
+		var buf bytes.Buffer
+		data := errorBodyData{Status: status, StatusText: http.StatusText(status), Method: http.MethodGet, Path: `/a "quoted" path`}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		if isJSON && !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("renders invalid JSON for a %d, use the json function to quote values: %s", status, bodySnippet(buf.Bytes()))
+		}
+	}
+	return &errorBodies{tmpl: tmpl, contentType: contentType}, nil
+}
+
+// jsonString returns v as a JSON value, for templates to quote with.
+func jsonString(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// wrap returns next with the error bodies replaced, except for the internal
+// routes. internal is keyed by mux pattern.
+func (e *errorBodies) wrap(internal map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorBodyWriter{ResponseWriter: w, bodies: e, internal: internal, r: r}, r)
+	})
+}
+
+// errorBodyWriter replaces the body of an error response once its status is
+// written, discarding the handler's.
+type errorBodyWriter struct {
+	http.ResponseWriter
+	bodies   *errorBodies
+	internal map[string]bool
+	r        *http.Request
+	// replaced is set once the body has been replaced.
+	replaced bool
+}
+
+func (w *errorBodyWriter) WriteHeader(status int) {
+	if !w.replace(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.replaced = true
+
+	var body []byte
+	if w.bodies.tmpl == nil {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(map[string]string{"error": strings.ToLower(http.StatusText(status))})
+		body = append(body, '\n')
+	} else {
+		var buf bytes.Buffer
+		data := errorBodyData{Status: status, StatusText: http.StatusText(status), Method: w.r.Method, Path: w.r.URL.Path}
+		if err := w.bodies.tmpl.Execute(&buf, data); err != nil {
+			slog.Error("Failed to render error body", "status", status, "error", err)
+		}
+		w.Header().Set("Content-Type", w.bodies.contentType)
+		body = buf.Bytes()
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+	if _, err := w.ResponseWriter.Write(body); err != nil {
+		slog.Debug("Failed to write error body", "error", err)
+	}
+}
+
+// replace reports whether the body for status should be replaced.
+func (w *errorBodyWriter) replace(status int) bool {
+	// the mux sets the pattern before calling the handler, and leaves it
+	// empty when nothing matched.
+	if w.internal[w.r.Pattern] {
+		return false
+	}
+	if w.bodies.tmpl == nil {
+		// ours are all JSON already, the mux's are plain text.
+		return (status == http.StatusNotFound || status == http.StatusMethodNotAllowed) &&
+			strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain")
+	}
+	return slices.Contains(errorBodyStatuses, status)
+}
+
+func (w *errorBodyWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
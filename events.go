@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// The reasons of the events we record.
+const (
+	eventKeysRotated        = "KeysRotated"
+	eventDiscoveryFailing   = "DiscoveryFailing"
+	eventDiscoveryRecovered = "DiscoveryRecovered"
+)
+
+// clusterEvents records Kubernetes Events about a cluster's publisher against
+// an object, so key rotations and long running discovery failures show up in
+// kubectl get events. Events go through client-go's recorder, which
+// aggregates repeats and rate limits them per object so a flapping upstream
+// can't flood the API server. A nil clusterEvents records nothing.
+type clusterEvents struct {
+	cluster  string
+	recorder record.EventRecorder
+	object   *corev1.ObjectReference
+	// failingAfter is how long discovery has to have been failing before
+	// it's recorded.
+	failingAfter time.Duration
+}
+
+// newEventRecorder returns a recorder writing events to namespace with cs,
+// and a func stopping it.
+func newEventRecorder(cs kubernetes.Interface, namespace string) (record.EventRecorder, func()) {
+	b := record.NewBroadcaster()
+	b.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events(namespace)})
+	return b.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8soidcpublisher"}), b.Shutdown
+}
+
+// parseEventObject parses ref, in Kind/name form, as an object in namespace.
+// The API version is left unset, so the events can't be matched to the
+// object by UID, but are listed against it by kind and name.
+func parseEventObject(ref, namespace string) (*corev1.ObjectReference, error) {
+	kind, name, ok := strings.Cut(ref, "/")
+	if !ok || kind == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("must be in Kind/name form, got %q", ref)
+	}
+	return &corev1.ObjectReference{Kind: kind, Namespace: namespace, Name: name}, nil
+}
+
+// keysRotated records that the published key IDs changed from prev to cur.
+func (e *clusterEvents) keysRotated(prev, cur []string) {
+	if e == nil {
+		return
+	}
+	var added, removed []string
+	for _, kid := range cur {
+		if !slices.Contains(prev, kid) {
+			added = append(added, kid)
+		}
+	}
+	for _, kid := range prev {
+		if !slices.Contains(cur, kid) {
+			removed = append(removed, kid)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	e.recorder.Eventf(e.object, corev1.EventTypeNormal, eventKeysRotated,
+		"Cluster %s published keys changed, added [%s], removed [%s]", e.cluster, strings.Join(added, ", "), strings.Join(removed, ", "))
+}
+
+// discoveryFailing records that discovery has been failing since since, with
+// err the latest failure.
+func (e *clusterEvents) discoveryFailing(since time.Time, err error) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.object, corev1.EventTypeWarning, eventDiscoveryFailing,
+		"Cluster %s discovery has been failing for %s: %v", e.cluster, time.Since(since).Round(time.Second), err)
+}
+
+// discoveryRecovered records that discovery succeeded after failing since
+// since.
+func (e *clusterEvents) discoveryRecovered(since time.Time) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(e.object, corev1.EventTypeNormal, eventDiscoveryRecovered,
+		"Cluster %s discovery recovered after failing for %s", e.cluster, time.Since(since).Round(time.Second))
+}
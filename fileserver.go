@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// fileServer serves the documents in a directory read only, for -serve-dir,
+// e.g. the -publish-dir of a publisher running elsewhere. A document with a
+// .gz copy alongside it is served that copy, as is, to clients that accept
+// gzip, so high traffic static serving doesn't pay for compression.
+type fileServer struct {
+	root *os.Root
+	// gzip compresses the documents without a .gz copy, on each request.
+	gzip         bool
+	cacheControl string
+}
+
+// newFileServer returns a server for the documents under dir, which can't be
+// escaped by the request path.
+func newFileServer(dir string, gzip bool, cacheControl string) (*fileServer, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &fileServer{root: root, gzip: gzip, cacheControl: cacheControl}, nil
+}
+
+func (f *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// only the documents themselves are cacheable.
+	w.Header().Set("Cache-Control", "no-store")
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || strings.HasSuffix(name, ".gz") {
+		// the compressed copies are only served in place of their
+		// documents.
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	body, modTime, err := f.read(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	case err != nil:
+		slog.Error("Failed to read served file", "path", name, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+
+	doc := &document{body: body, etag: etagOf(body)}
+	gzipETag := strings.TrimSuffix(doc.etag, `"`) + `-gzip"`
+	if gz, ok := f.precompressed(name, modTime); ok {
+		// it may not have been compressed from this version of the
+		// document, so it's tagged by its own content.
+		doc.gzipped, gzipETag = gz, etagOf(gz)
+	} else if f.gzip {
+		if doc.gzipped, err = gzipBytes(body); err != nil {
+			slog.Error("Failed to compress served file", "path", name, "error", err)
+			doc.gzipped = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", fileContentType(name))
+	w.Header().Set("Cache-Control", f.cacheControl)
+	serveEncoded(w, r, doc, gzipETag)
+}
+
+// read returns the contents and modification time of the regular file name.
+func (f *fileServer) read(name string) ([]byte, time.Time, error) {
+	file, err := f.root.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, time.Time{}, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	b, err := io.ReadAll(file)
+	return b, fi.ModTime(), err
+}
+
+// precompressed returns the .gz copy of name, if there is one at least as new
+// as the document modified at modTime. An older copy is of a previous version,
+// which mustn't be served in place of the current keys.
+func (f *fileServer) precompressed(name string, modTime time.Time) ([]byte, bool) {
+	gz, gzModTime, err := f.read(name + ".gz")
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, false
+	case err != nil:
+		slog.Warn("Failed to read precompressed file, serving it uncompressed", "path", name+".gz", "error", err)
+		return nil, false
+	case gzModTime.Before(modTime):
+		slog.Warn("Precompressed file is older than its document, serving it uncompressed", "path", name+".gz")
+		return nil, false
+	}
+	return gz, true
+}
+
+// fileContentType returns the Content-Type of the served file name. The
+// discovery document has no extension, but like the rest is JSON.
+func fileContentType(name string) string {
+	ext := path.Ext(name)
+	if ext == "" || ext == ".json" {
+		return "application/json"
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// handler returns the handler for -serve-dir, serving the files along with a
+// liveness check.
+func (f *fileServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.Handle("GET /", f)
+	return requestID(instrument(nil, mux))
+}
+
+// serveFiles serves f on addr until ctx is done, then shuts down, waiting up
+// to shutdownTimeout for in-flight requests.
+func serveFiles(ctx context.Context, addr string, f *fileServer, shutdownTimeout time.Duration) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: f.handler()}
+	errc := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", ln.Addr().String(), "dir", f.root.Name())
+		errc <- server.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("Received shutdown signal, initiating graceful shutdown...")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Server shutdown timed out, closing remaining connections", "timeout", shutdownTimeout)
+		return server.Close()
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestFileServer returns a file server for a directory holding files,
+// mapping paths to their contents. They're all modified at the same time, as
+// gzip -k leaves them.
+func newTestFileServer(t *testing.T, gzip bool, files map[string][]byte) (*fileServer, string) {
+	t.Helper()
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Minute)
+	for name, b := range files {
+		p := filepath.Join(dir, name)
+		if err := writeFileAtomic(p, b); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := newFileServer(dir, gzip, "public, max-age=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.root.Close() })
+	return f, dir
+}
+
+func mustGzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	gz, err := gzipBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gz
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("not gzipped: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestFileServerPrecompressed(t *testing.T) {
+	const jwks = ".well-known/jwks.json"
+	body := []byte(`{"keys":[]}`)
+	// a different compression of the same body, so it's recognisably the
+	// file that was served rather than one compressed on the fly.
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	_, _ = zw.Write(body)
+	_ = zw.Close()
+	precompressed := buf.Bytes()
+
+	for _, tc := range []struct {
+		name           string
+		gzip           bool
+		files          map[string][]byte
+		acceptEncoding string
+		wantEncoding   string
+		wantVary       bool
+		// wantBody is what's served, before decompression.
+		wantBody []byte
+		wantETag string
+	}{
+		{
+			name:           "precompressed to a gzip client",
+			files:          map[string][]byte{jwks: body, jwks + ".gz": precompressed},
+			acceptEncoding: "gzip, br",
+			wantEncoding:   "gzip",
+			wantVary:       true,
+			wantBody:       precompressed,
+			wantETag:       etagOf(precompressed),
+		},
+		{
+			name:     "precompressed to a client without gzip",
+			files:    map[string][]byte{jwks: body, jwks + ".gz": precompressed},
+			wantVary: true,
+			wantBody: body,
+			wantETag: etagOf(body),
+		},
+		{
+			name:           "precompressed to a client refusing gzip",
+			files:          map[string][]byte{jwks: body, jwks + ".gz": precompressed},
+			acceptEncoding: "gzip;q=0",
+			wantVary:       true,
+			wantBody:       body,
+			wantETag:       etagOf(body),
+		},
+		{
+			name:           "no copy, not compressing",
+			files:          map[string][]byte{jwks: body},
+			acceptEncoding: "gzip",
+			wantBody:       body,
+			wantETag:       etagOf(body),
+		},
+		{
+			name:           "no copy, compressed on the fly",
+			gzip:           true,
+			files:          map[string][]byte{jwks: body},
+			acceptEncoding: "gzip",
+			wantEncoding:   "gzip",
+			wantVary:       true,
+			wantBody:       mustGzip(t, body),
+			wantETag:       `"` + etagOf(body)[1:33] + `-gzip"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, _ := newTestFileServer(t, tc.gzip, tc.files)
+			r := httptest.NewRequest(http.MethodGet, "/"+jwks, nil)
+			if tc.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			f.handler().ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tc.wantEncoding)
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tc.wantVary {
+				t.Errorf("Vary = %q, want Accept-Encoding %t", w.Header().Get("Vary"), tc.wantVary)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "public, max-age=60" {
+				t.Errorf("Cache-Control = %q, want the documents'", got)
+			}
+			if got := w.Header().Get("ETag"); got != tc.wantETag {
+				t.Errorf("ETag = %s, want %s", got, tc.wantETag)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tc.wantBody) {
+				t.Errorf("body = %q, want %q", w.Body, tc.wantBody)
+			}
+			if tc.wantEncoding == "gzip" {
+				if got := gunzip(t, w.Body.Bytes()); !bytes.Equal(got, body) {
+					t.Errorf("decompressed body = %q, want %q", got, body)
+				}
+			}
+
+			// a revalidation with the tag served is answered 304.
+			r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+			w = httptest.NewRecorder()
+			f.handler().ServeHTTP(w, r)
+			if w.Code != http.StatusNotModified {
+				t.Errorf("revalidation = %d, want 304", w.Code)
+			}
+		})
+	}
+}
+
+func TestFileServerStalePrecompressed(t *testing.T) {
+	const jwks = ".well-known/jwks.json"
+	body := []byte(`{"keys":[{"kid":"new"}]}`)
+	f, dir := newTestFileServer(t, false, map[string][]byte{
+		jwks:         body,
+		jwks + ".gz": mustGzip(t, []byte(`{"keys":[{"kid":"old"}]}`)),
+	})
+	// the document has been rewritten since it was compressed.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, jwks+".gz"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/"+jwks, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	f.handler().ServeHTTP(w, r)
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want the outdated copy skipped", got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), body) {
+		t.Errorf("body = %q, want the current document %q", w.Body, body)
+	}
+}
+
+func TestFileServerNotFound(t *testing.T) {
+	f, _ := newTestFileServer(t, false, map[string][]byte{
+		".well-known/jwks.json":    []byte(`{"keys":[]}`),
+		".well-known/jwks.json.gz": mustGzip(t, []byte(`{"keys":[]}`)),
+	})
+	outside := filepath.Join(filepath.Dir(f.root.Name()), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(outside) })
+
+	for _, target := range []string{
+		"/",
+		"/.well-known",
+		"/.well-known/openid-configuration",
+		"/.well-known/jwks.json.gz",
+		"/../secret",
+		"/.well-known/../../secret",
+	} {
+		// straight to the file server, as the mux would redirect the
+		// paths escaping the directory.
+		w := get(f, target)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s = %d, want 404: %s", target, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%s Cache-Control = %q, want no-store", target, got)
+		}
+	}
+	if w := get(f.handler(), "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", w.Code)
+	}
+}
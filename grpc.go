@@ -0,0 +1,88 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative discoverypb/discovery.proto
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/lstoll/k8soidcpublisher/discoverypb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// discoveryServer serves the documents over gRPC, for service meshes that
+// fetch trust data over it. They come from the same cache as the HTTP
+// endpoints, and are refused when those would be.
+type discoveryServer struct {
+	discoverypb.UnimplementedDiscoveryServer
+
+	clusters []*cluster
+	// maintenance is the HTTP server's maintenance mode, which refuses the
+	// documents here too.
+	maintenance *atomic.Bool
+}
+
+func (s *discoveryServer) GetMetadata(_ context.Context, req *discoverypb.GetDocumentRequest) (*discoverypb.Document, error) {
+	return s.document(req.GetCluster(), false)
+}
+
+func (s *discoveryServer) GetJWKS(_ context.Context, req *discoverypb.GetDocumentRequest) (*discoverypb.Document, error) {
+	return s.document(req.GetCluster(), true)
+}
+
+// document returns the cluster's key set or discovery document, with the
+// same checks for staleness as serving them over HTTP.
+func (s *discoveryServer) document(name string, jwks bool) (*discoverypb.Document, error) {
+	if s.maintenance.Load() {
+		return nil, status.Error(codes.Unavailable, "down for maintenance")
+	}
+	c, err := s.cluster(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h := c.sink
+	h.mu.RLock()
+	doc, keys := h.mdDoc, h.keys
+	if jwks {
+		doc = h.ksDoc
+	}
+	h.mu.RUnlock()
+
+	if doc == nil {
+		if h.state.lastSuccess().IsZero() {
+			return nil, status.Error(codes.Unavailable, documentStateInitializing)
+		}
+		return nil, status.Error(codes.Unavailable, documentStateStale)
+	}
+	metadataStale, keysStale := h.documentsStale(h.state)
+	stale := metadataStale
+	if jwks {
+		stale = keysStale
+		if h.independent && keys == 0 {
+			return nil, status.Error(codes.Unavailable, "no keys")
+		}
+	}
+	if stale && !h.failOpen {
+		return nil, status.Error(codes.Unavailable, documentStateStale)
+	}
+	return &discoverypb.Document{Json: doc.body, ContentHash: h.state.contentHash()}, nil
+}
+
+// cluster returns the cluster named name, which may be empty if there's only
+// one.
+func (s *discoveryServer) cluster(name string) (*cluster, error) {
+	if name == "" {
+		if len(s.clusters) == 1 {
+			return s.clusters[0], nil
+		}
+		return nil, status.Error(codes.InvalidArgument, "cluster is required when several are published")
+	}
+	for _, c := range s.clusters {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "unknown cluster %q", name)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// inspect prints the key set p would publish as a table. p's sinks are
+// replaced, so nothing is published.
+func inspect(ctx context.Context, w io.Writer, p *publisher, timeout time.Duration) error {
+	st := &captureSink{}
+	p.sinks = []namedSink{{name: "inspect", Sink: st}}
+	if err := p.warmup(ctx, timeout); err != nil {
+		return fmt.Errorf("discovering documents: %v", err)
+	}
+	return printKeySet(w, st.ks)
+}
+
+// inspectFile prints the key set in file as a table, e.g. one written by the
+// file sink.
+func inspectFile(w io.Writer, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading key set: %v", err)
+	}
+	var raw rawJWKS
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("unmarshaling %s: %v", file, err)
+	}
+	ks, err := parseJWKS(raw, false)
+	if err != nil {
+		return fmt.Errorf("parsing key set from %s: %v", file, err)
+	}
+	return printKeySet(w, ks)
+}
+
+// printKeySet writes a table of the keys in ks, followed by a summary of the
+// key types.
+func printKeySet(w io.Writer, ks *jose.JSONWebKeySet) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KID\tKTY\tUSE\tALG\tSIZE")
+	counts := map[string]int{}
+	for _, k := range ks.Keys {
+		kty := keyType(k)
+		counts[kty]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", orDash(k.KeyID), kty, orDash(k.Use), orDash(k.Algorithm), keySize(k))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	types := make([]string, 0, len(counts))
+	for kty := range counts {
+		types = append(types, kty)
+	}
+	sort.Strings(types)
+	var parts []string
+	for _, kty := range types {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kty], kty))
+	}
+	summary := fmt.Sprintf("\n%d keys", len(ks.Keys))
+	if len(parts) > 0 {
+		summary += ": " + strings.Join(parts, ", ")
+	}
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
+
+// keySize describes the strength of a key parsed by parseJWK, as its modulus
+// size or curve.
+func keySize(k jose.JSONWebKey) string {
+	switch pub := k.Key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("%d bits", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return pub.Curve.Params().Name
+	}
+	if keyType(k) == "OKP" {
+		return "Ed25519"
+	}
+	return "-"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
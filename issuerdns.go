@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	issuerDNSOff    = "off"
+	issuerDNSWarn   = "warn"
+	issuerDNSStrict = "strict"
+)
+
+// issuerDNSTimeout bounds the lookup of the issuer's host.
+const issuerDNSTimeout = 5 * time.Second
+
+// issuerDNSCheck looks up the issuer's host, as relying parties can't fetch
+// the documents from an issuer that doesn't resolve. It's a common mistake
+// to deploy before the issuer's DNS is set up.
+type issuerDNSCheck struct {
+	// strict fails the refresh if the host doesn't resolve, rather than
+	// warning.
+	strict   bool
+	resolver *net.Resolver
+	log      *slog.Logger
+
+	// checked is the last issuer that resolved, or was warned about, so it's
+	// only checked again when the issuer changes. It's only accessed during
+	// a refresh, which are serialized.
+	checked string
+}
+
+// check looks up issuer's host if it hasn't been already. A host that doesn't
+// resolve is an error in strict mode, and a warning otherwise.
+func (c *issuerDNSCheck) check(ctx context.Context, issuer string) error {
+	if c == nil || issuer == c.checked {
+		return nil
+	}
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return fmt.Errorf("parsing issuer %q: %v", issuer, err)
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		// nothing to resolve.
+		c.checked = issuer
+		return nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, issuerDNSTimeout)
+	defer cancel()
+	addrs, err := c.resolver.LookupHost(lookupCtx, host)
+	if err != nil && ctx.Err() != nil {
+		// we're shutting down, which says nothing about the host.
+		return ctx.Err()
+	}
+	if err != nil {
+		if c.strict {
+			return fmt.Errorf("issuer host %s doesn't resolve, relying parties won't be able to reach it: %v", host, err)
+		}
+		c.log.Warn("Issuer host doesn't resolve, relying parties won't be able to reach it", "issuer", issuer, "host", host, "error", err)
+		c.checked = issuer
+		return nil
+	}
+	c.log.Debug("Issuer host resolves", "issuer", issuer, "host", host, "addrs", addrs)
+	c.checked = issuer
+	return nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// rawJWKS is a key set with the keys left unparsed, so each can be checked
+// individually.
+type rawJWKS struct {
+	Keys []json.RawMessage `json:"keys"`
+}
+
+// parseJWKS parses each key in raw, and checks that it is a usable public key.
+// If dropInvalid is set unusable keys are logged and left out of the returned
+// set, otherwise any unusable key is an error.
+func parseJWKS(raw rawJWKS, dropInvalid bool) (*jose.JSONWebKeySet, error) {
+	ks := &jose.JSONWebKeySet{}
+	var errs []error
+	for i, rk := range raw.Keys {
+		k, err := parseJWK(rk)
+		if err == nil {
+			ks.Keys = append(ks.Keys, k)
+			continue
+		}
+
+		// we may not have got as far as the kid, so pull it out directly.
+		var id struct {
+			KeyID string `json:"kid"`
+		}
+		_ = json.Unmarshal(rk, &id)
+
+		if dropInvalid {
+			slog.Warn("Dropping invalid key", "index", i, "kid", id.KeyID, "error", err)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("key %d (kid %q): %v", i, id.KeyID, err))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// parseJWK parses a single key, checking it holds a public key we can actually
+// verify signatures with.
+func parseJWK(b []byte) (jose.JSONWebKey, error) {
+	var k jose.JSONWebKey
+	if err := json.Unmarshal(b, &k); err != nil {
+		return k, err
+	}
+	if !k.IsPublic() {
+		return k, errors.New("not a public key")
+	}
+	if !k.Valid() {
+		return k, errors.New("invalid key parameters")
+	}
+
+	switch pub := k.Key.(type) {
+	case *rsa.PublicKey:
+		if pub.N == nil || pub.N.Sign() <= 0 || pub.E < 2 {
+			return k, errors.New("malformed RSA public key")
+		}
+	case *ecdsa.PublicKey:
+		if _, err := pub.ECDH(); err != nil {
+			return k, fmt.Errorf("unusable EC public key: %v", err)
+		}
+	case ed25519.PublicKey:
+		if len(pub) != ed25519.PublicKeySize {
+			return k, errors.New("malformed Ed25519 public key")
+		}
+	default:
+		return k, fmt.Errorf("unsupported key type %T", k.Key)
+	}
+
+	return k, nil
+}
+
+// defaultAllowedKeyTypes are the key types published by default, which are
+// all the asymmetric types parseJWK accepts.
+const defaultAllowedKeyTypes = "RSA,EC,OKP"
+
+// keyType returns the kty of a key parsed by parseJWK.
+func keyType(k jose.JSONWebKey) string {
+	switch k.Key.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "EC"
+	case ed25519.PublicKey:
+		return "OKP"
+	}
+	return ""
+}
+
+// parseKeyTypes parses a comma separated list of key types, which must be ones
+// parseJWK accepts.
+func parseKeyTypes(s string) ([]string, error) {
+	var types []string
+	for t := range strings.SplitSeq(s, ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case "RSA", "EC", "OKP":
+			types = append(types, t)
+		case "":
+		default:
+			return nil, fmt.Errorf("unsupported key type %q, must be RSA, EC or OKP", t)
+		}
+	}
+	if len(types) == 0 {
+		return nil, errors.New("no key types given")
+	}
+	return types, nil
+}
+
+// filterKeyTypes returns ks without the keys whose type isn't in allowed,
+// logging each one dropped.
+func filterKeyTypes(ks *jose.JSONWebKeySet, allowed []string, log *slog.Logger) *jose.JSONWebKeySet {
+	out := &jose.JSONWebKeySet{}
+	for _, k := range ks.Keys {
+		if kty := keyType(k); !slices.Contains(allowed, kty) {
+			log.Warn("Dropping key with disallowed type", "kid", k.KeyID, "kty", kty)
+			continue
+		}
+		out.Keys = append(out.Keys, k)
+	}
+	return out
+}
+
+const (
+	duplicateKIDsAllow  = "allow"
+	duplicateKIDsFirst  = "first"
+	duplicateKIDsReject = "reject"
+)
+
+// checkDuplicateKIDs handles keys sharing a kid, which is ambiguous for
+// verifiers that look keys up by it. With duplicateKIDsFirst only the first
+// key with each kid is kept, with a warning for the rest, and with
+// duplicateKIDsReject any duplicate is an error. Keys without a kid aren't
+// looked up by it, so they're left alone.
+func checkDuplicateKIDs(ks *jose.JSONWebKeySet, mode string, log *slog.Logger) (*jose.JSONWebKeySet, error) {
+	if mode == duplicateKIDsAllow {
+		return ks, nil
+	}
+	out := &jose.JSONWebKeySet{}
+	seen := map[string]bool{}
+	var dups []string
+	for _, k := range ks.Keys {
+		if k.KeyID != "" && seen[k.KeyID] {
+			if !slices.Contains(dups, k.KeyID) {
+				dups = append(dups, k.KeyID)
+			}
+			if mode == duplicateKIDsFirst {
+				log.Warn("Dropping key with duplicate kid", "kid", k.KeyID, "kty", keyType(k))
+			}
+			continue
+		}
+		seen[k.KeyID] = true
+		out.Keys = append(out.Keys, k)
+	}
+	if len(dups) > 0 && mode == duplicateKIDsReject {
+		return nil, fmt.Errorf("key set has duplicate kids: %s", strings.Join(dups, ", "))
+	}
+	return out, nil
+}
+
+// addCertThumbprints returns ks with the x5t#S256 thumbprint set on each key
+// that has an x5c certificate chain but no thumbprint, for verifiers that
+// match keys by certificate. The thumbprint is of the first certificate, which
+// holds the key.
+func addCertThumbprints(ks *jose.JSONWebKeySet) *jose.JSONWebKeySet {
+	out := &jose.JSONWebKeySet{Keys: slices.Clone(ks.Keys)}
+	for i, k := range out.Keys {
+		if len(k.Certificates) == 0 || len(k.CertificateThumbprintSHA256) > 0 {
+			continue
+		}
+		sum := sha256.Sum256(k.Certificates[0].Raw)
+		out.Keys[i].CertificateThumbprintSHA256 = sum[:]
+	}
+	return out
+}
+
+// canonicalKeyParams are the members of each key type, in the order they are
+// written by canonicalKeySet after the common kty, use, kid and alg.
+var canonicalKeyParams = map[string][]string{
+	"RSA": {"n", "e"},
+	"EC":  {"crv", "x", "y"},
+	"OKP": {"crv", "x"},
+	"oct": {"k"},
+}
+
+// canonicalKeySet marshals a key set with each key's members in a fixed order:
+// kty, use, kid, alg, the key type's parameters, then anything else sorted by
+// name. This suits strict parsers, and keeps the encoding stable regardless of
+// how go-jose orders them.
+type canonicalKeySet struct {
+	*jose.JSONWebKeySet
+}
+
+func (c canonicalKeySet) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"keys":[`)
+	for i, k := range c.Keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		b, err := json.Marshal(k)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling key %q: %v", k.KeyID, err)
+		}
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(b, &members); err != nil {
+			return nil, fmt.Errorf("unmarshaling key %q: %v", k.KeyID, err)
+		}
+
+		var kty string
+		_ = json.Unmarshal(members["kty"], &kty)
+		order := append([]string{"kty", "use", "kid", "alg"}, canonicalKeyParams[kty]...)
+		var rest []string
+		for name := range members {
+			if !slices.Contains(order, name) {
+				rest = append(rest, name)
+			}
+		}
+		sort.Strings(rest)
+
+		buf.WriteByte('{')
+		first := true
+		for _, name := range append(order, rest...) {
+			v, ok := members[name]
+			if !ok {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			nb, _ := json.Marshal(name)
+			buf.Write(nb)
+			buf.WriteByte(':')
+			buf.Write(v)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes(), nil
+}
+
+// keySetJSON returns ks for marshaling, in canonical member order if set.
+func keySetJSON(ks *jose.JSONWebKeySet, canonical bool) any {
+	if canonical {
+		return canonicalKeySet{ks}
+	}
+	return ks
+}
+
+// keyRetainer keeps keys that have been removed from the upstream key set in
+// the published set for a grace period, so relying parties can still verify
+// tokens signed by them during a rotation.
+type keyRetainer struct {
+	// sets is the number of previous upstream key sets whose keys are
+	// retained.
+	sets int
+	// grace is how long a key is retained after it was removed upstream.
+	grace time.Duration
+
+	log *slog.Logger
+	now func() time.Time
+	// limit caps the keys retained across clusters, if set.
+	limit *retentionLimit
+
+	// mu guards the sets, which the limit may evict from between refreshes.
+	mu sync.Mutex
+	// previous holds the prior distinct upstream key sets, most recent last.
+	previous []retainedKeySet
+	current  []jose.JSONWebKey
+	// removed tracks the keys in previous sets that are missing from the
+	// upstream set.
+	removed map[string]*keyRemoval
+}
+
+type retainedKeySet struct {
+	keys []jose.JSONWebKey
+	// at is when the set was replaced upstream.
+	at time.Time
+}
+
+type keyRemoval struct {
+	// at is when the key was first seen missing from the upstream set.
+	at      time.Time
+	dropped bool
+}
+
+func newKeyRetainer(sets int, grace time.Duration, log *slog.Logger) *keyRetainer {
+	return &keyRetainer{
+		sets:    sets,
+		grace:   grace,
+		log:     log,
+		now:     time.Now,
+		removed: map[string]*keyRemoval{},
+	}
+}
+
+// apply records the upstream key set, and returns it with any retained keys
+// that are still within their grace period appended. Sets evicted to stay
+// under the limit leave the published set on the next refresh.
+func (r *keyRetainer) apply(upstream *jose.JSONWebKeySet) *jose.JSONWebKeySet {
+	defer r.limit.enforce()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+
+	if r.current != nil && !sameKIDs(r.current, upstream.Keys) {
+		r.previous = append(r.previous, retainedKeySet{keys: r.current, at: now})
+		if len(r.previous) > r.sets {
+			r.previous = r.previous[len(r.previous)-r.sets:]
+		}
+	}
+	r.current = upstream.Keys
+
+	inUpstream := map[string]bool{}
+	for _, k := range upstream.Keys {
+		inUpstream[k.KeyID] = true
+	}
+
+	out := &jose.JSONWebKeySet{Keys: append([]jose.JSONWebKey(nil), upstream.Keys...)}
+	tracked := map[string]bool{}
+	// walk the most recent sets first, so the newest copy of a kid wins.
+	for i := len(r.previous) - 1; i >= 0; i-- {
+		for _, k := range r.previous[i].keys {
+			if inUpstream[k.KeyID] || tracked[k.KeyID] {
+				continue
+			}
+			tracked[k.KeyID] = true
+
+			rm, ok := r.removed[k.KeyID]
+			if !ok {
+				rm = &keyRemoval{at: now}
+				r.removed[k.KeyID] = rm
+				r.log.Info("Key removed upstream, retaining", "kid", k.KeyID, "until", now.Add(r.grace))
+			}
+			if now.Sub(rm.at) >= r.grace {
+				if !rm.dropped {
+					rm.dropped = true
+					r.log.Info("Dropping retained key", "kid", k.KeyID, "removed-at", rm.at)
+				}
+				continue
+			}
+			out.Keys = append(out.Keys, k)
+		}
+	}
+
+	// forget keys that are back upstream, or have aged out of the previous
+	// sets.
+	for kid, rm := range r.removed {
+		if !tracked[kid] {
+			if !rm.dropped && !inUpstream[kid] {
+				r.log.Info("Dropping retained key", "kid", kid, "removed-at", rm.at)
+			}
+			delete(r.removed, kid)
+		}
+	}
+
+	return out
+}
+
+func (r *keyRetainer) retained() (int, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, ps := range r.previous {
+		n += len(ps.keys)
+	}
+	if len(r.previous) == 0 {
+		return n, time.Time{}
+	}
+	return n, r.previous[0].at
+}
+
+func (r *keyRetainer) evictOldest() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.previous) == 0 {
+		return 0
+	}
+	n := len(r.previous[0].keys)
+	r.previous = slices.Delete(r.previous, 0, 1)
+	return n
+}
+
+// sameKIDs reports whether a and b contain the same set of key IDs.
+func sameKIDs(a, b []jose.JSONWebKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	kids := map[string]bool{}
+	for _, k := range a {
+		kids[k.KeyID] = true
+	}
+	for _, k := range b {
+		if !kids[k.KeyID] {
+			return false
+		}
+	}
+	return true
+}
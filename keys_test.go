@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// rawKey returns k encoded, with the fields in override replacing its own.
+func rawKey(t testing.TB, k jose.JSONWebKey, override map[string]any) json.RawMessage {
+	t.Helper()
+	b, err := json.Marshal(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	for f, v := range override {
+		m[f] = v
+	}
+	if b, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseJWK(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a point of the right size that isn't on P-256.
+	offCurve := base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	rsaPub := jose.JSONWebKey{Key: &rsaKey.PublicKey, KeyID: "rsa", Algorithm: "RS256", Use: "sig"}
+	ecPub := jose.JSONWebKey{Key: &ecKey.PublicKey, KeyID: "ec", Algorithm: "ES256", Use: "sig"}
+
+	for _, tc := range []struct {
+		name    string
+		raw     json.RawMessage
+		wantKty string
+		// wantErr is part of the error expected, if the key is unusable.
+		wantErr string
+	}{
+		{name: "RSA", raw: rawKey(t, rsaPub, nil), wantKty: "RSA"},
+		{name: "EC", raw: rawKey(t, ecPub, nil), wantKty: "EC"},
+		{name: "Ed25519", raw: rawKey(t, jose.JSONWebKey{Key: edPub, KeyID: "ed", Algorithm: "EdDSA"}, nil), wantKty: "OKP"},
+		{name: "RSA exponent of 1", raw: rawKey(t, rsaPub, map[string]any{"e": "AQ"}), wantErr: "malformed RSA public key"},
+		{name: "RSA modulus of 0", raw: rawKey(t, rsaPub, map[string]any{"n": "AA"}), wantErr: "RSA"},
+		{name: "RSA modulus not base64url", raw: rawKey(t, rsaPub, map[string]any{"n": "not base64!"}), wantErr: "illegal base64"},
+		{name: "EC point off the curve", raw: rawKey(t, ecPub, map[string]any{"x": offCurve, "y": offCurve}), wantErr: "invalid EC key"},
+		{name: "EC unsupported curve", raw: rawKey(t, ecPub, map[string]any{"crv": "P-192"}), wantErr: "P-192"},
+		{name: "RSA private key", raw: rawKey(t, jose.JSONWebKey{Key: rsaKey, KeyID: "rsa", Algorithm: "RS256"}, nil), wantErr: "not a public key"},
+		{name: "EC private key", raw: rawKey(t, jose.JSONWebKey{Key: ecKey, KeyID: "ec", Algorithm: "ES256"}, nil), wantErr: "not a public key"},
+		{name: "Ed25519 private key", raw: rawKey(t, jose.JSONWebKey{Key: edKey, KeyID: "ed", Algorithm: "EdDSA"}, nil), wantErr: "not a public key"},
+		{name: "symmetric key", raw: json.RawMessage(`{"kty":"oct","kid":"hmac","k":"c2VjcmV0"}`), wantErr: "not a public key"},
+		{name: "unknown key type", raw: json.RawMessage(`{"kty":"foo","kid":"foo"}`), wantErr: "unsupported key type"},
+		{name: "not an object", raw: json.RawMessage(`"key"`), wantErr: "cannot unmarshal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := parseJWK(tc.raw)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("parsed %s, want an error", tc.raw)
+				}
+				if !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("error %q doesn't contain %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keyType(k); got != tc.wantKty {
+				t.Errorf("key type %q, want %q", got, tc.wantKty)
+			}
+		})
+	}
+}
+
+func TestParseJWKSMalformedKey(t *testing.T) {
+	bad := rawKey(t, testKey(t, "bad"), map[string]any{"x": "AQ", "y": "AQ"})
+	raw := rawJWKS{Keys: []json.RawMessage{rawKey(t, testKey(t, "a"), nil), bad, rawKey(t, testKey(t, "b"), nil)}}
+
+	_, err := parseJWKS(raw, false)
+	if err == nil {
+		t.Fatal("parsed a key set with a malformed key")
+	}
+	// the offending key is named, so it can be found upstream.
+	if !strings.Contains(err.Error(), `key 1 (kid "bad")`) {
+		t.Errorf("error %q doesn't name the malformed key", err)
+	}
+
+	ks, err := parseJWKS(raw, true)
+	if err != nil {
+		t.Fatalf("dropping invalid keys: %v", err)
+	}
+	var kids []string
+	for _, k := range ks.Keys {
+		kids = append(kids, k.KeyID)
+	}
+	if strings.Join(kids, ",") != "a,b" {
+		t.Errorf("kept keys %q, want the malformed one dropped", kids)
+	}
+}
+
+// memberOrder returns the names of obj's members in the order they're encoded.
+func memberOrder(t *testing.T, obj json.RawMessage) []string {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, tok.(string))
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+// testCertKey returns an EC key carrying a self-signed certificate for it as
+// its x5c chain.
+func testCertKey(t testing.TB, kid string) jose.JSONWebKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: kid}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose.JSONWebKey{Key: &k.PublicKey, KeyID: kid, Algorithm: "ES256", Use: "sig", Certificates: []*x509.Certificate{cert}}
+}
+
+func TestCanonicalKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecWithCert := addCertThumbprints(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{testCertKey(t, "ec-cert")}}).Keys[0]
+
+	ks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &rsaKey.PublicKey, KeyID: "rsa", Algorithm: "RS256", Use: "sig"},
+		{Key: &ecKey.PublicKey, KeyID: "ec", Algorithm: "ES256", Use: "sig"},
+		{Key: edPub, KeyID: "ed", Algorithm: "EdDSA"},
+		ecWithCert,
+	}}
+	want := [][]string{
+		{"kty", "use", "kid", "alg", "n", "e"},
+		{"kty", "use", "kid", "alg", "crv", "x", "y"},
+		{"kty", "kid", "alg", "crv", "x"},
+		// anything else follows, sorted by name.
+		{"kty", "use", "kid", "alg", "crv", "x", "y", "x5c", "x5t#S256"},
+	}
+
+	b, err := json.Marshal(keySetJSON(ks, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Keys) != len(want) {
+		t.Fatalf("encoded %d keys, want %d", len(out.Keys), len(want))
+	}
+	for i, k := range out.Keys {
+		if got := memberOrder(t, k); strings.Join(got, ",") != strings.Join(want[i], ",") {
+			t.Errorf("key %d members %q, want %q", i, got, want[i])
+		}
+	}
+
+	// it's the same key set, and encodes the same every time.
+	var parsed jose.JSONWebKeySet
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range ks.Keys {
+		if got := parsed.Key(k.KeyID); len(got) != 1 || !got[0].Valid() {
+			t.Errorf("key %q didn't round trip", k.KeyID)
+		}
+	}
+	for range 10 {
+		again, err := json.Marshal(keySetJSON(ks, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, b) {
+			t.Fatalf("encoding changed:\n%s\n%s", b, again)
+		}
+	}
+}
+
+func TestCheckDuplicateKIDs(t *testing.T) {
+	a1, a2, b, c1, c2 := testKey(t, "a"), testKey(t, "a"), testKey(t, "b"), testKey(t, "c"), testKey(t, "c")
+	noKID1, noKID2 := testKey(t, ""), testKey(t, "")
+	ks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{a1, b, a2, c1, c2, noKID1, noKID2}}
+	for _, tc := range []struct {
+		mode string
+		// want is the kept keys, as indexes in to ks.
+		want    []int
+		wantErr string
+	}{
+		{mode: duplicateKIDsAllow, want: []int{0, 1, 2, 3, 4, 5, 6}},
+		// keys without a kid aren't looked up by it, so aren't duplicates.
+		{mode: duplicateKIDsFirst, want: []int{0, 1, 3, 5, 6}},
+		{mode: duplicateKIDsReject, wantErr: "key set has duplicate kids: a, c"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			out, err := checkDuplicateKIDs(ks, tc.mode, slog.Default())
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out.Keys) != len(tc.want) {
+				t.Fatalf("kept %d keys, want %d", len(out.Keys), len(tc.want))
+			}
+			for i, k := range out.Keys {
+				if want := ks.Keys[tc.want[i]]; k.Key != want.Key {
+					t.Errorf("key %d is %q, want key %d of the set", i, k.KeyID, tc.want[i])
+				}
+			}
+		})
+	}
+
+	// without duplicates nothing is dropped or refused.
+	unique := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{a1, b, c1}}
+	for _, mode := range []string{duplicateKIDsFirst, duplicateKIDsReject} {
+		out, err := checkDuplicateKIDs(unique, mode, slog.Default())
+		if err != nil || len(out.Keys) != 3 {
+			t.Errorf("%s: kept %v keys, error %v, want all 3", mode, out, err)
+		}
+	}
+}
+
+func TestPublisherDuplicateKIDs(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		wantKeys int
+		wantErr  bool
+	}{
+		{mode: duplicateKIDsAllow, wantKeys: 2},
+		{mode: duplicateKIDsFirst, wantKeys: 1},
+		{mode: duplicateKIDsReject, wantErr: true},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			up := newTestUpstream(t, testKey(t, "a"), testKey(t, "a"))
+			st := &captureSink{}
+			p := &publisher{src: up.source(), log: slog.Default(), duplicateKIDs: tc.mode}
+			p.addSink("capture", st)
+			err := p.refresh(context.Background())
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "duplicate kids: a") {
+					t.Fatalf("refresh error = %v, want the duplicate kid", err)
+				}
+				if st.ks != nil {
+					t.Error("key set with duplicate kids was published")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(st.ks.Keys) != tc.wantKeys {
+				t.Errorf("published %d keys, want %d", len(st.ks.Keys), tc.wantKeys)
+			}
+		})
+	}
+}
+
+func TestCertThumbprints(t *testing.T) {
+	withCert, withThumbprint, plain := testCertKey(t, "cert"), testCertKey(t, "thumbprint"), testKey(t, "plain")
+	sum := sha256.Sum256(withThumbprint.Certificates[0].Raw)
+	withThumbprint.CertificateThumbprintSHA256 = sum[:]
+	for _, tc := range []struct {
+		name            string
+		certThumbprints bool
+		// wantThumbprint is the kids expected to have an x5t#S256.
+		wantThumbprint []string
+	}{
+		{name: "as given", wantThumbprint: []string{"thumbprint"}},
+		{name: "x5t-s256", certThumbprints: true, wantThumbprint: []string{"cert", "thumbprint"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up := newTestUpstream(t, withCert, withThumbprint, plain)
+			p := &publisher{src: up.source(), log: slog.Default(), certThumbprints: tc.certThumbprints}
+			sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable}
+			p.addSink("http", sink)
+			if err := p.refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			w := get((&httpServer{clusters: []*cluster{{name: "default", pub: p, sink: sink}}}).handler(), "/.well-known/jwks.json")
+			var served struct {
+				Keys []map[string]any `json:"keys"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+				t.Fatal(err)
+			}
+			if len(served.Keys) != 3 {
+				t.Fatalf("served %d keys, want 3: %s", len(served.Keys), w.Body)
+			}
+			for _, k := range served.Keys {
+				kid := k["kid"].(string)
+				// certificate chains are always published as given.
+				if _, ok := k["x5c"]; ok != (kid != "plain") {
+					t.Errorf("key %s has x5c: %t", kid, ok)
+				}
+				got, ok := k["x5t#S256"].(string)
+				if ok != slices.Contains(tc.wantThumbprint, kid) {
+					t.Errorf("key %s has x5t#S256: %t, want %t", kid, ok, !ok)
+					continue
+				}
+				if !ok {
+					continue
+				}
+				key := withCert
+				if kid == "thumbprint" {
+					key = withThumbprint
+				}
+				want := sha256.Sum256(key.Certificates[0].Raw)
+				if got != base64.RawURLEncoding.EncodeToString(want[:]) {
+					t.Errorf("key %s x5t#S256 is %s, not its certificate's thumbprint", kid, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// serviceAccountTokenFile is where the kubelet projects the pod's service
+// account token.
+const serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// inClusterServiceAccount returns the service account we run as in-cluster, in
+// namespace:name form, from the subject of the projected token.
+func inClusterServiceAccount() (string, error) {
+	b, err := os.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return "", err
+	}
+	tok, err := jwt.ParseSigned(strings.TrimSpace(string(b)), jwtAlgs)
+	if err != nil {
+		return "", fmt.Errorf("parsing token: %v", err)
+	}
+	// we only want to know who we are, the API server verifies it.
+	var claims jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", fmt.Errorf("reading token claims: %v", err)
+	}
+	sa, ok := strings.CutPrefix(claims.Subject, "system:serviceaccount:")
+	if !ok {
+		return "", fmt.Errorf("token subject %q is not a service account", claims.Subject)
+	}
+	return sa, nil
+}
+
+// restConfig builds the config for reaching the API server, from the
+// kubeconfig at path if set, then the KUBECONFIG environment, otherwise from
+// the in-cluster environment if inCluster is set.
+func restConfig(path, kubeContext string, inCluster bool) (*rest.Config, error) {
+	if path == "" {
+		path = os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
+	}
+	if path != "" {
+		return kubeconfigConfig(path, kubeContext)
+	}
+	if kubeContext != "" {
+		return nil, errors.New("a context requires a kubeconfig")
+	}
+	if !inCluster {
+		return nil, errors.New("no kubeconfig given, and -no-in-cluster disables the in-cluster config. Pass -kubeconfig or set KUBECONFIG")
+	}
+	c, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("creating in cluster configuration: %v", err)
+	}
+	return c, nil
+}
+
+// kubeconfigConfig builds a rest config from the kubeconfig at path, which
+// may be a list of files separated as in KUBECONFIG, merged as kubectl does. If
+// kubeContext is set it is used instead of the merged current context. Either
+// way the context must exist once merged.
+func kubeconfigConfig(path, kubeContext string) (*rest.Config, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{}
+	if paths := filepath.SplitList(path); len(paths) > 1 {
+		// missing files are skipped, as with kubectl.
+		rules.Precedence = paths
+	} else {
+		rules.ExplicitPath = path
+	}
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+
+	raw, err := cc.RawConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %v", path, err)
+	}
+	name := kubeContext
+	if name == "" {
+		name = raw.CurrentContext
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%s has no current context, set one or pass a context", path)
+	}
+	if _, ok := raw.Contexts[name]; !ok {
+		return nil, fmt.Errorf("context %q not found in %s", name, path)
+	}
+
+	return cc.ClientConfig()
+}
+
+// setProxy routes requests to the API server through the proxy at proxyURL,
+// overriding any proxy set in the kubeconfig and the HTTPS_PROXY/NO_PROXY
+// environment that is used by default. http, https and socks5 proxies are
+// supported.
+func setProxy(config *rest.Config, proxyURL string) error {
+	proxy, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return err
+	}
+	config.Proxy = proxy
+	return nil
+}
+
+// apiServerTLS overrides the kubeconfig or in-cluster TLS settings for
+// reaching the API server.
+type apiServerTLS struct {
+	// caFile is the CA bundle to verify the API server with.
+	caFile string
+	// certFile and keyFile are the client certificate to present, for API
+	// servers requiring mTLS.
+	certFile string
+	keyFile  string
+	// insecure skips verifying the API server's certificate.
+	insecure bool
+}
+
+// apply sets the overrides on config. The files are read by client-go, and
+// reloaded as it sees fit.
+func (t apiServerTLS) apply(config *rest.Config) {
+	if t.caFile != "" {
+		config.CAFile, config.CAData = t.caFile, nil
+	}
+	if t.certFile != "" {
+		config.CertFile, config.CertData = t.certFile, nil
+		config.KeyFile, config.KeyData = t.keyFile, nil
+	}
+	if t.insecure {
+		// client-go rejects a CA alongside insecure.
+		config.Insecure = true
+		config.CAFile, config.CAData = "", nil
+	}
+}
+
+const (
+	apiServerProtocolDefault = ""
+	apiServerProtocolHTTP1   = "http1"
+	apiServerProtocolHTTP2   = "http2"
+)
+
+// apiServerTransport selects the protocol for reaching the API server, for
+// links and proxies that don't get on with client-go's defaults.
+type apiServerTransport struct {
+	// protocol is apiServerProtocolHTTP1 or apiServerProtocolHTTP2 to force
+	// it, or empty to leave it to client-go, which prefers HTTP/2.
+	protocol string
+	// pingInterval is how long an HTTP/2 connection can be idle before it's
+	// health checked with a ping, and pingTimeout how long to wait for the
+	// reply before closing the connection.
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	// connWindow and streamWindow are the HTTP/2 flow control windows, in
+	// bytes, or 0 for Go's defaults. Larger windows help on high latency
+	// links.
+	connWindow   int
+	streamWindow int
+}
+
+// apply sets the transport up on config, after any other TLS and proxy
+// settings are made. Forcing HTTP/2 replaces client-go's transport with our
+// own, so client certificate files are read once rather than reloaded.
+func (t apiServerTransport) apply(config *rest.Config) error {
+	switch t.protocol {
+	case apiServerProtocolDefault:
+		return nil
+	case apiServerProtocolHTTP1:
+		config.NextProtos = []string{"http/1.1"}
+		return nil
+	}
+
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return fmt.Errorf("building TLS config: %v", err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	proxy := config.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	dial := config.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	tr := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dial,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 25,
+		Protocols:           new(http.Protocols),
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout:               t.pingInterval,
+			PingTimeout:                   t.pingTimeout,
+			MaxReceiveBufferPerConnection: t.connWindow,
+			MaxReceiveBufferPerStream:     t.streamWindow,
+		},
+	}
+	tr.Protocols.SetHTTP2(true)
+
+	// client-go refuses a transport alongside its own TLS settings, which
+	// are now in ours.
+	config.Transport = tr
+	config.TLSClientConfig = rest.TLSClientConfig{}
+	config.Proxy, config.Dial = nil, nil
+	return nil
+}
+
+// reresolvingTransport closes the idle connections to the API server before a
+// request, once every interval, so the request dials a new one and follows DNS
+// changes to the API server's address. Otherwise a connection kept alive by
+// frequent requests can stick to an old address, e.g. through a control plane
+// upgrade.
+type reresolvingTransport struct {
+	next     http.RoundTripper
+	interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// reresolveEvery returns a wrapper for rest.Config.Wrap re-resolving the API
+// server's address every interval.
+func reresolveEvery(interval time.Duration) func(http.RoundTripper) http.RoundTripper {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &reresolvingTransport{next: rt, interval: interval, last: time.Now()}
+	}
+}
+
+func (t *reresolvingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if time.Since(t.last) >= t.interval {
+		t.last = time.Now()
+		// connections in use by other requests are left alone, they'll be
+		// closed once idle next time.
+		utilnet.CloseIdleConnectionsFor(t.next)
+	}
+	t.mu.Unlock()
+	return t.next.RoundTrip(req)
+}
+
+func (t *reresolvingTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.next
+}
+
+// parseProxyURL returns a proxy function for http.Transport that always uses
+// proxyURL.
+func parseProxyURL(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, must be http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", proxyURL)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// apiServerClient returns a REST client for making raw requests to the API
+// server's discovery endpoints. config is not modified.
+func apiServerClient(config *rest.Config) (*rest.RESTClient, error) {
+	config = rest.CopyConfig(config)
+
+	// https://github.com/operator-framework/operator-sdk/issues/1570#issuecomment-842962128
+	config.APIPath = "/api"
+	config.GroupVersion = &schema.GroupVersion{Group: "", Version: "v1"}
+	config.NegotiatedSerializer = serializer.WithoutConversionCodecFactory{CodecFactory: scheme.Codecs}
+
+	cl, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	cl.Client.CheckRedirect = checkRedirect(true)
+	return cl, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKubeconfig writes a kubeconfig with a context for each of servers,
+// mapping context names to API server URLs, to a file in dir.
+func writeKubeconfig(t *testing.T, dir, name, current string, servers map[string]string) string {
+	t.Helper()
+	var clusters, contexts strings.Builder
+	for ctx, server := range servers {
+		clusters.WriteString("- name: " + ctx + "\n  cluster:\n    server: " + server + "\n")
+		contexts.WriteString("- name: " + ctx + "\n  context:\n    cluster: " + ctx + "\n    user: " + ctx + "\n")
+	}
+	b := "apiVersion: v1\nkind: Config\ncurrent-context: " + current + "\nclusters:\n" + clusters.String() + "contexts:\n" + contexts.String() + "users: []\n"
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(b), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRestConfigMergedKubeconfigs(t *testing.T) {
+	dir := t.TempDir()
+	a := writeKubeconfig(t, dir, "a", "dev", map[string]string{"dev": "https://dev.example.com"})
+	b := writeKubeconfig(t, dir, "b", "", map[string]string{"prod": "https://prod.example.com"})
+	list := a + string(filepath.ListSeparator) + b
+
+	for _, tc := range []struct {
+		name       string
+		kubeconfig string
+		// kubeconfigEnv is KUBECONFIG.
+		kubeconfigEnv string
+		context       string
+		wantHost      string
+		// wantErr is part of the error, if the context doesn't resolve.
+		wantErr string
+	}{
+		{name: "current context of the first file", kubeconfig: list, wantHost: "https://dev.example.com"},
+		{name: "context from a later file", kubeconfig: list, context: "prod", wantHost: "https://prod.example.com"},
+		{name: "context from KUBECONFIG", kubeconfigEnv: list, context: "prod", wantHost: "https://prod.example.com"},
+		{name: "-kubeconfig over KUBECONFIG", kubeconfig: a, kubeconfigEnv: list, context: "prod", wantErr: `context "prod" not found`},
+		{name: "context in none of the files", kubeconfigEnv: list, context: "staging", wantErr: `context "staging" not found`},
+		{name: "no current context", kubeconfig: b, wantErr: "has no current context"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", tc.kubeconfigEnv)
+			c, err := restConfig(tc.kubeconfig, tc.context, false)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Host != tc.wantHost {
+				t.Errorf("host = %s, want %s", c.Host, tc.wantHost)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"lds.li/oauth2ext/oidc"
+)
+
+// serviceAccountNamespaceFile is where the kubelet projects the pod's
+// namespace.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// the usual client-go lease timings, as used by the controller manager.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leaderSink only passes updates on to the wrapped sink while leading is set,
+// so replicas sharing a destination don't all write to it. Updates are
+// dropped rather than failed otherwise, as not being the leader is normal.
+type leaderSink struct {
+	Sink
+	leading *atomic.Bool
+}
+
+func (s *leaderSink) unwrap() Sink { return s.Sink }
+
+func (s *leaderSink) Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	if !s.leading.Load() {
+		return nil
+	}
+	return s.Sink.Update(ctx, md, ks)
+}
+
+// delete deletes the documents from the wrapped sink while leading, as
+// followers don't write to it either.
+func (s *leaderSink) delete(ctx context.Context) error {
+	if !s.leading.Load() {
+		return nil
+	}
+	d, ok := asDeleter(s.Sink)
+	if !ok {
+		return nil
+	}
+	return d.delete(ctx)
+}
+
+// leaderElector campaigns for a lease, tracking whether we hold it.
+type leaderElector struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	identity  string
+	// leading is set while we hold the lease.
+	leading atomic.Bool
+	// onLeading is called, in its own goroutine, when we become the leader.
+	onLeading func(ctx context.Context)
+}
+
+// run campaigns for the lease until ctx is cancelled, campaigning again
+// whenever it's lost. The lease is released on return, so another replica can
+// take over straight away.
+func (e *leaderElector) run(ctx context.Context) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: e.namespace, Name: e.name},
+		Client:     e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: e.identity},
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            e.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				slog.Info("Became the leader, publishing", "lease", e.namespace+"/"+e.name, "identity", e.identity)
+				e.leading.Store(true)
+				e.onLeading(ctx)
+			},
+			OnStoppedLeading: func() {
+				// stop writing before anyone else can take the lease.
+				e.leading.Store(false)
+				slog.Info("No longer the leader, only serving", "lease", e.namespace+"/"+e.name, "identity", e.identity)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != e.identity {
+					slog.Info("Following the leader", "lease", e.namespace+"/"+e.name, "leader", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("configuring leader election: %v", err)
+	}
+
+	for ctx.Err() == nil {
+		le.Run(ctx)
+	}
+	return nil
+}
+
+// inClusterNamespace returns the namespace we run in, in-cluster.
+func inClusterNamespace() (string, error) {
+	b, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", err
+	}
+	ns := strings.TrimSpace(string(b))
+	if ns == "" {
+		return "", fmt.Errorf("%s is empty", serviceAccountNamespaceFile)
+	}
+	return ns, nil
+}
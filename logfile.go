@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// logQueueSize is how many log lines can be waiting to be written to a log
+// file before more are dropped.
+const logQueueSize = 4096
+
+// logFile is a file for the logs, which is reopened on SIGHUP so it works
+// with logrotate. Once background writing starts, lines are queued and
+// written by their own goroutine, so a slow disk doesn't hold up request
+// handling.
+type logFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+
+	// queue holds the lines waiting to be written while writing in the
+	// background, otherwise it's nil and lines are written directly. It's
+	// guarded separately from the file, so queueing a line never waits on
+	// a write.
+	queueMu sync.RWMutex
+	queue   chan []byte
+	done    chan struct{}
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen opens the file at l's path, replacing the one being written to.
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		_ = l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// reopenOnHangup reopens the file whenever we get a SIGHUP.
+func (l *logFile) reopenOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := l.reopen(); err != nil {
+				slog.Error("Failed to reopen log file", "path", l.path, "error", err)
+				continue
+			}
+			slog.Info("Reopened log file", "path", l.path)
+		}
+	}()
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.queueMu.RLock()
+	if l.queue != nil {
+		defer l.queueMu.RUnlock()
+		select {
+		case l.queue <- append([]byte(nil), p...):
+		default:
+			logLinesDropped.Inc()
+		}
+		return len(p), nil
+	}
+	l.queueMu.RUnlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// background starts writing lines in the background. Lines logged before
+// then are written directly, so nothing is lost if we exit during startup.
+func (l *logFile) background() {
+	q, done := make(chan []byte, logQueueSize), make(chan struct{})
+	go func() {
+		defer close(done)
+		for b := range q {
+			l.mu.Lock()
+			_, _ = l.f.Write(b)
+			l.mu.Unlock()
+		}
+	}()
+	l.queueMu.Lock()
+	defer l.queueMu.Unlock()
+	l.queue, l.done = q, done
+}
+
+// flush writes out any queued lines and goes back to writing directly, for
+// before we exit.
+func (l *logFile) flush() {
+	l.queueMu.Lock()
+	q, done := l.queue, l.done
+	l.queue = nil
+	l.queueMu.Unlock()
+	if q != nil {
+		close(q)
+		<-done
+	}
+}
+
+// flushContext flushes the queue like flush, but gives up once ctx is done,
+// e.g. on a hung disk. It reports whether everything was written.
+func (l *logFile) flushContext(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		l.flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
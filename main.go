@@ -2,144 +2,881 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/client-go/kubernetes/scheme"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/lstoll/k8soidcpublisher/discoverypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-	"lds.li/oauth2ext/oauth2as/discovery"
-	"lds.li/oauth2ext/oidc"
 )
 
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer stop()
+	// giveUp shuts down as for a signal, but exits non-zero.
+	ctx, giveUp := context.WithCancelCause(ctx)
+	defer giveUp(nil)
 
-	var (
-		listen     = flag.String("listen", "localhost:8080", "address to listen on")
-		kubeconfig = flag.String("kubeconfig", "", "Path to kubeconfig file, otherwise will use in-cluster config")
-	)
-	flag.Parse()
+	opts, err := parseOptions(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	var config *rest.Config
-	if *kubeconfig != "" {
-		c, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.logLevel)); err != nil {
+		log.Fatalf("-log-level must be debug, info, warn or error, got %q", opts.logLevel)
+	}
+	slog.SetLogLoggerLevel(level)
+
+	var logs *logFile
+	switch opts.logDest {
+	case "stderr":
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	default:
+		l, err := openLogFile(opts.logDest)
 		if err != nil {
-			log.Fatalf("Error flag config: %v", err)
+			log.Fatalf("Invalid -log-file: %v", err)
 		}
-		config = c
-	} else {
-		c, err := rest.InClusterConfig()
-		if err != nil {
-			log.Fatalf("Error creating in cluster configuration: %v", err)
+		l.reopenOnHangup()
+		log.SetOutput(l)
+		logs = l
+	}
+
+	if opts.inspectPath != "" {
+		// a file needs nothing else, so don't require access to a cluster.
+		if err := inspectFile(os.Stdout, opts.inspectPath); err != nil {
+			log.Fatalf("Inspection failed: %v", err)
 		}
-		config = c
+		return
 	}
 
-	// https://github.com/operator-framework/operator-sdk/issues/1570#issuecomment-842962128
-	config.APIPath = "/api"
-	config.GroupVersion = &schema.GroupVersion{Group: "", Version: "v1"}
-	config.NegotiatedSerializer = serializer.WithoutConversionCodecFactory{CodecFactory: scheme.Codecs}
+	if opts.serveDir != "" {
+		// serving files needs nothing else, so don't require access to a
+		// cluster either.
+		cc := (&httpSink{cacheMaxAge: opts.cacheMaxAge, staleWhileRevalidate: opts.staleRevalidate}).cacheControl()
+		fs, err := newFileServer(opts.serveDir, opts.gzipDocuments, cc)
+		if err != nil {
+			log.Fatalf("Invalid -serve-dir: %v", err)
+		}
+		if err := serveFiles(ctx, opts.listen, fs, opts.shutdownTimeout); err != nil {
+			log.Fatalf("Failed to serve -serve-dir: %v", err)
+		}
+		return
+	}
 
-	cl, err := rest.RESTClientFor(config)
+	if opts.staleAfter != 0 && opts.staleAfter <= opts.refreshInterval {
+		slog.Warn("-stale-after is not longer than -refresh-interval, documents will go stale between refreshes", "stale-after", opts.staleAfter, "refresh-interval", opts.refreshInterval)
+	}
+	allowedKeyTypes, err := parseKeyTypes(opts.allowedKty)
+	if err != nil {
+		log.Fatalf("Invalid -allowed-kty: %v", err)
+	}
+	defaults, err := parseMetadataDefaults(opts.scopesDefault, opts.claimsDefault, opts.subjectsDefault)
 	if err != nil {
-		log.Fatalf("Error creating rest client: %v", err)
+		log.Fatalf("Invalid metadata defaults: %v", err)
+	}
+	var limiter *rateLimiter
+	if opts.rateLimit != 0 || opts.rateLimitBurst != 0 {
+		l, err := newRateLimiter(opts.rateLimit, opts.rateLimitBurst, opts.rateLimitExempt)
+		if err != nil {
+			log.Fatalf("Invalid -rate-limit: %v", err)
+		}
+		limiter = l
+	}
+	if opts.spiffeRefresh == 0 {
+		opts.spiffeRefresh = opts.refreshInterval
 	}
 
-	metadata, err := discoverAPIServerOIDC(ctx, cl)
+	var old *oldIssuer
+	if opts.oldIssuerURL != "" {
+		o, err := parseOldIssuer(opts.oldIssuerURL, opts.oldIssuerUntil)
+		if err != nil {
+			log.Fatalf("Invalid -old-issuer: %v", err)
+		}
+		opts.sunsetAt = opts.oldIssuerUntil
+		old = o
+	}
+	deprecationHeader, sunsetHeader, err := migrationHeaders(opts.deprecatedAt, opts.sunsetAt)
 	if err != nil {
-		slog.Error("Failed to discover provider metadata", "error", err)
-		os.Exit(1)
+		log.Fatalf("Invalid -deprecation or -sunset: %v", err)
+	}
+	if err := validateMIMEType(opts.jwksContentType); err != nil {
+		log.Fatalf("Invalid -jwks-content-type: %v", err)
 	}
 
-	upstreamJWKSURI := metadata.JWKSURI
-	metadata.JWKSURI = fmt.Sprintf("%s/.well-known/jwks.json", metadata.Issuer)
-	// needed to validate, not used.
-	metadata.TokenEndpoint = fmt.Sprintf("%s/nonexistent", metadata.Issuer)
-	metadata.AuthorizationEndpoint = fmt.Sprintf("%s/nonexistent", metadata.Issuer)
+	var adminAddr string
+	switch {
+	case opts.adminOnListen:
+		slog.Warn("Serving metrics and admin endpoints on -listen alongside the documents", "addr", opts.listen)
+	case opts.listen == "":
+		// nothing is served over HTTP, so there's nothing to move.
+	default:
+		// already checked by validate.
+		addr, exposed, _ := adminListenAddr(opts.adminListen)
+		if exposed {
+			slog.Warn("Admin listener is not bound to loopback, metrics and admin endpoints will be reachable from other hosts", "addr", addr)
+		}
+		adminAddr = addr
+	}
 
-	discoh, err := discovery.NewOIDCConfigurationHandlerWithJWKSSource(metadata, &k8sAPIJWKSSource{cl: cl, url: upstreamJWKSURI})
-	if err != nil {
-		slog.Error("Failed to create discovery handler", "error", err)
-		os.Exit(1)
+	if err := validateMetricsPrefix(opts.metricsPrefixF); err != nil {
+		log.Fatalf("Invalid -metrics-prefix: %v", err)
+	}
+	gatherer := metricsGatherer(opts.metricsPrefixF)
+
+	var serveTLS *tls.Config
+	if opts.tlsCertFile != "" {
+		c, err := servingTLS(opts.tlsCertFile, opts.tlsKeyFile, opts.tlsClientCA)
+		if err != nil {
+			log.Fatalf("Invalid serving TLS config: %v", err)
+		}
+		serveTLS = c
+	}
+
+	var bastion *sshBastion
+	if opts.sshBastionAt != "" {
+		b, err := newSSHBastion(opts.sshBastionAt, opts.sshUser, opts.sshKeyFile, opts.sshKnownHosts)
+		if err != nil {
+			log.Fatalf("Invalid -ssh-bastion config: %v", err)
+		}
+		bastion = b
+		defer bastion.Close()
+	}
+
+	var correlation *correlationIDs
+	if opts.corrHeader != "" {
+		correlation = newCorrelationIDs(http.CanonicalHeaderKey(opts.corrHeader), opts.corrPer)
+		if correlation.runID != "" {
+			slog.Info("Tagging discovery requests with a correlation ID", "correlation-header", correlation.header, "correlation-id", correlation.runID)
+		}
+	}
+
+	var issuerClient *http.Client
+	if opts.sourceURL != "" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.proxyURL != "" {
+			proxy, err := parseProxyURL(opts.proxyURL)
+			if err != nil {
+				log.Fatalf("Invalid -proxy-url: %v", err)
+			}
+			transport.Proxy = proxy
+		}
+		var rt http.RoundTripper = transport
+		if correlation != nil {
+			rt = correlation.wrap(rt)
+		}
+		issuerClient = &http.Client{Transport: rt, Timeout: 30 * time.Second, CheckRedirect: checkRedirect(false)}
+	}
+
+	if opts.insecureTLS {
+		slog.Warn("TLS verification of the API server is disabled by -insecure-skip-tls-verify. The published keys can be substituted by anyone able to intercept the connection, never use this outside development")
+	}
+	tlsOverrides := apiServerTLS{caFile: opts.caFile, certFile: opts.clientCert, keyFile: opts.clientKey, insecure: opts.insecureTLS}
+
+	transportOverrides := apiServerTransport{
+		protocol:     opts.apiProtocol,
+		pingInterval: opts.h2PingEvery,
+		pingTimeout:  opts.h2PingTimeout,
+		connWindow:   opts.h2ConnWindow,
+		streamWindow: opts.h2StrmWindow,
+	}
+
+	var clusterConfigs []clusterConfig
+	if opts.clustersPath != "" {
+		ccs, err := loadClustersFile(opts.clustersPath)
+		if err != nil {
+			log.Fatalf("Error loading clusters file: %v", err)
+		}
+		clusterConfigs = ccs
+	} else {
+		clusterConfigs = []clusterConfig{{Name: "default", Kubeconfig: opts.kubeconfig, Context: opts.kubeContext}}
+	}
+	var pathMap map[string]issuerPaths
+	if opts.pathMapPath != "" {
+		m, err := loadPathMap(opts.pathMapPath)
+		if err != nil {
+			log.Fatalf("Error loading path map: %v", err)
+		}
+		pathMap = m
+	}
+	if opts.noFatalWarmup && opts.serveIssuerPath {
+		// the path is derived from the issuer, which may not be known yet.
+		for _, cc := range clusterConfigs {
+			if cc.PathPrefix == "" {
+				log.Fatal("-no-fatal-warmup can't be combined with -serve-issuer-path, unless every cluster in -clusters-file sets pathPrefix")
+			}
+		}
+	}
+
+	var errBodies *errorBodies
+	if opts.errorBodyFile != "" {
+		eb, err := loadErrorBodies(opts.errorBodyFile, opts.errorBodyType)
+		if err != nil {
+			log.Fatalf("Invalid -error-body-file: %v", err)
+		}
+		errBodies = eb
+	}
+
+	checkIssuerDNS := false
+	if opts.issuerDNSMode != issuerDNSOff {
+		if opts.trustForwarded {
+			slog.Info("Skipping -issuer-dns-check, the issuer is taken from each request with -trust-forwarded-headers")
+		} else {
+			checkIssuerDNS = true
+		}
+	}
+
+	if opts.publishResync > 0 && opts.publishResync < opts.refreshInterval {
+		slog.Warn("-publish-resync-interval is shorter than -refresh-interval, documents will be resynced every refresh", "publish-resync-interval", opts.publishResync, "refresh-interval", opts.refreshInterval)
+	}
+
+	if opts.deleteStale > 0 {
+		slog.Warn("Published documents will be deleted if discovery fails for longer than -delete-stale-after", "delete-stale-after", opts.deleteStale)
+	}
+
+	if opts.listen == "" && !opts.selftestMode && !opts.validateMode && !opts.inspectMode && !opts.verifyMode {
+		if opts.exitAfterFails > 0 {
+			slog.Info("Will exit non-zero if every sink fails this many refreshes in a row", "exit-after-publish-failures", opts.exitAfterFails)
+		} else {
+			slog.Info("Failing sinks will be retried every refresh indefinitely, set -exit-after-publish-failures to exit instead")
+		}
+	}
+
+	var elector *leaderElector
+	if opts.leaderElect {
+		ns := opts.leaseNamespace
+		if ns == "" {
+			n, err := inClusterNamespace()
+			if err != nil {
+				log.Fatalf("Error determining the lease namespace, set -leader-election-namespace: %v", err)
+			}
+			ns = n
+		}
+		id := opts.leaseIdentity
+		if id == "" {
+			h, err := os.Hostname()
+			if err != nil {
+				log.Fatalf("Error determining the lease identity, set -leader-election-id: %v", err)
+			}
+			id = h
+		}
+		elector = &leaderElector{namespace: ns, name: opts.leaseName, identity: id}
+	}
+	var eventsRef *corev1.ObjectReference
+	if opts.eventsObject != "" {
+		ns := opts.eventsNamespace
+		if ns == "" {
+			n, err := inClusterNamespace()
+			if err != nil {
+				log.Fatalf("Error determining the events namespace, set -events-namespace: %v", err)
+			}
+			ns = n
+		}
+		ref, err := parseEventObject(opts.eventsObject, ns)
+		if err != nil {
+			log.Fatalf("Invalid -events-object: %v", err)
+		}
+		eventsRef = ref
+	}
+
+	// gate restricts writing to a shared destination to the leader.
+	gate := func(s Sink) Sink {
+		if elector == nil {
+			return s
+		}
+		return &leaderSink{Sink: s, leading: &elector.leading}
+	}
+
+	// already checked by validate.
+	cmNamespace, cmName, _ := strings.Cut(opts.publishConfigMap, "/")
+
+	var gitAuth transport.AuthMethod
+	if opts.gitTokenFile != "" {
+		b, err := os.ReadFile(opts.gitTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading git token: %v", err)
+		}
+		gitAuth = &githttp.BasicAuth{Username: opts.gitUsername, Password: strings.TrimSpace(string(b))}
+	}
+
+	var putHeaders http.Header
+	if opts.putHeadersFile != "" {
+		var err error
+		putHeaders, err = loadHeadersFile(opts.putHeadersFile)
+		if err != nil {
+			log.Fatalf("Error reading -publish-put-headers-file: %v", err)
+		}
+	}
+
+	var adminToken string
+	if opts.adminTokenFile != "" {
+		b, err := os.ReadFile(opts.adminTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading admin token: %v", err)
+		}
+		adminToken = strings.TrimSpace(string(b))
+		if adminToken == "" {
+			log.Fatalf("Admin token file %s is empty", opts.adminTokenFile)
+		}
+	}
+
+	audit := slog.Default().With("log", "audit")
+	if opts.auditLogFile != "" {
+		f, err := os.OpenFile(opts.auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer f.Close()
+		audit = slog.New(slog.NewJSONHandler(f, nil))
+	}
+
+	st := staleness{
+		staleAfter:       opts.staleAfter,
+		clockSkew:        opts.staleClockSkew,
+		failOpen:         opts.staleMode == staleModeFailOpen,
+		independent:      opts.staleSeparately,
+		unreadyOnFailure: opts.unreadyOnFail,
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle("GET /.well-known/openid-configuration", discoh)
-	mux.Handle("GET /.well-known/jwks.json", discoh)
+	var sem chan struct{}
+	if opts.discoveryConc > 0 {
+		sem = make(chan struct{}, opts.discoveryConc)
+	}
+
+	retention := &retentionLimit{max: opts.maxRetainedKeys}
+
+	var clusters []*cluster
+	for _, cc := range clusterConfigs {
+		// keep the single cluster's logs as they were.
+		logger := slog.Default()
+		if opts.clustersPath != "" {
+			logger = logger.With("cluster", cc.Name)
+		}
+
+		var config *rest.Config
+		if opts.needsAPIServer() {
+			c, err := restConfig(cc.Kubeconfig, cc.Context, !opts.noInCluster)
+			if err != nil {
+				log.Fatalf("Error creating config for cluster %s: %v", cc.Name, err)
+			}
+			if opts.proxyURL != "" {
+				if err := setProxy(c, opts.proxyURL); err != nil {
+					log.Fatalf("Invalid -proxy-url: %v", err)
+				}
+			}
+			if bastion != nil {
+				c.Dial = bastion.DialContext
+			}
+			tlsOverrides.apply(c)
+			c.QPS, c.Burst = float32(opts.kubeQPS), opts.kubeBurst
+			if err := transportOverrides.apply(c); err != nil {
+				log.Fatalf("Error configuring transport for cluster %s: %v", cc.Name, err)
+			}
+			if correlation != nil {
+				c.Wrap(correlation.wrap)
+			}
+			if opts.reresolveAPI > 0 {
+				c.Wrap(reresolveEvery(opts.reresolveAPI))
+			}
+			config = c
+		}
+
+		var src discoverySource
+		if opts.sourceURL != "" {
+			src = &issuerSource{
+				client:      issuerClient,
+				issuer:      opts.sourceURL,
+				path:        opts.discoveryPath,
+				accept:      opts.discoveryAcc,
+				dropInvalid: opts.dropInvalidKeys,
+				externalRetry: retryPolicy{
+					attempts:   opts.jwksAttempts,
+					backoff:    opts.jwksBackoff,
+					maxBackoff: opts.jwksMaxBack,
+				},
+			}
+		} else {
+			cl, err := apiServerClient(config)
+			if err != nil {
+				log.Fatalf("Error creating rest client: %v", err)
+			}
+			as := &apiServerSource{
+				cl:          cl,
+				path:        opts.discoveryPath,
+				accept:      opts.discoveryAcc,
+				dropInvalid: opts.dropInvalidKeys,
+			}
+			if cc.Kubeconfig == "" {
+				sa, err := inClusterServiceAccount()
+				if err != nil {
+					logger.Debug("Couldn't determine our service account", "error", err)
+				}
+				as.serviceAccount = sa
+			}
+			src = as
+		}
+
+		pub := &publisher{
+			cluster:         cc.Name,
+			src:             src,
+			log:             logger,
+			sem:             sem,
+			allowedKeyTypes: allowedKeyTypes,
+			confirmKeys:     opts.staleSeparately,
+			sameOriginJWKS:  opts.sameOriginJWKS,
+			errorHistory:    opts.errorHistory,
+			correlation:     correlation,
+			defaults:        defaults,
+			duplicateKIDs:   opts.duplicateKIDs,
+			eksCompat:       opts.eksCompat,
+			certThumbprints: opts.certThumbprints,
+
+			acceptSuspect:        opts.suspectDocs == suspectAccept,
+			keysServedSeparately: opts.staleSeparately,
+			exitAfterFailures:    opts.exitAfterFails,
+			giveUp:               giveUp,
+			resyncInterval:       opts.publishResync,
+			deleteStaleAfter:     opts.deleteStale,
+		}
+		if checkIssuerDNS {
+			pub.issuerDNS = &issuerDNSCheck{strict: opts.issuerDNSMode == issuerDNSStrict, resolver: net.DefaultResolver, log: logger}
+		}
+		discoveryAge.add(pub)
+		if opts.retainKeySets > 0 {
+			pub.retainer = newKeyRetainer(opts.retainKeySets, opts.retainKeysFor, logger)
+			pub.retainer.limit = retention
+			retention.add(cc.Name, "retain-key-sets", pub.retainer)
+		}
+		c := &cluster{
+			name:       cc.Name,
+			host:       cc.Host,
+			pathPrefix: cc.PathPrefix,
+			pub:        pub,
+		}
+
+		if opts.listen != "" {
+			c.sink = &httpSink{
+				jwksContentType:      opts.jwksContentType,
+				staleness:            st,
+				state:                pub,
+				cacheMaxAge:          opts.cacheMaxAge,
+				staleWhileRevalidate: opts.staleRevalidate,
+				gzip:                 opts.gzipDocuments,
+				pretty:               opts.prettyDocuments,
+				prettyQuery:          opts.prettyQuery,
+				canonicalKeys:        opts.canonicalKeys,
+				contentHashHeader:    opts.contentHashHdr,
+				deprecation:          deprecationHeader,
+				sunset:               sunsetHeader,
+				oldIssuer:            old,
+				keyVersions:          opts.jwksVersions,
+				spiffeBundle:         opts.spiffeBundle,
+				spiffeRefreshHint:    opts.spiffeRefresh,
+				initializingStatus:   opts.initStatus,
+				retention:            retention,
+			}
+			if opts.jwksVersions > 0 {
+				retention.add(cc.Name, "jwks-versions", c.sink)
+			}
+			pub.addSink("http", c.sink)
+		}
+		// addBackend adds a sink publishing somewhere outside this process.
+		addBackend := func(name string, s Sink) {
+			if opts.publishOnlyValid {
+				s = &validSink{Sink: s, name: name, log: logger}
+			}
+			pub.addSink(name, gate(s))
+		}
+		if opts.cacheDir != "" {
+			// every replica keeps its own cache, so it isn't a backend.
+			dir := opts.cacheDir
+			if opts.clustersPath != "" {
+				dir = filepath.Join(dir, url.PathEscape(cc.Name))
+			}
+			pub.addSink("cache", &fileSink{dir: dir})
+		}
+		if opts.publishDir != "" {
+			addBackend("file", &fileSink{dir: opts.publishDir, canonicalKeys: opts.canonicalKeys})
+		}
+		if opts.publishConfigMap != "" {
+			cs, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				log.Fatalf("Error creating kubernetes client: %v", err)
+			}
+			addBackend("configmap", &configMapSink{client: cs.CoreV1().ConfigMaps(cmNamespace), name: cmName, canonicalKeys: opts.canonicalKeys})
+		}
+		if opts.publishGit != "" {
+			addBackend("git", &gitSink{url: opts.publishGit, branch: opts.gitBranch, dir: opts.gitDir, auth: gitAuth, canonicalKeys: opts.canonicalKeys})
+		}
+		if opts.putMetadataURL != "" {
+			addBackend("http-put", &putSink{
+				client:        &http.Client{Timeout: 30 * time.Second, CheckRedirect: checkRedirect(true)},
+				metadataURL:   opts.putMetadataURL,
+				jwksURL:       opts.putJWKSURL,
+				headers:       putHeaders,
+				retry:         retryPolicy{attempts: opts.putAttempts, backoff: opts.putBackoff, maxBackoff: 30 * time.Second},
+				dryRun:        opts.putDryRun,
+				canonicalKeys: opts.canonicalKeys,
+				log:           logger,
+			})
+		}
+		if eventsRef != nil {
+			cs, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				log.Fatalf("Error creating kubernetes client: %v", err)
+			}
+			recorder, stopEvents := newEventRecorder(cs, eventsRef.Namespace)
+			defer stopEvents()
+			pub.events = &clusterEvents{cluster: cc.Name, recorder: recorder, object: eventsRef, failingAfter: opts.eventsFailing}
+		}
+		if elector != nil {
+			cs, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				log.Fatalf("Error creating kubernetes client: %v", err)
+			}
+			elector.client = cs
+			elector.onLeading = func(ctx context.Context) {
+				// the previous leader may not have published the latest
+				// documents, and we skipped them as a follower.
+				pub.republish()
+				if err := pub.refresh(ctx); err != nil {
+					pub.log.Error("Failed to publish discovery documents on becoming the leader", "error", err)
+				}
+			}
+		}
+		if len(pub.sinks) == 0 && !opts.selftestMode && !opts.validateMode && !opts.inspectMode && !opts.verifyMode {
+			log.Fatal("Nothing to publish to, set at least one of -listen, -publish-dir, -publish-configmap, -publish-git or -publish-put-metadata-url")
+		}
+
+		clusters = append(clusters, c)
+	}
+
+	if opts.validateMode {
+		if len(clusters) != 1 {
+			log.Fatal("-validate checks a single cluster, and can't be used with -clusters-file")
+		}
+		if err := validate(ctx, clusters[0].pub, opts.warmupTimeout); err != nil {
+			slog.Error("Validation failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.inspectMode {
+		if len(clusters) != 1 {
+			log.Fatal("-inspect shows a single cluster, and can't be used with -clusters-file")
+		}
+		if err := inspect(ctx, os.Stdout, clusters[0].pub, opts.warmupTimeout); err != nil {
+			slog.Error("Inspection failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.selftestMode {
+		if len(clusters) != 1 {
+			log.Fatal("-selftest checks a single cluster, and can't be used with -clusters-file")
+		}
+		if err := selftest(ctx, clusters[0].pub, opts.selftestTokenFile, opts.warmupTimeout); err != nil {
+			slog.Error("Self test failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.verifyMode {
+		if len(clusters) != 1 {
+			log.Fatal("-verify-published checks a single cluster, and can't be used with -clusters-file")
+		}
+		// a client with none of our TLS or proxy overrides, as relying
+		// parties won't have them either.
+		client := &http.Client{Timeout: 30 * time.Second}
+		if err := verifyPublished(ctx, clusters[0].pub, client, opts.warmupTimeout); err != nil {
+			slog.Error("Verifying the published documents failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// bind before warming up, so a port conflict is reported straight away
+	// rather than once discovery succeeds.
+	listeners := map[string]net.Listener{}
+	for _, addr := range []string{opts.listen, adminAddr, opts.grpcListen} {
+		if addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %v", addr, err)
+		}
+		listeners[addr] = ln
+	}
 
-	server := &http.Server{
-		Addr:    *listen,
-		Handler: mux,
+	if !opts.noFatalWarmup {
+		if err := warmupClusters(ctx, clusters, opts.warmupTimeout); err != nil {
+			slog.Error("Failed to discover provider metadata", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	var wg sync.WaitGroup
-	wg.Go(func() {
-		slog.Info("listening", "addr", *listen)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			slog.Error("Failed to listen", "error", err)
+	interval := opts.refreshInterval
+	if opts.refreshMode == refreshModeWatch {
+		interval = opts.watchInterval
+	}
+	for i, c := range clusters {
+		// spread the clusters' refreshes evenly over the interval.
+		delay := interval * time.Duration(i) / time.Duration(len(clusters))
+		wg.Go(func() {
+			if opts.noFatalWarmup {
+				// warm up while serving, the sinks return 503s until it
+				// succeeds.
+				if err := c.pub.warmup(ctx, opts.warmupTimeout); err != nil {
+					c.pub.log.Error("Failed to discover provider metadata, will keep retrying", "interval", interval, "error", err)
+				}
+			}
+			if opts.refreshMode == refreshModeWatch {
+				c.pub.watch(ctx, opts.watchInterval, opts.refreshInterval, delay)
+				return
+			}
+			c.pub.run(ctx, opts.refreshInterval, delay)
+		})
+	}
+
+	if elector != nil {
+		wg.Go(func() {
+			if err := elector.run(ctx); err != nil {
+				slog.Error("Leader election failed", "error", err)
+				os.Exit(1)
+			}
+		})
+	}
+
+	var pusher *metricsPusher
+	if opts.pushURL != "" {
+		pusher = newMetricsPusher(opts.pushURL, opts.pushJob, opts.pushInterval, gatherer)
+		wg.Go(func() {
+			pusher.run(ctx)
+		})
+	}
+
+	var (
+		servers []*http.Server
+		hs      *httpServer
+	)
+	if opts.listen != "" {
+		if err := mapIssuerPaths(clusters, pathMap); err != nil {
+			slog.Error("Invalid -path-map-file", "error", err)
+			os.Exit(1)
+		}
+		for _, c := range clusters {
+			if c.mappedPaths != nil || c.pathPrefix != "" || !opts.serveIssuerPath {
+				continue
+			}
+			p, err := issuerPath(c.sink.issuer())
+			if err != nil {
+				slog.Error("Failed to determine issuer path", "cluster", c.name, "error", err)
+				os.Exit(1)
+			}
+			c.pathPrefix = p
+		}
+		if old != nil && strings.TrimSuffix(clusters[0].sink.issuer(), "/") == old.issuer {
+			slog.Error("-old-issuer is the issuer being published", "issuer", old.issuer)
+			os.Exit(1)
+		}
+		if err := checkClusterRoutes(clusters); err != nil {
+			slog.Error("Invalid cluster routing", "error", err)
 			os.Exit(1)
 		}
-	})
+		if opts.checkJWKSURI {
+			if err := checkJWKSURIServed(clusters); err != nil {
+				slog.Error("Published jwks_uri isn't served", "error", err)
+				os.Exit(1)
+			}
+		}
+		var combined *combinedJWKS
+		if opts.combinedPath != "" {
+			combined = &combinedJWKS{path: opts.combinedPath, clusters: clusters}
+			if err := checkCombinedRoute(combined); err != nil {
+				slog.Error("Invalid -combined-jwks-path", "error", err)
+				os.Exit(1)
+			}
+		}
 
-	<-ctx.Done()
-	slog.Info("Received shutdown signal, initiating graceful shutdown...")
+		hs = &httpServer{
+			clusters:       clusters,
+			adminToken:     adminToken,
+			audit:          audit,
+			separateAdmin:  adminAddr != "",
+			trustForwarded: opts.trustForwarded,
+			debugEndpoints: opts.debugEndpoints,
+			adminEndpoints: opts.adminEndpoints,
+			refreshTimeout: opts.refreshTimeout,
+			openMetrics:    opts.openMetrics,
+			combined:       combined,
+			statusPage:     opts.statusPage,
+			errorBodies:    errBodies,
+			gatherer:       gatherer,
+			limiter:        limiter,
 
-	shutdownCtx := context.WithoutCancel(ctx)
-	shutdownCtx, shutdownCancel := context.WithTimeout(shutdownCtx, 5*time.Second)
-	defer shutdownCancel()
+			maintenanceRetryAfter: opts.maintRetryAfter,
+		}
+		hs.maintenance.Store(opts.maintenance)
+		servers = append(servers, &http.Server{
+			Addr:      opts.listen,
+			Handler:   hs.handler(),
+			TLSConfig: serveTLS,
+		})
+		if adminAddr != "" {
+			servers = append(servers, &http.Server{
+				Addr:    adminAddr,
+				Handler: hs.adminHandler(),
+			})
+		}
+	}
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		slog.Error("Server shutdown failed", "error", err)
-	} else {
-		slog.Info("Server shutdown gracefully")
+	var grpcServer *grpc.Server
+	if opts.grpcListen != "" {
+		var serverOpts []grpc.ServerOption
+		if serveTLS != nil {
+			serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(serveTLS)))
+		}
+		grpcServer = grpc.NewServer(serverOpts...)
+		discoverypb.RegisterDiscoveryServer(grpcServer, &discoveryServer{clusters: clusters, maintenance: &hs.maintenance})
 	}
 
-	wg.Wait()
-	slog.Info("Application shutdown complete")
-}
+	if opts.readyFile != "" {
+		wg.Go(func() {
+			maintainReadyFile(ctx, opts.readyFile, readyFileInterval, func() bool { return hs.readyToServe(clusters, st) })
+		})
+	}
 
-func discoverAPIServerOIDC(ctx context.Context, cl *rest.RESTClient) (*oidc.ProviderMetadata, error) {
-	res := cl.Get().RequestURI("/.well-known/openid-configuration").Do(ctx)
+	if logs != nil {
+		// we're about to handle requests, which mustn't wait on the disk.
+		logs.background()
+	}
+	for _, server := range servers {
+		wg.Go(func() {
+			ln := listeners[server.Addr]
+			slog.Info("listening", "addr", ln.Addr().String(), "tls", server.TLSConfig != nil)
+			serve := server.Serve
+			if server.TLSConfig != nil {
+				serve = func(ln net.Listener) error { return server.ServeTLS(ln, "", "") }
+			}
+			if err := serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Failed to serve", "addr", server.Addr, "error", err)
+				if logs != nil {
+					logs.flush()
+				}
+				os.Exit(1)
+			}
+		})
+	}
 
-	mdraw, err := res.Raw()
-	if err != nil {
-		return nil, fmt.Errorf("getting /.well-known/openid-configuration: %v", res.Error())
+	if grpcServer != nil {
+		wg.Go(func() {
+			ln := listeners[opts.grpcListen]
+			slog.Info("listening", "addr", ln.Addr().String(), "grpc", true, "tls", serveTLS != nil)
+			if err := grpcServer.Serve(ln); err != nil {
+				slog.Error("Failed to serve gRPC", "addr", opts.grpcListen, "error", err)
+				if logs != nil {
+					logs.flush()
+				}
+				os.Exit(1)
+			}
+		})
 	}
 
-	md := oidc.ProviderMetadata{}
-	if err := json.Unmarshal(mdraw, &md); err != nil {
-		return nil, fmt.Errorf("unmarshaling discovery response: %v", err)
+	<-ctx.Done()
+	if errors.Is(context.Cause(ctx), errPublishFailing) {
+		slog.Info("Publishing is failing, initiating graceful shutdown...")
+	} else {
+		slog.Info("Received shutdown signal, initiating graceful shutdown...")
 	}
 
-	return &md, nil
-}
+	if hs != nil {
+		hs.shuttingDown.Store(true)
+	}
+	if opts.shutdownDelay > 0 {
+		slog.Info("Reporting not ready before shutting down servers", "delay", opts.shutdownDelay)
+		time.Sleep(opts.shutdownDelay)
+	}
 
-type k8sAPIJWKSSource struct {
-	cl  *rest.RESTClient
-	url string
-}
+	shutdownCtx := context.WithoutCancel(ctx)
+	shutdownCtx, shutdownCancel := context.WithTimeout(shutdownCtx, opts.shutdownTimeout)
+	defer shutdownCancel()
 
-func (s *k8sAPIJWKSSource) GetJWKS(ctx context.Context) ([]byte, error) {
-	res := s.cl.Get().RequestURI(s.url).Do(ctx)
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(shutdownCtx); errors.Is(err, context.DeadlineExceeded) {
+				slog.Warn("Server shutdown timed out, closing remaining connections", "addr", server.Addr, "timeout", opts.shutdownTimeout)
+				if err := server.Close(); err != nil {
+					slog.Error("Server close failed", "addr", server.Addr, "error", err)
+				}
+			} else if err != nil {
+				slog.Error("Server shutdown failed", "addr", server.Addr, "error", err)
+			} else {
+				slog.Info("Server shutdown gracefully", "addr", server.Addr)
+			}
+		})
+	}
 
-	kraw, err := res.Raw()
-	if err != nil {
-		return nil, fmt.Errorf("getting %s: %v", s.url, res.Error())
+	if grpcServer != nil {
+		wg.Go(func() {
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				slog.Info("gRPC server shutdown gracefully", "addr", opts.grpcListen)
+			case <-shutdownCtx.Done():
+				slog.Warn("gRPC server shutdown timed out, closing remaining connections", "addr", opts.grpcListen, "timeout", opts.shutdownTimeout)
+				grpcServer.Stop()
+			}
+		})
 	}
 
-	return kraw, nil
+	wg.Wait()
+
+	// leave a final record of what we were serving, and make sure it and the
+	// last metrics get out, without holding up the exit for long.
+	flushCtx, flushCancel := context.WithTimeout(context.WithoutCancel(ctx), opts.flushTimeout)
+	defer flushCancel()
+	for _, c := range clusters {
+		c.pub.logFinalState()
+	}
+	if pusher != nil {
+		if err := pusher.push(flushCtx); err != nil {
+			slog.Error("Failed to push final metrics", "error", err)
+		}
+	}
+	slog.Info("Application shutdown complete")
+	if logs != nil && !logs.flushContext(flushCtx) {
+		fmt.Fprintf(os.Stderr, "Timed out writing the last logs to %s after %s\n", logs.path, opts.flushTimeout)
+	}
+	if errors.Is(context.Cause(ctx), errPublishFailing) {
+		os.Exit(1)
+	}
 }
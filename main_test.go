@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShutdownDuringDiscovery starts a publisher and server, shuts them down
+// the way main does while a discovery is blocked on the upstream, and checks
+// everything stops within the shutdown timeout without leaking goroutines.
+func TestShutdownDuringDiscovery(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	inflight := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inflight <- struct{}{}:
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+
+	p := &publisher{
+		src: &issuerSource{client: upstream.Client(), issuer: upstream.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept},
+		log: slog.Default(),
+	}
+	sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable}
+	p.addSink("http", sink)
+	hs := &httpServer{clusters: []*cluster{{name: "default", pub: p, sink: sink}}}
+	server := &http.Server{Handler: hs.handler()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		p.run(ctx, 5*time.Millisecond, 0)
+	})
+	wg.Go(func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("serve: %v", err)
+		}
+	})
+
+	// the documents aren't discovered yet while the refresh is blocked.
+	select {
+	case <-inflight:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for discovery to start")
+	}
+	resp, err := http.Get("http://" + ln.Addr().String() + defaultDiscoveryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("discovery document served with status %d mid-discovery, want 503", resp.StatusCode)
+	}
+
+	const shutdownTimeout = 2 * time.Second
+	start := time.Now()
+	cancel()
+	hs.shuttingDown.Store(true)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("server shutdown: %v", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		t.Fatalf("publisher and server still running %s after shutdown started", time.Since(start))
+	}
+
+	close(release)
+	upstream.Close()
+	http.DefaultClient.CloseIdleConnections()
+
+	// exiting goroutines take a moment to be gone.
+	deadline := time.Now().Add(shutdownTimeout)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines running after shutdown, %d before starting:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maintenanceRoutes returns the endpoints for entering and leaving
+// maintenance mode.
+func (s *httpServer) maintenanceRoutes() []route {
+	return []route{
+		{
+			method:      http.MethodPost,
+			path:        "/debug/maintenance",
+			description: "Enter maintenance mode, serving the documents and readiness as 503s with Retry-After while discovery continues",
+			handler:     s.serveMaintenance(true),
+			admin:       true,
+			internal:    true,
+		},
+		{
+			method:      http.MethodDelete,
+			path:        "/debug/maintenance",
+			description: "Leave maintenance mode, serving the documents again",
+			handler:     s.serveMaintenance(false),
+			admin:       true,
+			internal:    true,
+		},
+	}
+}
+
+func (s *httpServer) serveMaintenance(enter bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.maintenance.Swap(enter) != enter {
+			if enter {
+				slog.Warn("Entered maintenance mode, the documents aren't being served")
+			} else {
+				slog.Info("Left maintenance mode, serving the documents again")
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"maintenance": enter})
+	}
+}
+
+// unlessMaintenance serves next, unless we're in maintenance mode.
+func (s *httpServer) unlessMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.maintenance.Load() {
+			s.serveMaintenanceResponse(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveMaintenanceResponse tells the client we're down for maintenance, and
+// when to try again.
+func (s *httpServer) serveMaintenanceResponse(w http.ResponseWriter) {
+	if s.maintenanceRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.maintenanceRetryAfter.Round(time.Second)/time.Second)))
+	}
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "maintenance", "error": "down for maintenance"})
+}
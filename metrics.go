@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsPrefix is the prefix our metrics are registered with, see
+// prefixGatherer.
+const metricsPrefix = "k8soidcpublisher_"
+
+var (
+	// the cluster label is the configured cluster name, or empty for
+	// process wide endpoints, so its cardinality is bounded by the config.
+	httpResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8soidcpublisher_http_responses_total",
+		Help: "HTTP responses served, by cluster, endpoint and status code.",
+	}, []string{"cluster", "endpoint", "code"})
+
+	httpResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8soidcpublisher_http_response_bytes_total",
+		Help: "Bytes of HTTP response bodies served, by cluster and endpoint.",
+	}, []string{"cluster", "endpoint"})
+
+	refreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8soidcpublisher_refreshes_total",
+		Help: "Discovery refreshes, by cluster and result.",
+	}, []string{"cluster", "result"})
+
+	discoveryErrorTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8soidcpublisher_last_discovery_error_timestamp_seconds",
+		Help: "Unix time of the most recent failed discovery, by cluster. The recent errors themselves are at /debug/errors.",
+	}, []string{"cluster"})
+
+	logLinesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "k8soidcpublisher_log_lines_dropped_total",
+		Help: "Log lines dropped because writing them to -log-file fell behind.",
+	})
+
+	retainedKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "k8soidcpublisher_retained_keys",
+		Help: "Keys held in key set snapshots for -retain-key-sets and -jwks-versions, across all clusters. Capped by -max-retained-keys.",
+	})
+
+	upstreamBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8soidcpublisher_upstream_document_bytes",
+		Help: "Size of the upstream discovery documents as last fetched, by cluster and document (metadata or jwks).",
+	}, []string{"cluster", "document"})
+
+	// contentInfo has a single series per cluster, for the hash of what it
+	// last published, so replicas can be compared.
+	contentInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8soidcpublisher_content_info",
+		Help: "Always 1, labelled with the hash of the published discovery documents, by cluster.",
+	}, []string{"cluster", "hash"})
+)
+
+// discoveryAge reports how long ago each cluster's discovery last succeeded.
+var discoveryAge = &discoveryAgeCollector{}
+
+func init() {
+	prometheus.MustRegister(httpResponses, httpResponseBytes, refreshes, discoveryErrorTime, logLinesDropped, retainedKeys, upstreamBytes, contentInfo, discoveryAge)
+}
+
+var discoveryAgeDesc = prometheus.NewDesc(
+	"k8soidcpublisher_seconds_since_last_successful_discovery",
+	"Seconds since discovery last succeeded, by cluster, or since startup if it never has. Alert on this, e.g. > 900.",
+	[]string{"cluster"}, nil,
+)
+
+// discoveryAgeCollector computes each cluster's time since its last
+// successful discovery at scrape time, so it's always current without
+// anything having to keep it updated.
+type discoveryAgeCollector struct {
+	mu       sync.Mutex
+	clusters []discoveryAgeCluster
+}
+
+type discoveryAgeCluster struct {
+	pub *publisher
+	// added stands in for the last success until there is one.
+	added time.Time
+}
+
+func (c *discoveryAgeCollector) add(p *publisher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clusters = append(c.clusters, discoveryAgeCluster{pub: p, added: time.Now()})
+}
+
+func (c *discoveryAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- discoveryAgeDesc
+}
+
+func (c *discoveryAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, dc := range c.clusters {
+		last := dc.pub.lastSuccess()
+		if last.IsZero() {
+			last = dc.added
+		}
+		ch <- prometheus.MustNewConstMetric(discoveryAgeDesc, prometheus.GaugeValue, time.Since(last).Seconds(), dc.pub.cluster)
+	}
+}
+
+// metricsGatherer returns the gatherer for the metrics we export, with our
+// own named with prefix.
+func metricsGatherer(prefix string) prometheus.Gatherer {
+	if prefix == metricsPrefix {
+		return prometheus.DefaultGatherer
+	}
+	return prefixGatherer{Gatherer: prometheus.DefaultGatherer, prefix: prefix}
+}
+
+// prefixGatherer renames our metrics from metricsPrefix to prefix, for
+// -metrics-prefix. The Go runtime, process and promhttp metrics keep their
+// standard names, so off the shelf dashboards for them still work.
+type prefixGatherer struct {
+	prometheus.Gatherer
+	prefix string
+}
+
+func (g prefixGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if name, ok := strings.CutPrefix(mf.GetName(), metricsPrefix); ok {
+			mf.Name = proto.String(g.prefix + name)
+		}
+	}
+	// gatherers return the families sorted by name.
+	slices.SortFunc(mfs, func(a, b *dto.MetricFamily) int { return strings.Compare(a.GetName(), b.GetName()) })
+	return mfs, err
+}
+
+// validateMetricsPrefix checks prefix makes valid metric names, starting with
+// a letter, underscore or colon followed by any of those or digits. It may be
+// empty.
+func validateMetricsPrefix(prefix string) error {
+	for i, c := range prefix {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return fmt.Errorf("%q isn't a valid metric name prefix, it must be letters, digits, _ and : and not start with a digit", prefix)
+		}
+	}
+	return nil
+}
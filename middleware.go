@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// requestID tags each request with an ID, echoed in the response header and
+// logs so a client's request can be matched with our logs. An incoming
+// X-Request-Id is used if it looks sane, otherwise one is generated.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			_, _ = rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether a client provided ID is safe to echo and log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type publicOriginKey struct{}
+
+// forwarded applies the public host and scheme a reverse proxy reports in the
+// Forwarded or X-Forwarded-Host/X-Forwarded-Proto headers, so requests are
+// routed by the host the client asked for and the origin is available via
+// publicOriginFromContext. The headers are trivially spoofed, so this must
+// only be used behind a proxy that sets them.
+func forwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto, host := forwardedHeaders(r)
+		if host == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if proto != "http" && proto != "https" {
+			proto = "http"
+			if r.TLS != nil {
+				proto = "https"
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), publicOriginKey{}, proto+"://"+host))
+		r.Host = host
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedHeaders returns the proto and host from the first hop of the
+// Forwarded header, falling back to the X-Forwarded-* headers.
+func forwardedHeaders(r *http.Request) (proto, host string) {
+	if f := r.Header.Get("Forwarded"); f != "" {
+		first, _, _ := strings.Cut(f, ",")
+		for pair := range strings.SplitSeq(first, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			v = strings.Trim(v, `"`)
+			switch strings.ToLower(k) {
+			case "proto":
+				proto = strings.ToLower(v)
+			case "host":
+				host = v
+			}
+		}
+		if host != "" {
+			return proto, validHost(host)
+		}
+	}
+
+	host, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+	proto, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.ToLower(strings.TrimSpace(proto)), validHost(strings.TrimSpace(host))
+}
+
+// validHost returns host if it is a plausible host[:port], otherwise an empty
+// string.
+func validHost(host string) string {
+	if host == "" || strings.ContainsAny(host, "/?#@ \t") {
+		return ""
+	}
+	if _, err := url.Parse("http://" + host); err != nil {
+		return ""
+	}
+	return strings.ToLower(host)
+}
+
+// publicOriginFromContext returns the scheme://host the client used, if it was
+// reported by a trusted proxy.
+func publicOriginFromContext(ctx context.Context) string {
+	o, _ := ctx.Value(publicOriginKey{}).(string)
+	return o
+}
+
+// instrument logs and records metrics for each request served by next. The
+// endpoint is the mux pattern that matched the request, so label cardinality
+// is bounded by the routes we serve. clusters maps patterns to the cluster
+// they serve.
+func instrument(clusters map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rw, r)
+
+		endpoint := r.Pattern
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		cluster := clusters[r.Pattern]
+		httpResponses.WithLabelValues(cluster, endpoint, strconv.Itoa(rw.status)).Inc()
+		httpResponseBytes.WithLabelValues(cluster, endpoint).Add(float64(rw.bytes))
+
+		slog.Info("request",
+			"request-id", requestIDFromContext(r.Context()),
+			"cluster", cluster,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.status,
+			"bytes", rw.bytes,
+			"duration", time.Since(start),
+			"remote-addr", r.RemoteAddr,
+			"user-agent", r.UserAgent(),
+		)
+	})
+}
+
+// responseWriter captures the status code and body size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// oldIssuer is an issuer being migrated away from, whose documents are served
+// alongside the current issuer's until its cutover, for relying parties that
+// haven't moved yet.
+type oldIssuer struct {
+	issuer string
+	until  time.Time
+	// host and path are where the old issuer's documents are served.
+	host string
+	path string
+}
+
+// parseOldIssuer parses an old issuer URL, served until the RFC 3339 time
+// until.
+func parseOldIssuer(issuer, until string) (*oldIssuer, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer %q: %v", issuer, err)
+	}
+	if u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("issuer %q must be an https URL without a query or fragment", issuer)
+	}
+	if until == "" {
+		return nil, errors.New("a cutover time is required")
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return nil, fmt.Errorf("cutover %q is not an RFC 3339 timestamp, e.g. 2025-01-02T15:04:05Z", until)
+	}
+	return &oldIssuer{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		until:  t,
+		// the mux matches hosts exactly, and without the port.
+		host: strings.ToLower(u.Hostname()),
+		path: strings.TrimSuffix(u.Path, "/"),
+	}, nil
+}
+
+// oldIssuerRoutes returns the endpoints serving the documents for the old
+// issuer, with the migration headers.
+func (h *httpSink) oldIssuerRoutes(cluster string) []route {
+	o := h.oldIssuer
+	return []route{
+		{
+			method:      http.MethodGet,
+			cluster:     cluster,
+			host:        o.host,
+			path:        o.path + "/.well-known/openid-configuration",
+			description: fmt.Sprintf("OIDC discovery document for the old issuer %s, until %s", o.issuer, o.until.Format(time.RFC3339)),
+			handler:     h.untilCutover(h.migrationHeaderHandler(h.serveOldMetadata)),
+		},
+		{
+			method:      http.MethodGet,
+			cluster:     cluster,
+			host:        o.host,
+			path:        o.path + "/.well-known/jwks.json",
+			description: fmt.Sprintf("JSON Web Key Set for the old issuer %s, until %s", o.issuer, o.until.Format(time.RFC3339)),
+			handler:     h.untilCutover(h.migrationHeaderHandler(h.serveJWKS)),
+		},
+	}
+}
+
+// untilCutover serves next until the old issuer's cutover, and a 410 after.
+func (h *httpSink) untilCutover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !time.Now().Before(h.oldIssuer.until) {
+			writeJSON(w, http.StatusGone, map[string]string{"error": fmt.Sprintf("issuer %s was retired at %s", h.oldIssuer.issuer, h.oldIssuer.until.Format(time.RFC3339))})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveOldMetadata serves the metadata rewritten for the old issuer.
+func (h *httpSink) serveOldMetadata(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	md := h.metadata
+	h.mu.RUnlock()
+
+	var doc *document
+	if md != nil {
+		d, err := h.issuerDocument(md, h.oldIssuer.issuer)
+		if err != nil {
+			slog.Error("Failed to build metadata for the old issuer", "issuer", h.oldIssuer.issuer, "error", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		doc = d
+	}
+	stale, _ := h.documentsStale(h.state)
+	h.serveDocument(w, r, "application/json", doc, stale)
+}
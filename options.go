@@ -0,0 +1,630 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// options holds the command line flags. validate checks the rules between
+// them, so each is defined once, whatever else reads the flags.
+type options struct {
+	listen        string
+	kubeconfig    string
+	noInCluster   bool
+	kubeContext   string
+	discoveryAcc  string
+	discoveryPath string
+	sourceURL     string
+	clustersPath  string
+	jwksAttempts  int
+	jwksBackoff   time.Duration
+	jwksMaxBack   time.Duration
+	caFile        string
+	clientCert    string
+	clientKey     string
+	insecureTLS   bool
+	apiProtocol   string
+	h2PingEvery   time.Duration
+	h2PingTimeout time.Duration
+	h2ConnWindow  int
+	h2StrmWindow  int
+	reresolveAPI  time.Duration
+	sshBastionAt  string
+	sshUser       string
+	sshKeyFile    string
+	sshKnownHosts string
+	corrHeader    string
+	corrPer       string
+	kubeQPS       float64
+	kubeBurst     int
+	proxyURL      string
+
+	shutdownDelay   time.Duration
+	flushTimeout    time.Duration
+	shutdownTimeout time.Duration
+	warmupTimeout   time.Duration
+	noFatalWarmup   bool
+	discoveryConc   int
+	refreshMode     string
+	watchInterval   time.Duration
+	refreshInterval time.Duration
+	staleAfter      time.Duration
+	staleClockSkew  time.Duration
+	readyFile       string
+	errorHistory    int
+	staleSeparately bool
+	unreadyOnFail   bool
+	staleMode       string
+	cacheMaxAge     time.Duration
+	staleRevalidate time.Duration
+	gzipDocuments   bool
+	serveDir        string
+	prettyDocuments bool
+	prettyQuery     bool
+	jwksContentType string
+	contentHashHdr  bool
+	deprecatedAt    string
+	sunsetAt        string
+	combinedPath    string
+	initStatus      int
+	spiffeBundle    bool
+	spiffeRefresh   time.Duration
+	jwksVersions    int
+	scopesDefault   string
+	claimsDefault   string
+	subjectsDefault string
+	oldIssuerURL    string
+	oldIssuerUntil  string
+	canonicalKeys   bool
+	allowedKty      string
+	sameOriginJWKS  bool
+	certThumbprints bool
+	eksCompat       bool
+	duplicateKIDs   string
+	suspectDocs     string
+	dropInvalidKeys bool
+	retainKeySets   int
+	maxRetainedKeys int
+	retainKeysFor   time.Duration
+	grpcListen      string
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCA     string
+	adminListen     string
+	adminOnListen   bool
+	adminTokenFile  string
+	debugEndpoints  bool
+	adminEndpoints  bool
+	refreshTimeout  time.Duration
+	maintenance     bool
+	maintRetryAfter time.Duration
+	rateLimit       float64
+	rateLimitBurst  int
+	rateLimitExempt string
+	pushURL         string
+	metricsPrefixF  string
+	pushJob         string
+	pushInterval    time.Duration
+	errorBodyFile   string
+	errorBodyType   string
+	statusPage      bool
+	openMetrics     bool
+	auditLogFile    string
+	trustForwarded  bool
+	pathMapPath     string
+	issuerDNSMode   string
+	checkJWKSURI    bool
+	serveIssuerPath bool
+
+	validateMode      bool
+	inspectMode       bool
+	inspectPath       string
+	verifyMode        bool
+	selftestMode      bool
+	selftestTokenFile string
+
+	publishDir       string
+	cacheDir         string
+	publishConfigMap string
+	publishGit       string
+	gitBranch        string
+	gitDir           string
+	gitTokenFile     string
+	gitUsername      string
+	putMetadataURL   string
+	putJWKSURL       string
+	putHeadersFile   string
+	putAttempts      int
+	putBackoff       time.Duration
+	putDryRun        bool
+	publishResync    time.Duration
+	deleteStale      time.Duration
+	exitAfterFails   int
+	publishOnlyValid bool
+	leaderElect      bool
+	leaseNamespace   string
+	leaseName        string
+	logLevel         string
+	logDest          string
+	eventsObject     string
+	eventsNamespace  string
+	eventsFailing    time.Duration
+	leaseIdentity    string
+
+	// set holds the names of the flags given on the command line, for
+	// telling an explicit value apart from the default.
+	set map[string]bool
+}
+
+// parseOptions parses the flags in args into options, and validates them.
+func parseOptions(fs *flag.FlagSet, args []string) (*options, error) {
+	o := &options{}
+	o.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	o.set = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { o.set[f.Name] = true })
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// register defines the flags on fs, setting o's fields.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.listen, "listen", "localhost:8080", "address to listen on. Set to empty to disable serving over HTTP")
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to kubeconfig file, or a list of them separated as in KUBECONFIG to merge as kubectl does. Defaults to KUBECONFIG, otherwise the in-cluster config is used")
+	fs.BoolVar(&o.noInCluster, "no-in-cluster", false, "Fail if no kubeconfig is given, rather than falling back to the in-cluster config")
+	fs.StringVar(&o.kubeContext, "context", "", "Name of the kubeconfig context to use, instead of the current context")
+	fs.StringVar(&o.discoveryAcc, "discovery-accept", defaultDiscoveryAccept, "Accept header to request the discovery document and key set with, so content negotiation can't return another representation")
+	fs.StringVar(&o.discoveryPath, "discovery-path", defaultDiscoveryPath, "Path on the API server, or under -source-url, to fetch the discovery document from")
+	fs.StringVar(&o.sourceURL, "source-url", "", "Republish the OIDC issuer at this URL, fetched over plain HTTP(S), rather than a Kubernetes API server")
+	fs.StringVar(&o.clustersPath, "clusters-file", "", "YAML file mapping the host and path prefix each of several clusters is served under to its kubeconfig, instead of -kubeconfig and -context")
+	fs.IntVar(&o.jwksAttempts, "external-jwks-attempts", 3, "Attempts at fetching a -source-url issuer's key set per refresh, when it's hosted on another host such as a CDN")
+	fs.DurationVar(&o.jwksBackoff, "external-jwks-backoff", time.Second, "Delay before retrying an external key set fetch, doubling with each retry up to -external-jwks-max-backoff, with jitter")
+	fs.DurationVar(&o.jwksMaxBack, "external-jwks-max-backoff", 10*time.Second, "Longest delay between retries of an external key set fetch")
+	fs.StringVar(&o.caFile, "certificate-authority", "", "CA bundle to verify the API server with, rather than the kubeconfig's or in-cluster CA")
+	fs.StringVar(&o.clientCert, "client-certificate", "", "Client certificate to present to the API server, for API servers requiring mTLS. Requires -client-key")
+	fs.StringVar(&o.clientKey, "client-key", "", "Private key for -client-certificate")
+	fs.BoolVar(&o.insecureTLS, "insecure-skip-tls-verify", false, "Don't verify the API server's certificate. Only for development clusters, anyone between us and the API server can then substitute their own keys")
+	fs.StringVar(&o.apiProtocol, "api-server-protocol", apiServerProtocolDefault, "Protocol to reach the API server with, http1 to force HTTP/1.1 for proxies that mangle HTTP/2, or http2 to force HTTP/2 with the -api-server-http2-* settings. By default client-go negotiates it")
+	fs.DurationVar(&o.h2PingEvery, "api-server-http2-ping-interval", 30*time.Second, "With -api-server-protocol=http2, how long a connection can be idle before it's health checked with a ping")
+	fs.DurationVar(&o.h2PingTimeout, "api-server-http2-ping-timeout", 15*time.Second, "With -api-server-protocol=http2, how long to wait for a ping reply before closing the connection")
+	fs.IntVar(&o.h2ConnWindow, "api-server-http2-connection-window", 0, "With -api-server-protocol=http2, the connection flow control window in bytes. Larger windows help on high latency links. 0 uses Go's default")
+	fs.IntVar(&o.h2StrmWindow, "api-server-http2-stream-window", 0, "With -api-server-protocol=http2, the per stream flow control window in bytes. 0 uses Go's default")
+	fs.DurationVar(&o.reresolveAPI, "api-server-reresolve-interval", 0, "How often to close idle connections to the API server, so the next request looks its address up again and follows DNS changes, e.g. during control plane upgrades. Otherwise connections kept alive by frequent requests stick to the address they were opened to. 0 disables it")
+	fs.StringVar(&o.sshBastionAt, "ssh-bastion", "", "SSH host, as host or host:port, to reach the API servers through, for networks where they're only reachable from a bastion. The connection is made on first use and again if it drops")
+	fs.StringVar(&o.sshUser, "ssh-user", "", "User to log in to -ssh-bastion as")
+	fs.StringVar(&o.sshKeyFile, "ssh-key-file", "", "Unencrypted private key to authenticate to -ssh-bastion with")
+	fs.StringVar(&o.sshKnownHosts, "ssh-known-hosts", "", "known_hosts file to verify -ssh-bastion's host key against. Defaults to ~/.ssh/known_hosts")
+	fs.StringVar(&o.corrHeader, "correlation-header", "", "Header to send an ID in with the discovery requests, e.g. Audit-ID, which the API server records as the audit event's ID, so our requests can be found in the audit log. The ID is logged. Empty sends none")
+	fs.StringVar(&o.corrPer, "correlation-id-per", correlationPerRefresh, "How often the -correlation-header ID changes: refresh for a new one per refresh, or run for one for the whole run")
+	fs.Float64Var(&o.kubeQPS, "kube-qps", 5, "Requests per second allowed to each API server, before client-side throttling. Discovery makes a couple per refresh, so client-go's default of 5 is plenty unless the ConfigMap sink or leader election are busy. Negative disables throttling")
+	fs.IntVar(&o.kubeBurst, "kube-burst", 10, "Requests allowed in a burst above -kube-qps to each API server, client-go's default")
+	fs.StringVar(&o.proxyURL, "proxy-url", "", "http, https or socks5 proxy to reach the API server through. By default the kubeconfig's proxy-url, then the HTTPS_PROXY/NO_PROXY environment is used")
+
+	fs.DurationVar(&o.shutdownDelay, "shutdown-delay", 0, "How long to keep serving after a shutdown signal with /readyz reporting not ready, so load balancers stop sending requests before the servers shut down. The pod's termination grace period must cover this and -shutdown-timeout")
+	fs.DurationVar(&o.flushTimeout, "shutdown-flush-timeout", 5*time.Second, "How long to spend on shutdown pushing the final metrics to -metrics-push-url and writing the last logs, after the servers have shut down")
+	fs.DurationVar(&o.shutdownTimeout, "shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests to complete on shutdown, before closing their connections")
+	fs.DurationVar(&o.warmupTimeout, "warmup-timeout", 5*time.Minute, "How long to keep retrying the initial discovery before giving up")
+	fs.BoolVar(&o.noFatalWarmup, "no-fatal-warmup", false, "Don't exit if the initial discovery fails within -warmup-timeout. Start serving straight away, returning 503s until discovery succeeds")
+	fs.IntVar(&o.discoveryConc, "discovery-concurrency", 8, "Maximum number of clusters discovered at once with -clusters-file. 0 is unbounded")
+	fs.StringVar(&o.refreshMode, "refresh-mode", refreshModePoll, "How to keep the documents up to date. poll refreshes every -refresh-interval, watch checks for changes every -watch-interval with conditional requests, falling back to polling if the upstream doesn't support them")
+	fs.DurationVar(&o.watchInterval, "watch-interval", 15*time.Second, "How often to check for changes with -refresh-mode=watch")
+	fs.DurationVar(&o.refreshInterval, "refresh-interval", 5*time.Minute, "How often to re-discover the API server's metadata and keys")
+	fs.DurationVar(&o.staleAfter, "stale-after", 30*time.Minute, "How long after the last successful discovery the documents are considered stale. 0 disables staleness checks")
+	fs.DurationVar(&o.staleClockSkew, "stale-clock-skew", 0, "Extra tolerance added to -stale-after, so clock differences don't mark fresh documents stale")
+	fs.StringVar(&o.readyFile, "ready-file", "", "File to create once the documents are ready to serve, and remove whenever /readyz would report not ready, including in maintenance mode and on shutdown, for file based readiness probes")
+	fs.IntVar(&o.errorHistory, "error-history", 10, "Number of recent discovery errors to keep, with when they happened, for /debug/errors")
+	fs.BoolVar(&o.staleSeparately, "stale-independently", false, "Judge the metadata and key set's staleness separately, so one can keep being served while only the other is failing. An empty key set is also served as a 503")
+	fs.BoolVar(&o.unreadyOnFail, "unready-on-failure", false, "Report not ready as soon as a discovery attempt fails, rather than once the documents go stale. The documents are still served until -stale-after")
+	fs.StringVar(&o.staleMode, "stale-mode", staleModeFailClosed, "What to do when the documents are stale. fail-closed returns a 503, fail-open keeps serving them")
+	fs.DurationVar(&o.cacheMaxAge, "cache-max-age", 5*time.Minute, "max-age for the Cache-Control header on the served documents")
+	fs.DurationVar(&o.staleRevalidate, "cache-stale-while-revalidate", 0, "stale-while-revalidate for the Cache-Control header on the served documents, letting caches serve them for this long past max-age while they revalidate. 0 omits it")
+	fs.BoolVar(&o.gzipDocuments, "gzip", false, "Serve gzip compressed documents to clients that accept them. Documents are compressed once when they change")
+	fs.StringVar(&o.serveDir, "serve-dir", "", "Serve the documents in this directory over -listen, read only, rather than discovering them, e.g. the -publish-dir of a publisher running elsewhere. A document with a .gz copy alongside it at least as new, as written by gzip -k, is served that copy to clients that accept gzip. With -gzip the rest are compressed on each request")
+	fs.BoolVar(&o.prettyDocuments, "pretty", false, "Serve the documents indented for readability, rather than compact")
+	fs.BoolVar(&o.prettyQuery, "pretty-query", false, "Serve the documents indented to requests with ?pretty=1, for reading them by hand, while other requests get the usual documents. Indented responses aren't cacheable")
+	fs.StringVar(&o.jwksContentType, "jwks-content-type", "application/jwk-set+json", "Content-Type to serve the JWKS with, e.g. application/json for clients that reject application/jwk-set+json")
+	fs.BoolVar(&o.contentHashHdr, "content-hash-header", false, "Add the hash of the published documents to their responses as X-Content-Hash, to compare what replicas serve. It's also always reported by the k8soidcpublisher_content_info metric")
+	fs.StringVar(&o.deprecatedAt, "deprecation", "", "RFC 3339 time the issuer was deprecated, e.g. 2025-01-02T15:04:05Z, served in a Deprecation header with the documents to warn relying parties during an issuer migration")
+	fs.StringVar(&o.sunsetAt, "sunset", "", "RFC 3339 time the issuer's endpoints will go away, served in a Sunset header with the documents")
+	fs.StringVar(&o.combinedPath, "combined-jwks-path", "", "Path to also serve the union of every cluster's keys at, deduplicated by kid, for any host, e.g. /combined/jwks. Empty disables it")
+	fs.IntVar(&o.initStatus, "initializing-status", http.StatusServiceUnavailable, "HTTP status for the documents and /readyz before discovery first succeeds, so a cold start can be told apart from stale documents, which are always a 503. Must be a 4xx or 5xx")
+	fs.BoolVar(&o.spiffeBundle, "spiffe-bundle", false, "Also serve the keys as a SPIFFE trust bundle at spiffe-bundle.json alongside the JWKS, so SPIRE can federate with the cluster's service account tokens as JWT-SVIDs")
+	fs.DurationVar(&o.spiffeRefresh, "spiffe-refresh-hint", 0, "How often to tell -spiffe-bundle consumers to check for a new bundle, as spiffe_refresh_hint. 0 uses -refresh-interval")
+	fs.IntVar(&o.jwksVersions, "jwks-versions", 0, "Number of key set versions to retain and serve under the JWKS path at /versions/<version>, with an index at /versions, so relying parties can pin to one during a key migration. 0 disables them")
+	fs.StringVar(&o.scopesDefault, "scopes-supported", "", "Comma separated scopes_supported to serve in the metadata when the upstream omits it, for relying parties that require it. Must include openid")
+	fs.StringVar(&o.claimsDefault, "claims-supported", "", "Comma separated claims_supported to serve in the metadata when the upstream omits it")
+	fs.StringVar(&o.subjectsDefault, "subject-types-supported", "", "Comma separated subject_types_supported (public or pairwise) to serve in the metadata when the upstream omits it")
+	fs.StringVar(&o.oldIssuerURL, "old-issuer", "", "Issuer being migrated away from, whose documents are also served, at its host and path, until -old-issuer-until. They're served with the Deprecation and Sunset headers rather than the current issuer's")
+	fs.StringVar(&o.oldIssuerUntil, "old-issuer-until", "", "RFC 3339 time -old-issuer's documents stop being served, and its Sunset")
+	fs.BoolVar(&o.canonicalKeys, "canonical-keys", false, "Publish each key's members in a fixed order (kty, use, kid, alg, then the key type's parameters) for strict parsers")
+	fs.StringVar(&o.allowedKty, "allowed-kty", defaultAllowedKeyTypes, "Comma separated key types (kty) to publish, others are dropped from the key set with a warning")
+	fs.BoolVar(&o.sameOriginJWKS, "require-same-origin-jwks", false, "Reject discovery documents whose jwks_uri isn't on the issuer's scheme and host, so a misconfigured or compromised upstream can't point verification at keys elsewhere")
+	fs.BoolVar(&o.certThumbprints, "x5t-s256", false, "Add the x5t#S256 certificate thumbprint to keys that carry an x5c certificate chain without one, for verifiers that match keys by certificate. x5c chains are always published as given")
+	fs.BoolVar(&o.eksCompat, "eks-compat", false, "Serve the key set as EKS does, with use, alg and kid set on every key and only RSA and EC signing keys, for registering a self-managed cluster as an AWS IAM OIDC provider")
+	fs.StringVar(&o.duplicateKIDs, "duplicate-kids", duplicateKIDsAllow, "How to handle keys sharing a kid, which is ambiguous for verifiers that look keys up by it: allow, first to keep only the first with a warning, or reject to fail the refresh")
+	fs.StringVar(&o.suspectDocs, "suspect-documents", suspectReject, "What to do with discovery documents that parse but look degraded, with required lists missing, lists that are empty or no keys. reject fails the refresh, keeping the previous documents until they go stale, accept publishes them. Both log the reasons")
+	fs.BoolVar(&o.dropInvalidKeys, "drop-invalid-keys", false, "Drop keys that don't parse in to a usable public key from the published set with a warning, rather than failing the refresh")
+	fs.IntVar(&o.retainKeySets, "retain-key-sets", 0, "Number of previous key sets whose keys stay published after they are removed by the API server, for -retain-keys-for. 0 disables retention")
+	fs.IntVar(&o.maxRetainedKeys, "max-retained-keys", 0, "Most keys to hold in key set snapshots for -retain-key-sets and -jwks-versions, across all clusters. The oldest snapshots are evicted past this. 0 for no cap")
+	fs.DurationVar(&o.retainKeysFor, "retain-keys-for", 24*time.Hour, "How long keys from previous key sets stay published after being removed by the API server")
+	fs.StringVar(&o.grpcListen, "grpc-listen", "", "Address to also serve the documents on over gRPC, with the k8soidcpublisher.v1.Discovery service in discoverypb/discovery.proto, for service meshes standardized on it. They're the ones served over HTTP, so it requires -listen. Uses -tls-cert-file if set")
+	fs.StringVar(&o.tlsCertFile, "tls-cert-file", "", "Certificate to serve -listen over HTTPS with, rather than plain HTTP. Requires -tls-key-file. It's read once at startup")
+	fs.StringVar(&o.tlsKeyFile, "tls-key-file", "", "Private key for -tls-cert-file")
+	fs.StringVar(&o.tlsClientCA, "tls-client-ca-file", "", "CA bundle client certificates must be issued by to connect to -listen, so only their holders can fetch the documents. Requires -tls-cert-file. Probes without a certificate need -admin-listen")
+	fs.StringVar(&o.adminListen, "admin-listen", defaultAdminListen, "Address to serve /metrics and the admin endpoints on, away from the documents on -listen. An address without a host (e.g. :9090) binds to 127.0.0.1, and one reachable from other hosts is logged as a warning")
+	fs.BoolVar(&o.adminOnListen, "admin-on-listen", false, "Serve /metrics and the admin endpoints on -listen alongside the documents, rather than on -admin-listen. They are then as reachable as the documents are")
+	fs.StringVar(&o.adminTokenFile, "admin-token-file", "", "File containing the bearer token for the admin and debug endpoints, required to enable them")
+	fs.BoolVar(&o.debugEndpoints, "enable-debug-endpoints", false, "Serve the read only /debug endpoints, /debug/upstream, /debug/validation and /debug/errors. Requires -admin-token-file")
+	fs.BoolVar(&o.adminEndpoints, "enable-admin-endpoints", false, "Serve the admin endpoints that change state, /debug/expire, /debug/refresh and /debug/maintenance. Requires -admin-token-file")
+	fs.DurationVar(&o.refreshTimeout, "admin-refresh-timeout", 30*time.Second, "How long POST /debug/refresh waits for the discovery it triggers, which is cancelled then, or as soon as the admin client disconnects")
+	fs.BoolVar(&o.maintenance, "maintenance", false, "Start in maintenance mode, serving the documents and readiness as 503s while discovery carries on, to take the publisher out of rotation. Leave it with DELETE /debug/maintenance, see -enable-admin-endpoints")
+	fs.DurationVar(&o.maintRetryAfter, "maintenance-retry-after", 5*time.Minute, "Retry-After sent with maintenance mode responses. 0 omits it")
+	fs.Float64Var(&o.rateLimit, "rate-limit", 0, "Requests a second served over -listen, on average, refusing the rest with 429s so a burst of relying parties can't overwhelm us. 0 doesn't limit them")
+	fs.IntVar(&o.rateLimitBurst, "rate-limit-burst", 0, "Requests served in a burst over -rate-limit. 0 allows a second's worth")
+	fs.StringVar(&o.rateLimitExempt, "rate-limit-exempt", defaultRateLimitExempt, "Comma separated paths never rate limited, by default the health and readiness probes and metrics scrapes, which would otherwise take us out of rotation under load")
+	fs.StringVar(&o.pushURL, "metrics-push-url", "", "Prometheus Pushgateway to push the metrics to every -metrics-push-interval, and a final time on shutdown, for setups where nothing scrapes us")
+	fs.StringVar(&o.metricsPrefixF, "metrics-prefix", metricsPrefix, "Prefix for our metric names, in place of k8soidcpublisher_, to fit naming conventions or avoid collisions with other exporters. The Go runtime and process metrics keep their standard names")
+	fs.StringVar(&o.pushJob, "metrics-push-job", "k8soidcpublisher", "Job the metrics are pushed to -metrics-push-url under. They are grouped by instance, our host name")
+	fs.DurationVar(&o.pushInterval, "metrics-push-interval", time.Minute, "How often to push the metrics to -metrics-push-url")
+	fs.StringVar(&o.errorBodyFile, "error-body-file", "", "Go text/template file rendering the bodies of 404, 405 and 503 responses to relying parties, for clients expecting errors of a particular shape, with .Status, .StatusText, .Method and .Path, and a json function to quote values. Without it they're JSON")
+	fs.StringVar(&o.errorBodyType, "error-body-content-type", "application/json", "Content-Type of the -error-body-file bodies. A JSON type is checked to render valid JSON at startup")
+	fs.BoolVar(&o.statusPage, "status-page", false, "Serve an HTML status page at /, showing each cluster's issuer, keys, last discovery and health, for operators browsing to us")
+	fs.BoolVar(&o.openMetrics, "openmetrics", false, "Serve /metrics in the OpenMetrics format regardless of the scraper's Accept header. Otherwise it's served to scrapers that ask for it")
+	fs.StringVar(&o.auditLogFile, "audit-log-file", "", "File to append audit events for admin endpoint access to, as JSON lines. By default they are logged with the other logs, tagged log=audit")
+	fs.BoolVar(&o.trustForwarded, "trust-forwarded-headers", false, "Take the public host and scheme from the Forwarded or X-Forwarded-Host/X-Forwarded-Proto headers, for routing and as the served issuer. Only set this behind a proxy that sets them")
+	fs.StringVar(&o.pathMapPath, "path-map-file", "", "YAML file mapping issuers to exactly which paths their discovery document and key set are served at, for when the issuer and serving URLs diverge, e.g. behind a path rewriting proxy")
+	fs.StringVar(&o.issuerDNSMode, "issuer-dns-check", issuerDNSOff, "Look up the issuer's host when it's first discovered, as relying parties can't reach an issuer that doesn't resolve. off skips it, warn logs a warning, strict fails the refresh until it resolves. It's skipped with -trust-forwarded-headers, where the served issuer comes from each request")
+	fs.BoolVar(&o.checkJWKSURI, "check-jwks-uri", false, "Exit at startup if the published jwks_uri isn't a path, and host if routed by one, that the key set is actually served at, catching a path prefix or host that doesn't match the issuer. Clusters in -path-map-file are skipped")
+	fs.BoolVar(&o.serveIssuerPath, "serve-issuer-path", false, "Serve the discovery endpoints under the issuer's path component (e.g. /clusters/foo/.well-known/openid-configuration), rather than the root")
+
+	fs.BoolVar(&o.validateMode, "validate", false, "Check the discovery document that would be published against the OpenID Connect Discovery requirements, then exit without publishing")
+	fs.BoolVar(&o.inspectMode, "inspect", false, "Print a table of the keys that would be published, then exit without publishing")
+	fs.StringVar(&o.inspectPath, "inspect-file", "", "JWKS file to -inspect instead of discovering the key set, e.g. a published jwks.json")
+	fs.BoolVar(&o.verifyMode, "verify-published", false, "Publish the documents, then fetch them back from the issuer's public URLs as a relying party would, checking each is served over HTTPS with a valid certificate and matches what was published. Exits non-zero if any check fails")
+	fs.BoolVar(&o.selftestMode, "selftest", false, "Check that a service account token verifies against the key set that would be published, then exit without publishing")
+	fs.StringVar(&o.selftestTokenFile, "selftest-token-file", serviceAccountTokenFile, "File containing the service account token for -selftest. Defaults to the pod's projected token")
+
+	fs.StringVar(&o.publishDir, "publish-dir", "", "Directory to write the discovery documents to, laid out as they are served under the issuer's path, for use as the root of a static site")
+	fs.StringVar(&o.cacheDir, "cache-dir", "", "Directory to cache the discovery documents in, to be read back and served if the first discovery at startup fails, so the publisher starts degraded rather than exiting. Nothing is published from it. With -clusters-file each cluster is cached in a subdirectory named after it")
+	fs.StringVar(&o.publishConfigMap, "publish-configmap", "", "ConfigMap to write the discovery documents to, in namespace/name form")
+	fs.StringVar(&o.publishGit, "publish-git", "", "URL of a git repository to commit and push the discovery documents to when they change")
+	fs.StringVar(&o.gitBranch, "publish-git-branch", "main", "Branch to push to for -publish-git. It must already exist")
+	fs.StringVar(&o.gitDir, "publish-git-dir", "", "Directory in the -publish-git repository to lay the documents out under, as they are served under the issuer's path")
+	fs.StringVar(&o.gitTokenFile, "publish-git-token-file", "", "File containing a token to authenticate to the -publish-git repository over HTTPS with")
+	fs.StringVar(&o.gitUsername, "publish-git-username", "x-access-token", "Username to send with the -publish-git-token-file token")
+	fs.StringVar(&o.putMetadataURL, "publish-put-metadata-url", "", "URL to PUT the discovery document to when it changes, with -publish-put-jwks-url")
+	fs.StringVar(&o.putJWKSURL, "publish-put-jwks-url", "", "URL to PUT the key set to when it changes, with -publish-put-metadata-url. It's PUT before the discovery document")
+	fs.StringVar(&o.putHeadersFile, "publish-put-headers-file", "", "File of headers to send with each -publish-put request, one per line in Name: value form, e.g. for an Authorization header. Their values are never logged")
+	fs.IntVar(&o.putAttempts, "publish-put-attempts", 3, "Attempts at each -publish-put request per refresh. Network errors, 5xx and 429 responses are retried, other non-2xx responses fail the refresh")
+	fs.DurationVar(&o.putBackoff, "publish-put-backoff", time.Second, "Delay before retrying a -publish-put request, doubling with each retry up to 30s, with jitter")
+	fs.BoolVar(&o.putDryRun, "publish-put-dry-run", false, "Log the -publish-put requests that would be made, rather than making them")
+	fs.DurationVar(&o.publishResync, "publish-resync-interval", 0, "Publish to every sink at least this often, even if the documents haven't changed, to heal published copies that were deleted or modified by something else. It's checked on each refresh, or each change check with -refresh-mode=watch, so takes effect at -refresh-interval or -watch-interval granularity. 0 only publishes changes")
+	fs.DurationVar(&o.deleteStale, "delete-stale-after", 0, "Delete the documents from -publish-dir, -publish-configmap, -publish-git and -publish-put once discovery has been failing for this long, so relying parties fail loudly rather than trusting keys that may have been rotated out. They're published again once discovery succeeds. This takes the issuer offline, so it's off by default. 0 never deletes them")
+	fs.IntVar(&o.exitAfterFails, "exit-after-publish-failures", 0, "Exit non-zero after this many refreshes in a row in which every -publish-* sink failed, so an orchestrator restarts us or a CronJob run fails. 0 keeps retrying forever. It needs -listen to be empty, as a sink serving over HTTP doesn't fail")
+	fs.BoolVar(&o.publishOnlyValid, "publish-only-valid", false, "Only write documents to -publish-dir, -publish-configmap, -publish-git and -publish-put if they pass validation, with a signing key, keeping the previous ones otherwise. This stops a broken upstream document propagating to everything reading from them")
+	fs.BoolVar(&o.leaderElect, "leader-elect", false, "Only write to -publish-dir, -publish-configmap, -publish-git and -publish-put while holding a lease, so replicas sharing a destination don't all write to it. Every replica still serves over HTTP")
+	fs.StringVar(&o.leaseNamespace, "leader-election-namespace", "", "Namespace of the -leader-elect lease. Defaults to the namespace we run in")
+	fs.StringVar(&o.leaseName, "leader-election-name", "k8soidcpublisher", "Name of the -leader-elect lease")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Minimum level of logs to write: debug, info, warn or error. debug also logs the full discovery document and the key IDs whenever the published documents change, as a record of what was served")
+	fs.StringVar(&o.logDest, "log-file", "stderr", "Where to write logs: stderr, stdout, or the path of a file to append to. A file is reopened on SIGHUP for logrotate, and written in the background so a slow disk doesn't hold up requests")
+	fs.StringVar(&o.eventsObject, "events-object", "", "Object to record Kubernetes Events against when the published keys change and when refreshes have been failing for -events-failing-after, in Kind/name form, e.g. Deployment/k8soidcpublisher, so they show up in kubectl get events. Events are rate limited. Empty records none")
+	fs.StringVar(&o.eventsNamespace, "events-namespace", "", "Namespace of the -events-object, which the events are recorded in. Defaults to the namespace we run in")
+	fs.DurationVar(&o.eventsFailing, "events-failing-after", 15*time.Minute, "How long refreshes have to have been failing before a DiscoveryFailing event is recorded, see -events-object. A DiscoveryRecovered event follows once one succeeds")
+	fs.StringVar(&o.leaseIdentity, "leader-election-id", "", "Identity to hold the -leader-elect lease as, unique to each replica. Defaults to the host name, which is the pod name in-cluster")
+}
+
+// needsAPIServer reports whether we reach an API server: to discover from,
+// unless republishing -source-url, and for the ConfigMap sink, the leader
+// lease and recording events whatever the source. Everything deciding whether
+// to build an API server client, or whether its flags apply, must ask this.
+func (o *options) needsAPIServer() bool {
+	return o.sourceURL == "" || o.publishConfigMap != "" || o.leaderElect || o.eventsObject != ""
+}
+
+// publishes reports whether the documents are written to a shared
+// destination, rather than only served.
+func (o *options) publishes() bool {
+	return o.publishDir != "" || o.publishConfigMap != "" || o.publishGit != "" || o.putMetadataURL != ""
+}
+
+// validate checks the flags make sense together, and are each in range. Flags
+// naming files, documents or lists are checked as they're loaded or parsed.
+func (o *options) validate() error {
+	if o.inspectPath != "" && !o.inspectMode {
+		return errors.New("-inspect-file requires -inspect")
+	}
+	if o.serveDir != "" && o.listen == "" {
+		return errors.New("-serve-dir serves over HTTP, set -listen")
+	}
+
+	if o.staleMode != staleModeFailClosed && o.staleMode != staleModeFailOpen {
+		return fmt.Errorf("-stale-mode must be %s or %s, got %q", staleModeFailClosed, staleModeFailOpen, o.staleMode)
+	}
+	if !strings.HasPrefix(o.discoveryPath, "/") {
+		return fmt.Errorf("-discovery-path must start with /, got %q", o.discoveryPath)
+	}
+	if o.refreshMode != refreshModePoll && o.refreshMode != refreshModeWatch {
+		return fmt.Errorf("-refresh-mode must be %s or %s, got %q", refreshModePoll, refreshModeWatch, o.refreshMode)
+	}
+	if strings.TrimSpace(o.discoveryAcc) == "" {
+		return errors.New("-discovery-accept must not be empty")
+	}
+	if o.discoveryConc < 0 {
+		return fmt.Errorf("-discovery-concurrency must not be negative, got %d", o.discoveryConc)
+	}
+	if o.staleClockSkew < 0 {
+		return fmt.Errorf("-stale-clock-skew must not be negative, got %s", o.staleClockSkew)
+	}
+	switch o.duplicateKIDs {
+	case duplicateKIDsAllow, duplicateKIDsFirst, duplicateKIDsReject:
+	default:
+		return fmt.Errorf("-duplicate-kids must be %s, %s or %s, got %q", duplicateKIDsAllow, duplicateKIDsFirst, duplicateKIDsReject, o.duplicateKIDs)
+	}
+	if o.shutdownDelay < 0 {
+		return fmt.Errorf("-shutdown-delay must not be negative, got %s", o.shutdownDelay)
+	}
+	if o.maintRetryAfter < 0 {
+		return fmt.Errorf("-maintenance-retry-after must not be negative, got %s", o.maintRetryAfter)
+	}
+	if (o.rateLimit != 0 || o.rateLimitBurst != 0) && o.listen == "" {
+		return errors.New("-rate-limit only applies to serving over HTTP, set -listen")
+	}
+	if o.errorHistory < 0 {
+		return fmt.Errorf("-error-history must not be negative, got %d", o.errorHistory)
+	}
+	if o.combinedPath != "" && (o.listen == "" || !strings.HasPrefix(o.combinedPath, "/")) {
+		return fmt.Errorf("-combined-jwks-path must be a path starting with /, and requires -listen, got %q", o.combinedPath)
+	}
+	if o.initStatus < 400 || o.initStatus > 599 {
+		return fmt.Errorf("-initializing-status must be a 4xx or 5xx status, got %d", o.initStatus)
+	}
+	if o.spiffeBundle && o.listen == "" {
+		return errors.New("-spiffe-bundle only applies to serving over HTTP, set -listen")
+	}
+	if o.spiffeRefresh < 0 {
+		return fmt.Errorf("-spiffe-refresh-hint must not be negative, got %s", o.spiffeRefresh)
+	}
+	if o.spiffeRefresh != 0 && !o.spiffeBundle {
+		return errors.New("-spiffe-refresh-hint only applies to -spiffe-bundle")
+	}
+	if o.jwksVersions < 0 {
+		return fmt.Errorf("-jwks-versions must not be negative, got %d", o.jwksVersions)
+	}
+	if o.pushURL != "" && o.pushInterval <= 0 {
+		return fmt.Errorf("-metrics-push-interval must be positive, got %s", o.pushInterval)
+	}
+	if o.flushTimeout <= 0 {
+		return fmt.Errorf("-shutdown-flush-timeout must be positive, got %s", o.flushTimeout)
+	}
+	if o.kubeQPS > 0 && o.kubeBurst < 1 {
+		return fmt.Errorf("-kube-burst must be at least 1 with a positive -kube-qps, got %d", o.kubeBurst)
+	}
+	if o.maxRetainedKeys < 0 {
+		return fmt.Errorf("-max-retained-keys must not be negative, got %d", o.maxRetainedKeys)
+	}
+	if o.staleRevalidate < 0 {
+		return fmt.Errorf("-cache-stale-while-revalidate must not be negative, got %s", o.staleRevalidate)
+	}
+	if o.oldIssuerURL != "" {
+		if o.clustersPath != "" {
+			return errors.New("-old-issuer can't be combined with -clusters-file")
+		}
+		if o.sunsetAt != "" {
+			return errors.New("-old-issuer can't be combined with -sunset, -old-issuer-until is its sunset")
+		}
+	} else if o.oldIssuerUntil != "" {
+		return errors.New("-old-issuer-until requires -old-issuer")
+	}
+
+	var adminAddr string
+	switch {
+	case o.adminOnListen:
+		if o.listen == "" {
+			return errors.New("-admin-on-listen requires -listen")
+		}
+		if o.set["admin-listen"] {
+			return errors.New("-admin-on-listen and -admin-listen can't be used together")
+		}
+	case o.listen == "":
+		// nothing is served over HTTP, so there's nothing to move.
+		if o.set["admin-listen"] {
+			return errors.New("-admin-listen requires -listen")
+		}
+	default:
+		addr, _, err := adminListenAddr(o.adminListen)
+		if err != nil {
+			return fmt.Errorf("Invalid -admin-listen: %v", err)
+		}
+		adminAddr = addr
+	}
+
+	if (o.tlsCertFile == "") != (o.tlsKeyFile == "") {
+		return errors.New("-tls-cert-file and -tls-key-file must be set together")
+	}
+	if o.tlsClientCA != "" && o.tlsCertFile == "" {
+		return errors.New("-tls-client-ca-file requires -tls-cert-file")
+	}
+	if o.tlsCertFile != "" && o.listen == "" {
+		return errors.New("-tls-cert-file only applies to serving over HTTP, set -listen")
+	}
+
+	if o.sshBastionAt != "" {
+		if !o.needsAPIServer() {
+			return errors.New("-ssh-bastion only applies to reaching API servers, which -source-url only does for -publish-configmap, -leader-elect or -events-object")
+		}
+		if o.sshUser == "" || o.sshKeyFile == "" {
+			return errors.New("-ssh-bastion requires -ssh-user and -ssh-key-file")
+		}
+	}
+
+	if o.grpcListen != "" {
+		if o.listen == "" {
+			return errors.New("-grpc-listen serves the documents served over HTTP, set -listen")
+		}
+		if o.grpcListen == o.listen || o.grpcListen == adminAddr {
+			return errors.New("-grpc-listen must be a different address to -listen and -admin-listen")
+		}
+	}
+
+	if o.corrHeader != "" && o.corrPer != correlationPerRefresh && o.corrPer != correlationPerRun {
+		return fmt.Errorf("-correlation-id-per must be %s or %s, got %q", correlationPerRefresh, correlationPerRun, o.corrPer)
+	}
+
+	if o.sourceURL != "" {
+		if o.clustersPath != "" {
+			return errors.New("-source-url can't be combined with -clusters-file")
+		}
+		if u, err := url.Parse(o.sourceURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("-source-url must be an http or https URL, got %q", o.sourceURL)
+		}
+		if o.jwksAttempts < 1 {
+			return fmt.Errorf("-external-jwks-attempts must be at least 1, got %d", o.jwksAttempts)
+		}
+		if o.jwksBackoff <= 0 || o.jwksMaxBack < o.jwksBackoff {
+			return fmt.Errorf("-external-jwks-backoff must be positive and no more than -external-jwks-max-backoff, got %s and %s", o.jwksBackoff, o.jwksMaxBack)
+		}
+	}
+
+	if (o.clientCert == "") != (o.clientKey == "") {
+		return errors.New("-client-certificate and -client-key must be set together")
+	}
+	if o.insecureTLS && o.caFile != "" {
+		return errors.New("-insecure-skip-tls-verify can't be combined with -certificate-authority")
+	}
+	switch o.apiProtocol {
+	case apiServerProtocolDefault, apiServerProtocolHTTP1, apiServerProtocolHTTP2:
+	default:
+		return fmt.Errorf("-api-server-protocol must be %s or %s, got %q", apiServerProtocolHTTP1, apiServerProtocolHTTP2, o.apiProtocol)
+	}
+	if o.h2PingEvery < 0 || o.h2PingTimeout < 0 || o.h2ConnWindow < 0 || o.h2StrmWindow < 0 {
+		return errors.New("-api-server-http2-* settings must not be negative")
+	}
+	if o.reresolveAPI < 0 {
+		return fmt.Errorf("-api-server-reresolve-interval must not be negative, got %s", o.reresolveAPI)
+	}
+
+	if o.cacheDir != "" && o.listen == "" {
+		return errors.New("-cache-dir seeds the documents served by -listen, set it too")
+	}
+
+	if o.clustersPath != "" {
+		if o.kubeconfig != "" || o.kubeContext != "" {
+			return errors.New("-clusters-file can't be combined with -kubeconfig or -context")
+		}
+		if o.listen == "" || o.publishes() || o.putJWKSURL != "" {
+			return errors.New("-clusters-file only supports serving over HTTP, set -listen and not -publish-dir, -publish-configmap, -publish-git or -publish-put")
+		}
+	} else if o.kubeContext != "" && o.kubeconfig == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		// whether the context exists is only known once the files are
+		// merged, see kubeconfigConfig.
+		return errors.New("-context requires -kubeconfig or KUBECONFIG")
+	}
+	if o.pathMapPath != "" {
+		if o.listen == "" {
+			return errors.New("-path-map-file requires -listen")
+		}
+		// the mapping is by issuer, which may not be known yet.
+		if o.noFatalWarmup {
+			return errors.New("-path-map-file can't be combined with -no-fatal-warmup")
+		}
+	}
+	if o.checkJWKSURI {
+		if o.listen == "" {
+			return errors.New("-check-jwks-uri checks the routes served over HTTP, set -listen")
+		}
+		// the jwks_uri comes from the issuer, which may not be known yet.
+		if o.noFatalWarmup {
+			return errors.New("-check-jwks-uri can't be combined with -no-fatal-warmup")
+		}
+	}
+	if o.errorBodyFile != "" && o.listen == "" {
+		return errors.New("-error-body-file only applies to serving over HTTP, set -listen")
+	}
+
+	switch o.issuerDNSMode {
+	case issuerDNSOff, issuerDNSWarn, issuerDNSStrict:
+	default:
+		return fmt.Errorf("-issuer-dns-check must be %s, %s or %s, got %q", issuerDNSOff, issuerDNSWarn, issuerDNSStrict, o.issuerDNSMode)
+	}
+	if o.suspectDocs != suspectReject && o.suspectDocs != suspectAccept {
+		return fmt.Errorf("-suspect-documents must be %s or %s, got %q", suspectReject, suspectAccept, o.suspectDocs)
+	}
+	if o.publishResync < 0 {
+		return fmt.Errorf("-publish-resync-interval must not be negative, got %s", o.publishResync)
+	}
+	if o.deleteStale < 0 {
+		return fmt.Errorf("-delete-stale-after must not be negative, got %s", o.deleteStale)
+	}
+	if o.deleteStale > 0 {
+		if !o.publishes() {
+			return errors.New("-delete-stale-after only applies to -publish-dir, -publish-configmap, -publish-git and -publish-put, set at least one")
+		}
+		if o.deleteStale <= o.refreshInterval {
+			return fmt.Errorf("-delete-stale-after must be longer than -refresh-interval, or a single failed refresh deletes the documents, got %s", o.deleteStale)
+		}
+	}
+	if o.exitAfterFails < 0 {
+		return fmt.Errorf("-exit-after-publish-failures must not be negative, got %d", o.exitAfterFails)
+	}
+	if o.exitAfterFails > 0 && o.listen != "" {
+		return errors.New("-exit-after-publish-failures only applies when publishing without serving, set -listen to empty")
+	}
+
+	if o.leaderElect && !o.publishes() {
+		return errors.New("-leader-elect only applies to -publish-dir, -publish-configmap, -publish-git and -publish-put, set at least one")
+	}
+	if o.eventsObject != "" {
+		if o.clustersPath != "" {
+			return errors.New("-events-object can't be combined with -clusters-file, as there's no one cluster to record events in")
+		}
+		if o.eventsFailing <= 0 {
+			return fmt.Errorf("-events-failing-after must be positive, got %s", o.eventsFailing)
+		}
+	} else if o.eventsNamespace != "" {
+		return errors.New("-events-namespace only applies to -events-object")
+	}
+
+	if o.publishConfigMap != "" {
+		if ns, name, ok := strings.Cut(o.publishConfigMap, "/"); !ok || ns == "" || name == "" {
+			return fmt.Errorf("-publish-configmap must be in namespace/name form, got %q", o.publishConfigMap)
+		}
+	}
+	if o.putMetadataURL != "" || o.putJWKSURL != "" {
+		if o.putMetadataURL == "" || o.putJWKSURL == "" {
+			return errors.New("-publish-put-metadata-url and -publish-put-jwks-url must be set together")
+		}
+		for _, f := range []struct{ name, url string }{{"-publish-put-metadata-url", o.putMetadataURL}, {"-publish-put-jwks-url", o.putJWKSURL}} {
+			if u, err := url.Parse(f.url); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("%s must be an http or https URL, got %q", f.name, f.url)
+			}
+		}
+		if o.putAttempts < 1 {
+			return fmt.Errorf("-publish-put-attempts must be at least 1, got %d", o.putAttempts)
+		}
+		if o.putBackoff <= 0 {
+			return fmt.Errorf("-publish-put-backoff must be positive, got %s", o.putBackoff)
+		}
+	}
+	if o.putHeadersFile != "" && o.putMetadataURL == "" {
+		return errors.New("-publish-put-headers-file only applies to -publish-put-metadata-url and -publish-put-jwks-url")
+	}
+	if (o.debugEndpoints || o.adminEndpoints) && o.adminTokenFile == "" {
+		return errors.New("-enable-debug-endpoints and -enable-admin-endpoints require -admin-token-file")
+	}
+	if o.refreshTimeout <= 0 {
+		return fmt.Errorf("-admin-refresh-timeout must be positive, got %s", o.refreshTimeout)
+	}
+	return nil
+}
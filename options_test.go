@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOptions parses args as the command line would be.
+func testOptions(args ...string) (*options, error) {
+	fs := flag.NewFlagSet("k8soidcpublisher", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseOptions(fs, args)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	const source = "-source-url=https://issuer.example.com"
+	for _, tc := range []struct {
+		name string
+		args []string
+		// kubeconfigEnv is KUBECONFIG.
+		kubeconfigEnv string
+		// wantErr is part of the error, if the flags are invalid.
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "republishing an issuer", args: []string{source}},
+		{name: "publishing without serving", args: []string{"-listen=", "-publish-dir=/srv", "-exit-after-publish-failures=3"}},
+
+		// the API server is only needed for some flags with -source-url.
+		{name: "bastion to the API server", args: []string{"-ssh-bastion=bastion.example.com", "-ssh-user=core", "-ssh-key-file=/key"}},
+		{name: "bastion with -source-url", args: []string{source, "-ssh-bastion=bastion.example.com", "-ssh-user=core", "-ssh-key-file=/key"}, wantErr: "-ssh-bastion only applies to reaching API servers"},
+		{name: "bastion with -source-url and a ConfigMap", args: []string{source, "-publish-configmap=default/oidc", "-ssh-bastion=bastion.example.com", "-ssh-user=core", "-ssh-key-file=/key"}},
+		{name: "bastion with -source-url and leader election", args: []string{source, "-publish-dir=/srv", "-leader-elect", "-ssh-bastion=bastion.example.com", "-ssh-user=core", "-ssh-key-file=/key"}},
+		{name: "bastion with -source-url and events", args: []string{source, "-events-object=Deployment/k8soidcpublisher", "-ssh-bastion=bastion.example.com", "-ssh-user=core", "-ssh-key-file=/key"}},
+		{name: "bastion without a user", args: []string{"-ssh-bastion=bastion.example.com", "-ssh-key-file=/key"}, wantErr: "requires -ssh-user and -ssh-key-file"},
+
+		// whether -admin-listen was given is told apart from its default.
+		{name: "admin on -listen", args: []string{"-admin-on-listen"}},
+		{name: "admin on -listen and its own listener", args: []string{"-admin-on-listen", "-admin-listen=127.0.0.1:9090"}, wantErr: "can't be used together"},
+		{name: "admin listener without -listen", args: []string{"-listen=", "-publish-dir=/srv", "-admin-listen=127.0.0.1:9091"}, wantErr: "-admin-listen requires -listen"},
+		{name: "default admin listener without -listen", args: []string{"-listen=", "-publish-dir=/srv"}},
+		{name: "invalid admin listener", args: []string{"-admin-listen=127.0.0.1:9090:1"}, wantErr: "Invalid -admin-listen"},
+		{name: "gRPC on the admin listener", args: []string{"-grpc-listen=127.0.0.1:9090"}, wantErr: "-grpc-listen must be a different address"},
+		{name: "gRPC on its own listener", args: []string{"-grpc-listen=127.0.0.1:9000"}},
+
+		// serving flags need -listen.
+		{name: "rate limit without -listen", args: []string{"-listen=", "-publish-dir=/srv", "-rate-limit=10"}, wantErr: "-rate-limit only applies to serving over HTTP"},
+		{name: "serving a directory without -listen", args: []string{"-listen=", "-serve-dir=/srv"}, wantErr: "-serve-dir serves over HTTP"},
+		{name: "TLS without -listen", args: []string{"-listen=", "-publish-dir=/srv", "-tls-cert-file=/crt", "-tls-key-file=/key"}, wantErr: "-tls-cert-file only applies to serving over HTTP"},
+		{name: "TLS certificate without its key", args: []string{"-tls-cert-file=/crt"}, wantErr: "must be set together"},
+		{name: "checking the jwks_uri without -listen", args: []string{"-listen=", "-publish-dir=/srv", "-check-jwks-uri"}, wantErr: "-check-jwks-uri checks the routes served over HTTP"},
+		{name: "checking the jwks_uri before it's known", args: []string{"-check-jwks-uri", "-no-fatal-warmup"}, wantErr: "can't be combined with -no-fatal-warmup"},
+		{name: "cache without -listen", args: []string{"-listen=", "-publish-dir=/srv", "-cache-dir=/cache"}, wantErr: "-cache-dir seeds the documents served by -listen"},
+
+		// the shared destinations.
+		{name: "deleting without publishing", args: []string{"-delete-stale-after=1h"}, wantErr: "-delete-stale-after only applies to"},
+		{name: "deleting after a single refresh", args: []string{"-publish-dir=/srv", "-delete-stale-after=30s", "-refresh-interval=1m"}, wantErr: "must be longer than -refresh-interval"},
+		{name: "deleting", args: []string{"-publish-dir=/srv", "-delete-stale-after=1h"}},
+		{name: "leader election without publishing", args: []string{"-leader-elect"}, wantErr: "-leader-elect only applies to"},
+		{name: "ConfigMap without a namespace", args: []string{"-publish-configmap=oidc"}, wantErr: "namespace/name form"},
+		{name: "metadata PUT without the key set", args: []string{"-publish-put-metadata-url=https://bucket.example.com/md"}, wantErr: "must be set together"},
+		{name: "PUT to a relative URL", args: []string{"-publish-put-metadata-url=https://bucket.example.com/md", "-publish-put-jwks-url=/jwks"}, wantErr: "-publish-put-jwks-url must be an http or https URL"},
+		{name: "exiting on failures while serving", args: []string{"-publish-dir=/srv", "-exit-after-publish-failures=3"}, wantErr: "only applies when publishing without serving"},
+
+		// -clusters-file replaces the single cluster's flags.
+		{name: "clusters with -kubeconfig", args: []string{"-clusters-file=/clusters.yaml", "-kubeconfig=/kubeconfig"}, wantErr: "can't be combined with -kubeconfig"},
+		{name: "clusters with -source-url", args: []string{"-clusters-file=/clusters.yaml", source}, wantErr: "-source-url can't be combined with -clusters-file"},
+		{name: "clusters with events", args: []string{"-clusters-file=/clusters.yaml", "-events-object=Deployment/k8soidcpublisher"}, wantErr: "no one cluster to record events in"},
+		{name: "context without a kubeconfig", args: []string{"-context=prod"}, wantErr: "-context requires -kubeconfig or KUBECONFIG"},
+		{name: "context from KUBECONFIG", args: []string{"-context=prod"}, kubeconfigEnv: "/a:/b"},
+		{name: "context from -kubeconfig", args: []string{"-kubeconfig=/a:/b", "-context=prod"}},
+
+		// values out of range.
+		{name: "unknown stale mode", args: []string{"-stale-mode=maybe"}, wantErr: "-stale-mode must be"},
+		{name: "relative discovery path", args: []string{"-discovery-path=openid"}, wantErr: "-discovery-path must start with /"},
+		{name: "initializing as a success", args: []string{"-initializing-status=200"}, wantErr: "4xx or 5xx"},
+		{name: "negative shutdown delay", args: []string{"-shutdown-delay=-1s"}, wantErr: "-shutdown-delay must not be negative"},
+		{name: "source over another scheme", args: []string{"-source-url=ftp://issuer.example.com"}, wantErr: "-source-url must be an http or https URL"},
+		{name: "external JWKS backoff over its cap", args: []string{source, "-external-jwks-backoff=1m", "-external-jwks-max-backoff=1s"}, wantErr: "no more than -external-jwks-max-backoff"},
+		{name: "unknown issuer DNS check", args: []string{"-issuer-dns-check=maybe"}, wantErr: "-issuer-dns-check must be"},
+		{name: "events namespace without events", args: []string{"-events-namespace=default"}, wantErr: "-events-namespace only applies to -events-object"},
+		{name: "debug endpoints without a token", args: []string{"-enable-debug-endpoints"}, wantErr: "require -admin-token-file"},
+		{name: "unbounded admin refresh", args: []string{"-admin-refresh-timeout=0"}, wantErr: "-admin-refresh-timeout must be positive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", tc.kubeconfigEnv)
+			_, err := testOptions(tc.args...)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("error = %v, want none", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestOptionsNeedsAPIServer(t *testing.T) {
+	const source = "-source-url=https://issuer.example.com"
+	for _, tc := range []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{name: "discovering from the API server", want: true},
+		{name: "republishing an issuer", args: []string{source}},
+		{name: "republishing to a directory", args: []string{source, "-publish-dir=/srv"}},
+		{name: "republishing to a ConfigMap", args: []string{source, "-publish-configmap=default/oidc"}, want: true},
+		{name: "republishing with leader election", args: []string{source, "-publish-dir=/srv", "-leader-elect"}, want: true},
+		{name: "republishing with events", args: []string{source, "-events-object=Deployment/k8soidcpublisher"}, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o, err := testOptions(tc.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := o.needsAPIServer(); got != tc.want {
+				t.Errorf("needsAPIServer = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	o, err := testOptions("-refresh-interval=30s", "-admin-listen=127.0.0.1:9090", "-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.refreshInterval != 30*time.Second || !o.gzipDocuments || o.listen != "localhost:8080" {
+		t.Errorf("parsed -refresh-interval %s, -gzip %t and -listen %q, want 30s, true and the default", o.refreshInterval, o.gzipDocuments, o.listen)
+	}
+	// given at its default value, it still counts as set.
+	if !o.set["admin-listen"] || o.set["listen"] {
+		t.Errorf("set = %v, want only the flags given", o.set)
+	}
+
+	if _, err := testOptions("-no-such-flag"); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// pathMapFile is the -path-map-file format, mapping each issuer to exactly
+// where its documents are served, for when the public issuer URL and the
+// serving URL diverge, e.g. behind a path rewriting proxy.
+type pathMapFile struct {
+	Issuers []issuerPaths `json:"issuers"`
+}
+
+// issuerPaths are where an issuer's documents are served.
+type issuerPaths struct {
+	// Issuer is the issuer URL, exactly as published.
+	Issuer string `json:"issuer"`
+	// MetadataPath is the path the discovery document is served at.
+	MetadataPath string `json:"metadataPath"`
+	// JWKSPath is the path the key set is served at.
+	JWKSPath string `json:"jwksPath"`
+}
+
+// reservedPaths are served by the process itself, so can't be mapped to.
+var reservedPaths = []string{"/healthz", "/readyz", "/metrics", "/routes"}
+
+// loadPathMap reads and validates the path map at path, keyed by issuer
+// without any trailing slash.
+func loadPathMap(path string) (map[string]issuerPaths, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f pathMapFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(f.Issuers) == 0 {
+		return nil, fmt.Errorf("%s has no issuers", path)
+	}
+
+	m := map[string]issuerPaths{}
+	// served maps each path to the issuer served there.
+	served := map[string]string{}
+	for i, ip := range f.Issuers {
+		if u, err := url.Parse(ip.Issuer); err != nil || !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("issuer %d: %q is not an absolute URL", i, ip.Issuer)
+		}
+		key := strings.TrimSuffix(ip.Issuer, "/")
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("duplicate issuer %q", ip.Issuer)
+		}
+		for _, p := range []string{ip.MetadataPath, ip.JWKSPath} {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("issuer %s: path %q must start with /", ip.Issuer, p)
+			}
+			// the paths become mux patterns, which treat these specially.
+			if strings.ContainsAny(p, "{} ") || strings.HasSuffix(p, "/") {
+				return nil, fmt.Errorf("issuer %s: path %q must not contain braces or spaces, or end with /", ip.Issuer, p)
+			}
+			if slices.Contains(reservedPaths, p) || strings.HasPrefix(p, "/debug/") {
+				return nil, fmt.Errorf("issuer %s: path %q is reserved", ip.Issuer, p)
+			}
+			if other, ok := served[p]; ok && other != ip.Issuer {
+				return nil, fmt.Errorf("issuer %s: path %q is already served for %s", ip.Issuer, p, other)
+			}
+		}
+		if ip.MetadataPath == ip.JWKSPath {
+			return nil, fmt.Errorf("issuer %s: the metadata and key set are both served at %q", ip.Issuer, ip.MetadataPath)
+		}
+		served[ip.MetadataPath], served[ip.JWKSPath] = ip.Issuer, ip.Issuer
+		m[key] = ip
+	}
+	return m, nil
+}
+
+// mapIssuerPaths serves the clusters whose issuers are in pathMap at their
+// mapped paths. Each issuer in it must be published by a cluster, as one that
+// isn't is most likely a typo, leaving the cluster served at its issuer's own
+// paths.
+func mapIssuerPaths(clusters []*cluster, pathMap map[string]issuerPaths) error {
+	mapped := map[string]bool{}
+	for _, c := range clusters {
+		issuer := strings.TrimSuffix(c.sink.issuer(), "/")
+		if ip, ok := pathMap[issuer]; ok {
+			c.mappedPaths = &ip
+			mapped[issuer] = true
+		}
+	}
+	var unknown []string
+	for issuer, ip := range pathMap {
+		if !mapped[issuer] {
+			unknown = append(unknown, ip.Issuer)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("issuers in the path map aren't published by any cluster: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPathMap(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		// wantIssuers are the keys of the map loaded.
+		wantIssuers []string
+		// wantErr is part of the error, if the file is refused.
+		wantErr string
+	}{
+		{
+			name: "issuers",
+			file: `issuers:
+- issuer: https://example.com/clusters/a/
+  metadataPath: /a/openid-configuration
+  jwksPath: /a/keys
+- issuer: https://example.com/clusters/b
+  metadataPath: /b/openid-configuration
+  jwksPath: /b/keys
+`,
+			wantIssuers: []string{"https://example.com/clusters/a", "https://example.com/clusters/b"},
+		},
+		{name: "no issuers", file: "issuers: []\n", wantErr: "has no issuers"},
+		{name: "unknown field", file: "issuers:\n- issuer: https://example.com\n  metadata: /openid-configuration\n", wantErr: "parsing"},
+		{name: "relative issuer", file: "issuers:\n- issuer: example.com\n  metadataPath: /md\n  jwksPath: /keys\n", wantErr: `issuer 0: "example.com" is not an absolute URL`},
+		{
+			name: "duplicate issuer",
+			file: `issuers:
+- issuer: https://example.com/a
+  metadataPath: /a/md
+  jwksPath: /a/keys
+- issuer: https://example.com/a/
+  metadataPath: /b/md
+  jwksPath: /b/keys
+`,
+			wantErr: `duplicate issuer "https://example.com/a/"`,
+		},
+		{name: "relative path", file: "issuers:\n- issuer: https://example.com\n  metadataPath: md\n  jwksPath: /keys\n", wantErr: `path "md" must start with /`},
+		{name: "missing path", file: "issuers:\n- issuer: https://example.com\n  metadataPath: /md\n", wantErr: `path "" must start with /`},
+		{name: "pattern in a path", file: "issuers:\n- issuer: https://example.com\n  metadataPath: /{cluster}/md\n  jwksPath: /keys\n", wantErr: "must not contain braces"},
+		{name: "trailing slash", file: "issuers:\n- issuer: https://example.com\n  metadataPath: /md/\n  jwksPath: /keys\n", wantErr: "or end with /"},
+		{name: "reserved path", file: "issuers:\n- issuer: https://example.com\n  metadataPath: /healthz\n  jwksPath: /keys\n", wantErr: `path "/healthz" is reserved`},
+		{name: "debug path", file: "issuers:\n- issuer: https://example.com\n  metadataPath: /debug/md\n  jwksPath: /keys\n", wantErr: `path "/debug/md" is reserved`},
+		{name: "metadata and key set colliding", file: "issuers:\n- issuer: https://example.com\n  metadataPath: /docs\n  jwksPath: /docs\n", wantErr: `the metadata and key set are both served at "/docs"`},
+		{
+			name: "path served for two issuers",
+			file: `issuers:
+- issuer: https://example.com/a
+  metadataPath: /a/md
+  jwksPath: /keys
+- issuer: https://example.com/b
+  metadataPath: /b/md
+  jwksPath: /keys
+`,
+			wantErr: `issuer https://example.com/b: path "/keys" is already served for https://example.com/a`,
+		},
+		{
+			name: "key set served at another's metadata",
+			file: `issuers:
+- issuer: https://example.com/a
+  metadataPath: /a/md
+  jwksPath: /a/keys
+- issuer: https://example.com/b
+  metadataPath: /b/md
+  jwksPath: /a/md
+`,
+			wantErr: `path "/a/md" is already served for https://example.com/a`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "paths.yaml")
+			if err := os.WriteFile(path, []byte(tc.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			m, err := loadPathMap(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m) != len(tc.wantIssuers) {
+				t.Errorf("loaded %d issuers, want %v", len(m), tc.wantIssuers)
+			}
+			for _, issuer := range tc.wantIssuers {
+				if _, ok := m[issuer]; !ok {
+					t.Errorf("issuer %s not loaded, got %v", issuer, m)
+				}
+			}
+		})
+	}
+
+	if _, err := loadPathMap(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestMapIssuerPaths(t *testing.T) {
+	a := issuerPaths{Issuer: "https://example.com/clusters/a/", MetadataPath: "/a/md", JWKSPath: "/a/keys"}
+	unknown := issuerPaths{Issuer: "https://example.com/clusters/typo", MetadataPath: "/typo/md", JWKSPath: "/typo/keys"}
+	for _, tc := range []struct {
+		name    string
+		pathMap map[string]issuerPaths
+		wantErr string
+	}{
+		{name: "no map"},
+		{name: "mapped", pathMap: map[string]issuerPaths{"https://example.com/clusters/a": a}},
+		{name: "issuer no cluster publishes", pathMap: map[string]issuerPaths{"https://example.com/clusters/a": a, "https://example.com/clusters/typo": unknown}, wantErr: "aren't published by any cluster: https://example.com/clusters/typo"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mapped := newTestCluster(t, "a", "https://example.com/clusters/a", testKey(t, "a"))
+			other := newTestCluster(t, "b", "https://example.com/clusters/b", testKey(t, "b"))
+			err := mapIssuerPaths([]*cluster{mapped, other}, tc.pathMap)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.pathMap != nil; (mapped.mappedPaths != nil) != want {
+				t.Errorf("cluster a mapped %v, want %t", mapped.mappedPaths, want)
+			}
+			if other.mappedPaths != nil {
+				t.Errorf("cluster b mapped to %v, want its issuer's paths", other.mappedPaths)
+			}
+		})
+	}
+}
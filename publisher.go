@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"lds.li/oauth2ext/oidc"
+)
+
+// Sink receives the published discovery documents whenever they change.
+type Sink interface {
+	Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error
+}
+
+type namedSink struct {
+	name string
+	Sink
+}
+
+// publisher discovers the upstream OIDC metadata and keys, rewrites them
+// for publishing, and pushes them to each sink when they change.
+type publisher struct {
+	// cluster names the cluster being published, for metrics.
+	cluster string
+	src     discoverySource
+	log     *slog.Logger
+	sinks   []namedSink
+	// sem bounds how many publishers refresh at once, shared between them.
+	// nil is unbounded.
+	sem chan struct{}
+	// confirmKeys fetches the key set from the last known URI when discovery
+	// fails, so its freshness can be judged separately from the metadata's.
+	confirmKeys bool
+	// sameOriginJWKS rejects discovery documents whose jwks_uri isn't on
+	// the issuer's origin.
+	sameOriginJWKS bool
+	// allowedKeyTypes are the key types published, others are dropped. nil
+	// allows everything.
+	allowedKeyTypes []string
+	// certThumbprints adds x5t#S256 to keys with certificates, see
+	// addCertThumbprints.
+	certThumbprints bool
+	// eksCompat rewrites the key set to match what EKS serves, see
+	// eksCompatKeySet.
+	eksCompat bool
+	// duplicateKIDs is how keys sharing a kid are handled, see
+	// checkDuplicateKIDs. Empty allows them.
+	duplicateKIDs string
+	// retainer keeps recently removed keys published, if set.
+	retainer *keyRetainer
+	// defaults fill in metadata fields the upstream omits.
+	defaults metadataDefaults
+	// errorHistory is how many recent discovery errors to keep, see
+	// recentErrors.
+	errorHistory int
+	// correlation tags each refresh's requests with an ID, if set.
+	correlation *correlationIDs
+	// acceptSuspect publishes documents that look degraded, see
+	// suspectReasons, with a warning. Otherwise they fail the refresh.
+	acceptSuspect bool
+	// keysServedSeparately publishes an empty key set rather than treating it
+	// as suspect, for -stale-independently to serve as unavailable.
+	keysServedSeparately bool
+	// issuerDNS checks the issuer's host resolves, if set.
+	issuerDNS *issuerDNSCheck
+	// exitAfterFailures is how many refreshes in a row every sink can fail
+	// before giveUp is called with errPublishFailing. 0 retries forever.
+	exitAfterFailures int
+	giveUp            context.CancelCauseFunc
+	// resyncInterval is how long after the last publish the next refresh
+	// publishes to every sink even if the documents are unchanged, healing
+	// anything that changed what they hold. 0 only publishes changes.
+	resyncInterval time.Duration
+	// deleteStaleAfter is how long discovery can fail before the documents
+	// are deleted from every sink that can, see deleteStale. 0 never
+	// deletes them.
+	deleteStaleAfter time.Duration
+	// staleDeleted is set once the stale documents have been deleted, until
+	// they're next published.
+	staleDeleted bool
+	// events records key rotations and long running discovery failures as
+	// Kubernetes Events, if set.
+	events *clusterEvents
+
+	// published is the content last pushed to all sinks successfully, used to
+	// skip updates when nothing has changed, and publishedAt when.
+	published   []byte
+	publishedAt time.Time
+	// publishedKIDs are the key IDs last published, for reporting rotations.
+	publishedKIDs []string
+
+	mu sync.Mutex
+	// lastDiscovery is when discovery last succeeded, or when the seeded
+	// documents were published.
+	lastDiscovery time.Time
+	// lastMetadata and lastKeys are when the published metadata and key set
+	// were last confirmed current, which may be more recent than
+	// lastDiscovery when only the other failed.
+	lastMetadata time.Time
+	lastKeys     time.Time
+	// upstream is the API server's discovery document as last fetched.
+	upstream []byte
+	// upstreamKeys is the encoded key set as last fetched, before filtering.
+	upstreamKeys []byte
+	// jwksURI is the upstream key set's URI, as last discovered. It's empty
+	// if the keys were inline in the discovery document.
+	jwksURI string
+	// problems are the validation problems with the published metadata.
+	problems []string
+	// injected are the metadata fields filled in from defaults, rather
+	// than provided by the upstream.
+	injected []string
+	// hash identifies the published documents, see contentHash, and keys
+	// is how many keys they hold.
+	hash string
+	keys int
+	// forcedStale is set when an operator expires the documents, until they
+	// are next published.
+	forcedStale bool
+	// failed is set when the last attempt at discovery failed.
+	failed bool
+	// seeded is set when the documents were seeded from a sink, until
+	// discovery succeeds.
+	seeded bool
+	// forcePublish makes the next refresh publish to every sink, even if
+	// the documents are unchanged.
+	forcePublish bool
+	// recentErrs are the most recent discovery errors, oldest first.
+	recentErrs []discoveryError
+	// next is when the next discovery attempt is scheduled.
+	next time.Time
+	// publishFailures is how many refreshes in a row every sink has failed.
+	publishFailures int
+	// failingSince is when discovery started failing, zero while it isn't,
+	// and failureRecorded is set once that's been recorded as an event.
+	failingSince    time.Time
+	failureRecorded bool
+
+	// refreshMu serializes refreshes, which may be triggered outside of the
+	// refresh loop.
+	refreshMu sync.Mutex
+}
+
+// discoveryState exposes the publisher's discovery status, for reporting.
+type discoveryState interface {
+	// lastSuccess returns when discovery last succeeded, or the zero time if
+	// it never has.
+	lastSuccess() time.Time
+	// lastConfirmed returns when the published metadata and key set were
+	// each last confirmed current, or the zero time if they never have.
+	lastConfirmed() (metadata, keys time.Time)
+	// lastUpstream returns the API server's discovery document as last
+	// fetched, before any rewriting.
+	lastUpstream() []byte
+	// validationProblems returns the problems validateDiscovery found with
+	// the last discovered metadata.
+	validationProblems() []string
+	// contentHash returns the hash of the documents as last published, or
+	// an empty string if nothing has been.
+	contentHash() string
+	// failing reports whether the last attempt at discovery failed.
+	failing() bool
+	// expired reports whether the documents were expired by an operator,
+	// and should be treated as stale regardless of when they were
+	// discovered.
+	expired() bool
+	// recentErrors returns the most recent discovery errors, newest first.
+	recentErrors() []discoveryError
+	// injectedFields returns the published metadata fields that were filled
+	// in from defaults rather than provided by the upstream.
+	injectedFields() []string
+	// nextRefresh returns when the next discovery attempt is scheduled, or
+	// the zero time if none is.
+	nextRefresh() time.Time
+}
+
+// discoveryError is a failed attempt at discovery, kept for diagnostics.
+type discoveryError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+func (p *publisher) lastSuccess() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastDiscovery
+}
+
+func (p *publisher) lastConfirmed() (metadata, keys time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastMetadata, p.lastKeys
+}
+
+func (p *publisher) lastUpstream() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.upstream
+}
+
+func (p *publisher) upstreamJWKSURI() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jwksURI
+}
+
+// markFresh records that the upstream documents were confirmed unchanged, so
+// what we published is as fresh as a successful discovery.
+func (p *publisher) markFresh() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.lastDiscovery, p.lastMetadata, p.lastKeys = now, now, now
+	p.failed = false
+}
+
+func (p *publisher) validationProblems() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.problems
+}
+
+func (p *publisher) nextRefresh() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next
+}
+
+// scheduleNext records that the next discovery attempt is in d.
+func (p *publisher) scheduleNext(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = time.Now().Add(d)
+}
+
+func (p *publisher) injectedFields() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.injected
+}
+
+func (p *publisher) contentHash() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hash
+}
+
+// logFinalState logs what we were last publishing, as a final record on
+// shutdown.
+func (p *publisher) logFinalState() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.log.Info("Final state", "last-success", p.lastDiscovery, "keys", p.keys, "content-hash", p.hash, "failing", p.failed)
+}
+
+func (p *publisher) failing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed
+}
+
+// recordResult records whether the latest attempt at discovery failed.
+func (p *publisher) recordResult(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed = err != nil
+	now := time.Now()
+	if err == nil {
+		if p.failureRecorded {
+			p.events.discoveryRecovered(p.failingSince)
+		}
+		p.failingSince, p.failureRecorded = time.Time{}, false
+		return
+	}
+
+	if p.failingSince.IsZero() {
+		p.failingSince = now
+	}
+	if p.events != nil && !p.failureRecorded && now.Sub(p.failingSince) >= p.events.failingAfter {
+		p.events.discoveryFailing(p.failingSince, err)
+		p.failureRecorded = true
+	}
+	discoveryErrorTime.WithLabelValues(p.cluster).Set(float64(now.Unix()))
+	if p.errorHistory == 0 {
+		return
+	}
+	if len(p.recentErrs) == p.errorHistory {
+		p.recentErrs = slices.Delete(p.recentErrs, 0, 1)
+	}
+	p.recentErrs = append(p.recentErrs, discoveryError{Time: now, Error: err.Error()})
+}
+
+func (p *publisher) recentErrors() []discoveryError {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errs := slices.Clone(p.recentErrs)
+	slices.Reverse(errs)
+	return errs
+}
+
+func (p *publisher) expired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.forcedStale
+}
+
+// expire marks the documents stale until the next refresh publishes them to
+// every sink, whether or not they changed, as sinks may have dropped them.
+func (p *publisher) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forcedStale = true
+	p.forcePublish = true
+}
+
+// publishForced reports whether the next refresh publishes to every sink,
+// whether or not the documents changed.
+func (p *publisher) publishForced() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.forcePublish
+}
+
+// republish makes the next refresh publish to every sink, e.g. because a sink
+// that was skipping updates no longer is.
+func (p *publisher) republish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forcePublish = true
+}
+
+func (p *publisher) addSink(name string, s Sink) {
+	p.sinks = append(p.sinks, namedSink{name: name, Sink: s})
+}
+
+// warmup performs the initial refresh, retrying with backoff until it
+// succeeds or timeout elapses. This rides out the API server not being
+// reachable yet when we start, while still failing a persistently
+// misconfigured setup. If the first attempt fails, the documents are seeded
+// from what was last published to a sink that can be read back, so they can be
+// served in the meantime, see seed.
+func (p *publisher) warmup(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return p.retryRefresh(ctx, true)
+}
+
+// retryRefresh refreshes, retrying with backoff until it succeeds or ctx is
+// done. If seed is set the first failure tries seeding the documents, and if
+// that succeeds the retries are left to catchUp.
+func (p *publisher) retryRefresh(ctx context.Context, seed bool) error {
+	backoff := time.Second
+	shownRBAC := false
+	for attempt := 1; ; attempt++ {
+		err := p.refresh(ctx)
+		if err == nil {
+			return nil
+		}
+		p.log.Warn("Discovery attempt failed", "attempt", attempt, "retry-in", backoff, "error", err)
+
+		if seed && attempt == 1 {
+			serr := p.seed(ctx)
+			if serr == nil {
+				return nil
+			}
+			if !errors.Is(serr, errNoSeedSource) {
+				p.log.Warn("Failed to seed documents from a sink, continuing warmup", "error", serr)
+			}
+		}
+
+		// spell out the exact fix for first time deployers, once.
+		var fe *forbiddenError
+		if errors.As(err, &fe) && fe.serviceAccount != "" && !shownRBAC {
+			shownRBAC = true
+			p.log.Error("Service account lacks RBAC for discovery, apply the manifest below to grant it", "service-account", fe.serviceAccount)
+			fmt.Fprint(os.Stderr, fe.rbacManifest())
+		}
+
+		p.scheduleNext(backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// errNoSeedSource is returned by seed when no sink can be read back.
+var errNoSeedSource = errors.New("no sink to seed from")
+
+// seed pushes the documents last published to a sink that can be read back to
+// the sinks that can't, i.e. those serving from memory. They are as fresh as
+// when they were published, so only served within -stale-after of it.
+func (p *publisher) seed(ctx context.Context) error {
+	var errs []error
+	for _, s := range p.sinks {
+		ss, ok := asSeedSource(s.Sink)
+		if !ok {
+			continue
+		}
+		md, ks, published, err := ss.load(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading %s sink: %v", s.name, err))
+			continue
+		}
+
+		for _, t := range p.sinks {
+			if _, ok := asSeedSource(t.Sink); ok {
+				continue
+			}
+			if err := t.Update(ctx, md, ks); err != nil {
+				return fmt.Errorf("seeding %s sink: %v", t.name, err)
+			}
+		}
+		p.mu.Lock()
+		p.lastDiscovery, p.lastMetadata, p.lastKeys = published, published, published
+		p.seeded = true
+		p.mu.Unlock()
+		p.log.Info("Seeded documents from a sink until discovery succeeds", "sink", s.name, "published", published, "issuer", md.Issuer)
+		return nil
+	}
+	if len(errs) == 0 {
+		return errNoSeedSource
+	}
+	return errors.Join(errs...)
+}
+
+// catchUp retries discovery with backoff if the documents were seeded, rather
+// than leaving them until the next scheduled refresh.
+func (p *publisher) catchUp(ctx context.Context) {
+	p.mu.Lock()
+	seeded := p.seeded
+	p.mu.Unlock()
+	if seeded {
+		_ = p.retryRefresh(ctx, false)
+	}
+}
+
+// errPublishFailing is the cause the publisher gives up with when every sink
+// keeps failing.
+var errPublishFailing = errors.New("publishing failed")
+
+// recordPublishResult counts the refreshes in a row in which every sink
+// failed, giving up once there have been exitAfterFailures of them.
+func (p *publisher) recordPublishResult(allFailed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !allFailed {
+		p.publishFailures = 0
+		return
+	}
+	p.publishFailures++
+	if p.exitAfterFailures > 0 && p.publishFailures >= p.exitAfterFailures {
+		p.log.Error("Every sink failed too many refreshes in a row, exiting", "failures", p.publishFailures, "exit-after-publish-failures", p.exitAfterFailures)
+		p.giveUp(errPublishFailing)
+	}
+}
+
+// run refreshes every interval until ctx is cancelled, with the schedule
+// offset by delay so publishers sharing a process don't all refresh at once.
+// Failures are logged, and the sinks keep serving what they were last updated
+// with.
+func (p *publisher) run(ctx context.Context, interval, delay time.Duration) {
+	p.catchUp(ctx)
+
+	p.scheduleNext(delay + interval)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.scheduleNext(interval)
+			if err := p.refresh(ctx); err != nil {
+				p.log.Error("Failed to refresh discovery documents", "error", err)
+			}
+		}
+	}
+}
+
+// refresh discovers the current documents, and updates every sink if they
+// differ from what was last published. If any sink fails the content is not
+// recorded as published, so all sinks are retried on the next refresh.
+func (p *publisher) refresh(ctx context.Context) error {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	if p.sem != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p.sem <- struct{}{}:
+		}
+		defer func() { <-p.sem }()
+	}
+
+	ctx = p.correlation.start(ctx, p.log)
+	err := p.doRefresh(ctx)
+	p.recordResult(err)
+	if err != nil {
+		p.deleteStale(ctx)
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	refreshes.WithLabelValues(p.cluster, result).Inc()
+	return err
+}
+
+func (p *publisher) doRefresh(ctx context.Context) error {
+	md, mdraw, err := p.src.discover(ctx)
+	if err != nil {
+		if p.confirmKeys {
+			p.confirmKeySet(ctx)
+		}
+		return err
+	}
+
+	if p.sameOriginJWKS && md.JWKSURI != "" {
+		if err := checkJWKSOrigin(md.Issuer, md.JWKSURI); err != nil {
+			return err
+		}
+	}
+
+	var (
+		ks *jose.JSONWebKeySet
+		// upstreamJWKSURI is where the keys were fetched from, empty if
+		// they were inline.
+		upstreamJWKSURI string
+	)
+	if is, ok := p.src.(inlineKeysSource); ok {
+		if ks, err = is.inlineJWKS(mdraw); err != nil {
+			return err
+		}
+	}
+	if ks == nil {
+		if ks, err = p.src.jwks(ctx, md.JWKSURI); err != nil {
+			// the published metadata is still current if it's unchanged.
+			p.mu.Lock()
+			if bytes.Equal(mdraw, p.upstream) {
+				p.lastMetadata = time.Now()
+			}
+			p.mu.Unlock()
+			return err
+		}
+		upstreamJWKSURI = md.JWKSURI
+	}
+	upstreamKeys, err := json.Marshal(ks)
+	if err != nil {
+		return fmt.Errorf("marshaling key set: %v", err)
+	}
+
+	if p.allowedKeyTypes != nil {
+		ks = filterKeyTypes(ks, p.allowedKeyTypes, p.log)
+	}
+	if p.duplicateKIDs != "" {
+		if ks, err = checkDuplicateKIDs(ks, p.duplicateKIDs, p.log); err != nil {
+			return err
+		}
+	}
+	if p.certThumbprints {
+		ks = addCertThumbprints(ks)
+	}
+	if p.eksCompat {
+		if ks, err = eksCompatKeySet(ks, p.log); err != nil {
+			return err
+		}
+	}
+	if p.retainer != nil {
+		ks = p.retainer.apply(ks)
+	}
+
+	md, err = publicMetadata(md)
+	if err != nil {
+		return err
+	}
+	injected := p.defaults.apply(md)
+
+	// -stale-independently serves an empty key set as a 503 of its own, rather
+	// than keeping the previous one.
+	reasons, err := suspectReasons(md, ks, !p.keysServedSeparately)
+	if err != nil {
+		return err
+	}
+	if len(reasons) > 0 {
+		if !p.acceptSuspect {
+			p.log.Warn("Not publishing suspect discovery documents, keeping the previous ones", "issuer", md.Issuer, "reasons", reasons)
+			return fmt.Errorf("discovery documents for %s look degraded: %s", md.Issuer, strings.Join(reasons, ", "))
+		}
+		p.log.Warn("Publishing suspect discovery documents", "issuer", md.Issuer, "reasons", reasons)
+	}
+	if err := p.issuerDNS.check(ctx, md.Issuer); err != nil {
+		return err
+	}
+
+	// the documents are fresh regardless of whether the sinks take them, they
+	// retry on the next refresh.
+	p.mu.Lock()
+	prevMetadata, prevKeys := p.upstream, p.upstreamKeys
+	now := time.Now()
+	p.lastDiscovery, p.lastMetadata, p.lastKeys = now, now, now
+	p.seeded = false
+	p.upstream = mdraw
+	p.upstreamKeys = upstreamKeys
+	p.jwksURI = upstreamJWKSURI
+	force := p.forcePublish
+	p.mu.Unlock()
+
+	p.recordSize("metadata", prevMetadata, mdraw)
+	p.recordSize("jwks", prevKeys, upstreamKeys)
+
+	content, err := json.Marshal([]any{md, ks})
+	if err != nil {
+		return fmt.Errorf("marshaling documents: %v", err)
+	}
+	changed := !bytes.Equal(content, p.published)
+	resync := !changed && !force && p.resyncDue()
+	if !changed && !force && !resync {
+		p.log.Debug("Discovery documents unchanged")
+		return nil
+	}
+	if resync {
+		p.log.Info("Resyncing unchanged discovery documents to every sink", "since", p.publishedAt, "publish-resync-interval", p.resyncInterval)
+	}
+
+	// problems are reported rather than blocking publishing, the API server
+	// is the authority on what it serves.
+	problems, err := validateDiscovery(md)
+	if err != nil {
+		return err
+	}
+	for _, pr := range problems {
+		p.log.Warn("Discovery document is invalid", "issuer", md.Issuer, "problem", pr)
+	}
+	p.mu.Lock()
+	p.problems = problems
+	p.injected = injected
+	p.mu.Unlock()
+
+	var errs []error
+	for _, s := range p.sinks {
+		if err := s.Update(ctx, md, ks); err != nil {
+			errs = append(errs, fmt.Errorf("updating %s sink: %v", s.name, err))
+		}
+	}
+	p.recordPublishResult(len(errs) > 0 && len(errs) == len(p.sinks))
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	kids := make([]string, 0, len(ks.Keys))
+	for _, k := range ks.Keys {
+		kids = append(kids, k.KeyID)
+	}
+	if p.published != nil {
+		p.events.keysRotated(p.publishedKIDs, kids)
+	}
+	p.published = content
+	p.publishedAt = time.Now()
+	p.publishedKIDs = kids
+	p.staleDeleted = false
+	hash := contentHash(content)
+	p.mu.Lock()
+	prevHash := p.hash
+	p.hash = hash
+	p.keys = len(ks.Keys)
+	p.forcedStale = false
+	p.forcePublish = false
+	p.mu.Unlock()
+	if hash != prevHash {
+		contentInfo.DeletePartialMatch(prometheus.Labels{"cluster": p.cluster})
+		contentInfo.WithLabelValues(p.cluster, hash).Set(1)
+		p.logDocuments(ctx, md, ks, hash)
+	}
+	if resync {
+		p.log.Info("Resynced discovery documents", "issuer", md.Issuer, "keys", len(ks.Keys))
+	} else {
+		p.log.Info("Published discovery documents", "issuer", md.Issuer, "keys", len(ks.Keys))
+	}
+
+	return nil
+}
+
+// resyncDue reports whether resyncInterval has passed since the documents were
+// last published, so they're due to be published to every sink again.
+// refreshMu must be held.
+func (p *publisher) resyncDue() bool {
+	return p.resyncInterval > 0 && time.Since(p.publishedAt) >= p.resyncInterval
+}
+
+// deleteStale deletes the documents from every sink that can delete them once
+// discovery has been failing for longer than deleteStaleAfter, so relying
+// parties reading them fail loudly rather than trusting keys that may have
+// been rotated out. It's retried after each failed refresh or change check,
+// which is harmless once they're gone, and the next successful refresh
+// publishes them again. If discovery has never succeeded and nothing was
+// seeded, how old the documents are isn't known, so they're left alone.
+func (p *publisher) deleteStale(ctx context.Context) {
+	if p.deleteStaleAfter == 0 {
+		return
+	}
+	p.mu.Lock()
+	last := p.lastDiscovery
+	p.mu.Unlock()
+	if last.IsZero() || time.Since(last) < p.deleteStaleAfter {
+		return
+	}
+
+	if !p.staleDeleted {
+		p.log.Error("Discovery has been failing for longer than -delete-stale-after, DELETING THE PUBLISHED DOCUMENTS so relying parties stop trusting them", "last-discovery", last, "delete-stale-after", p.deleteStaleAfter)
+	}
+	failed := false
+	for _, s := range p.sinks {
+		d, ok := asDeleter(s.Sink)
+		if !ok {
+			continue
+		}
+		if err := d.delete(ctx); err != nil {
+			failed = true
+			p.log.Error("Failed to delete stale documents, retrying after the next refresh", "sink", s.name, "error", err)
+		}
+	}
+	// whatever we published before is gone, so must be published again
+	// even if it's unchanged.
+	p.mu.Lock()
+	p.forcePublish = true
+	p.mu.Unlock()
+	if !failed && !p.staleDeleted {
+		p.staleDeleted = true
+		p.log.Warn("Deleted the stale documents, they'll be published again once discovery succeeds")
+	}
+}
+
+// logDocuments logs the published metadata and key IDs at debug level, as a
+// record in the logs of what was served over time. It's all public, but the
+// keys themselves are left out for brevity.
+func (p *publisher) logDocuments(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet, hash string) {
+	if !p.log.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	mdJSON, err := json.Marshal(md)
+	if err != nil {
+		p.log.Debug("Failed to marshal published metadata for logging", "error", err)
+		return
+	}
+	kids := make([]string, 0, len(ks.Keys))
+	for _, k := range ks.Keys {
+		kids = append(kids, k.KeyID)
+	}
+	p.log.Debug("Published documents changed", "content-hash", hash, "metadata", string(mdJSON), "kids", kids)
+}
+
+// sizeChangeThreshold is the fraction an upstream document's size has to
+// change by between fetches to be logged.
+const sizeChangeThreshold = 0.25
+
+// recordSize records the size of the upstream document, logging if it changed
+// significantly from prev. A sudden change can mean a key rotation, or an
+// upstream misconfiguration. The key set's size is of it as parsed and
+// re-encoded, which is close to what was fetched.
+func (p *publisher) recordSize(document string, prev, cur []byte) {
+	upstreamBytes.WithLabelValues(p.cluster, document).Set(float64(len(cur)))
+	if prev == nil {
+		return
+	}
+	if change := math.Abs(float64(len(cur)-len(prev))) / float64(max(len(prev), 1)); change >= sizeChangeThreshold {
+		p.log.Info("Upstream document size changed significantly", "document", document, "previous-bytes", len(prev), "bytes", len(cur))
+	}
+}
+
+// confirmKeySet fetches the key set from where it was last discovered, and
+// records it as current if it's unchanged. This lets the keys stay fresh while
+// only the discovery document is failing.
+func (p *publisher) confirmKeySet(ctx context.Context) {
+	p.mu.Lock()
+	jwksURI, prev := p.jwksURI, p.upstreamKeys
+	p.mu.Unlock()
+	if jwksURI == "" {
+		return
+	}
+
+	ks, err := p.src.jwks(ctx, jwksURI)
+	if err != nil {
+		p.log.Debug("Failed to confirm key set", "error", err)
+		return
+	}
+	b, err := json.Marshal(ks)
+	if err != nil || !bytes.Equal(b, prev) {
+		return
+	}
+	p.mu.Lock()
+	p.lastKeys = time.Now()
+	p.mu.Unlock()
+}
+
+// contentHash returns a stable hash of the encoded documents. The encoding is
+// deterministic, so replicas publishing the same documents agree on it.
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:16])
+}
+
+// publicMetadata returns a copy of the API server's metadata, rewritten to
+// point at the key set we publish rather than the API server's.
+func publicMetadata(upstream *oidc.ProviderMetadata) (*oidc.ProviderMetadata, error) {
+	md := *upstream
+
+	jwksURI, err := url.JoinPath(md.Issuer, "/.well-known/jwks.json")
+	if err != nil {
+		return nil, fmt.Errorf("building JWKS URI for issuer %q: %v", md.Issuer, err)
+	}
+	md.JWKSURI = jwksURI
+	// not used, but required for the document to be valid.
+	md.TokenEndpoint = fmt.Sprintf("%s/nonexistent", md.Issuer)
+	md.AuthorizationEndpoint = fmt.Sprintf("%s/nonexistent", md.Issuer)
+
+	return &md, nil
+}
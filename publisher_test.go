@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"lds.li/oauth2ext/oidc"
+)
+
+// testUpstream is an issuer serving its documents with ETags, so they can be
+// watched, that can be made to fail.
+type testUpstream struct {
+	srv *httptest.Server
+	// fail makes every request fail with a 503.
+	fail atomic.Bool
+}
+
+func newTestUpstream(t *testing.T, keys ...jose.JSONWebKey) *testUpstream {
+	t.Helper()
+	u := &testUpstream{}
+	mux := http.NewServeMux()
+	u.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u.fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(u.srv.Close)
+
+	serve := func(b []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"1"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+		}
+	}
+	mux.Handle("GET /.well-known/openid-configuration", serve(testMetadataJSON(t, u.srv.URL, u.srv.URL+"/keys")))
+	mux.Handle("GET /keys", serve(testKeySetJSON(t, keys...)))
+	return u
+}
+
+func (u *testUpstream) source() *issuerSource {
+	return &issuerSource{client: u.srv.Client(), issuer: u.srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}
+}
+
+// countingSink counts the updates and deletes made to it.
+type countingSink struct {
+	updates atomic.Int32
+	deletes atomic.Int32
+}
+
+func (s *countingSink) Update(context.Context, *oidc.ProviderMetadata, *jose.JSONWebKeySet) error {
+	s.updates.Add(1)
+	return nil
+}
+
+func (s *countingSink) delete(context.Context) error {
+	s.deletes.Add(1)
+	return nil
+}
+
+// refreshModes runs the publisher's refresh loop in each mode, polling or
+// watching every interval.
+var refreshModes = []struct {
+	name string
+	run  func(ctx context.Context, p *publisher, interval time.Duration)
+}{
+	{name: refreshModePoll, run: func(ctx context.Context, p *publisher, interval time.Duration) { p.run(ctx, interval, 0) }},
+	{name: refreshModeWatch, run: func(ctx context.Context, p *publisher, interval time.Duration) { p.watch(ctx, interval, interval, 0) }},
+}
+
+// runPublisher publishes with p once, then runs its refresh loop in mode until
+// the test ends.
+func runPublisher(t *testing.T, p *publisher, mode func(context.Context, *publisher, time.Duration)) {
+	t.Helper()
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("initial refresh: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mode(ctx, p, 5*time.Millisecond)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor polls cond until it's true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublisherResync(t *testing.T) {
+	for _, mode := range refreshModes {
+		t.Run(mode.name, func(t *testing.T) {
+			up := newTestUpstream(t, testKey(t, "a"))
+			st := &countingSink{}
+			p := &publisher{src: up.source(), log: slog.Default(), resyncInterval: 50 * time.Millisecond}
+			p.addSink("counting", st)
+			runPublisher(t, p, mode.run)
+
+			waitFor(t, "the unchanged documents to be resynced", func() bool { return st.updates.Load() >= 2 })
+		})
+	}
+}
+
+func TestPublisherUnchangedNotPublished(t *testing.T) {
+	for _, mode := range refreshModes {
+		t.Run(mode.name, func(t *testing.T) {
+			up := newTestUpstream(t, testKey(t, "a"))
+			st := &countingSink{}
+			p := &publisher{src: up.source(), log: slog.Default()}
+			p.addSink("counting", st)
+			runPublisher(t, p, mode.run)
+
+			time.Sleep(50 * time.Millisecond)
+			if got := st.updates.Load(); got != 1 {
+				t.Errorf("sink updated %d times, want 1 as the documents didn't change", got)
+			}
+		})
+	}
+}
+
+func TestPublisherDeleteStale(t *testing.T) {
+	for _, mode := range refreshModes {
+		t.Run(mode.name, func(t *testing.T) {
+			up := newTestUpstream(t, testKey(t, "a"))
+			st := &countingSink{}
+			p := &publisher{src: up.source(), log: slog.Default(), deleteStaleAfter: 30 * time.Millisecond}
+			p.addSink("counting", st)
+			runPublisher(t, p, mode.run)
+
+			time.Sleep(10 * time.Millisecond)
+			if got := st.deletes.Load(); got != 0 {
+				t.Fatalf("documents deleted %d times while discovery was succeeding", got)
+			}
+
+			up.fail.Store(true)
+			waitFor(t, "the stale documents to be deleted", func() bool { return st.deletes.Load() >= 1 })
+
+			// once discovery recovers, the unchanged documents are
+			// published again.
+			updates := st.updates.Load()
+			up.fail.Store(false)
+			waitFor(t, "the documents to be published again", func() bool { return st.updates.Load() > updates })
+		})
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	up := newTestUpstream(t, testKey(t, "a"))
+
+	t.Run("retries until discovery succeeds", func(t *testing.T) {
+		up.fail.Store(true)
+		time.AfterFunc(100*time.Millisecond, func() { up.fail.Store(false) })
+		st := &countingSink{}
+		p := &publisher{src: up.source(), log: slog.Default()}
+		p.addSink("counting", st)
+		if err := p.warmup(context.Background(), 10*time.Second); err != nil {
+			t.Fatalf("warmup: %v", err)
+		}
+		if st.updates.Load() != 1 || p.lastSuccess().IsZero() {
+			t.Error("warmup returned without publishing")
+		}
+	})
+
+	t.Run("gives up after the timeout", func(t *testing.T) {
+		up.fail.Store(true)
+		defer up.fail.Store(false)
+		p := &publisher{src: up.source(), log: slog.Default()}
+		p.addSink("counting", &countingSink{})
+		start := time.Now()
+		err := p.warmup(context.Background(), 100*time.Millisecond)
+		if err == nil {
+			t.Fatal("warmup succeeded, want it to give up")
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("warmup took %s to give up after 100ms", time.Since(start))
+		}
+	})
+
+	t.Run("starts degraded from the cache", func(t *testing.T) {
+		// cache what a previous run published.
+		cache := &fileSink{dir: t.TempDir()}
+		prev := &publisher{src: up.source(), log: slog.Default()}
+		prev.addSink("cache", cache)
+		if err := prev.refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		up.fail.Store(true)
+		defer up.fail.Store(false)
+		p := &publisher{src: up.source(), log: slog.Default()}
+		sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable}
+		p.addSink("http", sink)
+		p.addSink("cache", cache)
+		if err := p.warmup(context.Background(), time.Minute); err != nil {
+			t.Fatalf("warmup with a cache: %v", err)
+		}
+		if p.lastSuccess().IsZero() {
+			t.Error("seeded documents have no publish time")
+		}
+		h := (&httpServer{clusters: []*cluster{{name: "default", pub: p, sink: sink}}}).handler()
+		if w := get(h, "/.well-known/jwks.json"); w.Code != http.StatusOK {
+			t.Errorf("cached key set served with status %d, want 200", w.Code)
+		}
+	})
+}
+
+// flakySink fails its updates while fail is set, counting the attempts.
+type flakySink struct {
+	countingSink
+	fail atomic.Bool
+}
+
+func (s *flakySink) Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	s.countingSink.Update(ctx, md, ks)
+	if s.fail.Load() {
+		return errors.New("sink unavailable")
+	}
+	return nil
+}
+
+func TestPublisherMultipleSinks(t *testing.T) {
+	up := newTestUpstream(t, testKey(t, "a"))
+	a, b := &countingSink{}, &flakySink{}
+	p := &publisher{src: up.source(), log: slog.Default()}
+	p.addSink("a", a)
+	p.addSink("b", b)
+	ctx := context.Background()
+
+	// both receive the documents, and an unchanged refresh updates neither.
+	for range 2 {
+		if err := p.refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.updates.Load() != 1 || b.updates.Load() != 1 {
+		t.Fatalf("sinks updated %d and %d times, want once each", a.updates.Load(), b.updates.Load())
+	}
+
+	// a failure in one sink doesn't stop the other being updated, and
+	// both are retried on the next refresh.
+	p.republish()
+	b.fail.Store(true)
+	if err := p.refresh(ctx); err != nil {
+		t.Logf("refresh with a failing sink: %v", err)
+	}
+	if a.updates.Load() != 2 || b.updates.Load() != 2 {
+		t.Fatalf("sinks updated %d and %d times, want twice each", a.updates.Load(), b.updates.Load())
+	}
+	b.fail.Store(false)
+	if err := p.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.updates.Load() != 3 || b.updates.Load() != 3 {
+		t.Errorf("sinks updated %d and %d times after the failure, want both retried", a.updates.Load(), b.updates.Load())
+	}
+}
+
+func TestPublisherPartialFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// failMetadata and failKeys fail the discovery document and key
+		// set fetches.
+		failMetadata, failKeys bool
+		confirmKeys            bool
+		wantMetadata, wantKeys bool
+	}{
+		{name: "key set failing", failKeys: true, wantMetadata: true},
+		{name: "discovery failing", failMetadata: true, confirmKeys: true, wantKeys: true},
+		{name: "discovery failing without confirming keys", failMetadata: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var failMetadata, failKeys atomic.Bool
+			mux := http.NewServeMux()
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			md, ks := testMetadataJSON(t, srv.URL, srv.URL+"/keys"), testKeySetJSON(t, testKey(t, "a"))
+			mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+				if failMetadata.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				serveJSON(md)(w, r)
+			})
+			mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+				if failKeys.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				serveJSON(ks)(w, r)
+			})
+
+			p := &publisher{
+				src:         &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept},
+				log:         slog.Default(),
+				confirmKeys: tc.confirmKeys,
+			}
+			p.addSink("counting", &countingSink{})
+			if err := p.refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			prevMetadata, prevKeys := p.lastConfirmed()
+
+			failMetadata.Store(tc.failMetadata)
+			failKeys.Store(tc.failKeys)
+			time.Sleep(time.Millisecond)
+			if err := p.refresh(context.Background()); err == nil {
+				t.Fatal("refresh succeeded")
+			}
+			mdAt, ksAt := p.lastConfirmed()
+			if got := mdAt.After(prevMetadata); got != tc.wantMetadata {
+				t.Errorf("metadata confirmed current: %t, want %t", got, tc.wantMetadata)
+			}
+			if got := ksAt.After(prevKeys); got != tc.wantKeys {
+				t.Errorf("key set confirmed current: %t, want %t", got, tc.wantKeys)
+			}
+			if !p.lastSuccess().Equal(prevMetadata) {
+				t.Error("a partly failed refresh counted as a success")
+			}
+		})
+	}
+}
+
+func TestPublisherSuspectDocuments(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// omit is left out of the upstream's discovery document.
+		omit string
+		// noKeys serves an empty key set.
+		noKeys               bool
+		defaults             metadataDefaults
+		acceptSuspect        bool
+		keysServedSeparately bool
+		// wantErr is part of the refresh error, if it's refused.
+		wantErr string
+	}{
+		{name: "complete"},
+		{name: "missing subject types", omit: "subject_types_supported", wantErr: "subject_types_supported is missing"},
+		{name: "missing subject types, filled in", omit: "subject_types_supported", defaults: metadataDefaults{subjectTypes: []string{"public"}}},
+		{name: "missing response types, subject types filled in", omit: "response_types_supported", defaults: metadataDefaults{subjectTypes: []string{"public"}}, wantErr: "response_types_supported is missing"},
+		{name: "missing subject types, accepted", omit: "subject_types_supported", acceptSuspect: true},
+		{name: "no keys", noKeys: true, wantErr: "key set has no keys"},
+		{name: "no keys, served separately", noKeys: true, keysServedSeparately: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			md := map[string]any{
+				"issuer":                                srv.URL,
+				"jwks_uri":                              srv.URL + "/keys",
+				"response_types_supported":              []string{"id_token"},
+				"subject_types_supported":               []string{"public"},
+				"id_token_signing_alg_values_supported": []string{"ES256"},
+			}
+			delete(md, tc.omit)
+			mdraw, err := json.Marshal(md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []jose.JSONWebKey{testKey(t, "a")}
+			if tc.noKeys {
+				keys = nil
+			}
+			mux.Handle("GET /.well-known/openid-configuration", serveJSON(mdraw))
+			mux.Handle("GET /keys", serveJSON(testKeySetJSON(t, keys...)))
+
+			st := &captureSink{}
+			p := &publisher{
+				src:                  &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept},
+				log:                  slog.Default(),
+				defaults:             tc.defaults,
+				acceptSuspect:        tc.acceptSuspect,
+				keysServedSeparately: tc.keysServedSeparately,
+			}
+			p.addSink("capture", st)
+			err = p.refresh(context.Background())
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("refresh error = %v, want %q", err, tc.wantErr)
+				}
+				if st.md != nil {
+					t.Error("suspect documents were published")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("refresh: %v", err)
+			}
+			if st.md == nil {
+				t.Fatal("documents weren't published")
+			}
+			if tc.defaults.subjectTypes != nil && !slices.Equal(st.md.SubjectTypesSupported, tc.defaults.subjectTypes) {
+				t.Errorf("subject_types_supported = %v, want the default %v", st.md.SubjectTypesSupported, tc.defaults.subjectTypes)
+			}
+			if len(st.ks.Keys) != len(keys) {
+				t.Errorf("published %d keys, want %d", len(st.ks.Keys), len(keys))
+			}
+		})
+	}
+}
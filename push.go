@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsPusher pushes the metrics to a Prometheus Pushgateway, for setups
+// where nothing scrapes us. They are pushed every interval, and a final time
+// on shutdown so the last values aren't lost.
+type metricsPusher struct {
+	pusher   *push.Pusher
+	interval time.Duration
+}
+
+// newMetricsPusher returns a pusher of the metrics from g to the Pushgateway
+// at url, under job. The metrics are grouped by instance, our host name, so
+// replicas don't replace each other's.
+func newMetricsPusher(url, job string, interval time.Duration, g prometheus.Gatherer) *metricsPusher {
+	p := push.New(url, job).Gatherer(g)
+	if h, err := os.Hostname(); err == nil {
+		p = p.Grouping("instance", h)
+	}
+	return &metricsPusher{pusher: p, interval: interval}
+}
+
+// run pushes the metrics every interval until ctx is cancelled.
+func (m *metricsPusher) run(ctx context.Context) {
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := m.push(ctx); err != nil {
+			slog.Error("Failed to push metrics", "error", err)
+		}
+	}
+}
+
+// push replaces the metrics in our group with the current ones.
+func (m *metricsPusher) push(ctx context.Context) error {
+	return m.pusher.PushContext(ctx)
+}
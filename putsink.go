@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+	"lds.li/oauth2ext/oidc"
+)
+
+// putSink PUTs the documents to a URL each, for object stores and APIs we
+// don't otherwise support. The key set goes first, as documentFiles orders
+// them, so the metadata never points at keys that aren't there yet.
+type putSink struct {
+	client      *http.Client
+	metadataURL string
+	jwksURL     string
+	// headers are sent with every request, e.g. for authentication.
+	headers http.Header
+	// retry is how each PUT is retried on network errors, server errors and
+	// rate limiting.
+	retry retryPolicy
+	// dryRun logs the requests rather than making them.
+	dryRun        bool
+	canonicalKeys bool
+	log           *slog.Logger
+}
+
+func (p *putSink) Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	files, err := documentFiles(md, ks, p.canonicalKeys, "")
+	if err != nil {
+		return err
+	}
+	urls := map[string]string{
+		".well-known/jwks.json":            p.jwksURL,
+		".well-known/openid-configuration": p.metadataURL,
+	}
+	for _, df := range files {
+		u := urls[df.path]
+		if p.dryRun {
+			p.log.Info("Dry run, not sending PUT", "url", u, "bytes", len(df.body), "headers", headerNames(p.headers))
+			continue
+		}
+		attempt := 0
+		err := p.retry.do(ctx, func() error {
+			attempt++
+			err := p.send(ctx, http.MethodPut, u, df.body)
+			if err != nil {
+				p.log.Warn("PUT failed", "url", u, "attempt", attempt, "of", p.retry.attempts, "error", err)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		p.log.Info("Published document", "url", u, "bytes", len(df.body))
+	}
+	return nil
+}
+
+// delete DELETEs the documents, the metadata first so it never points at keys
+// that are gone. Ones that are already gone are skipped.
+func (p *putSink) delete(ctx context.Context) error {
+	for _, u := range []string{p.metadataURL, p.jwksURL} {
+		if p.dryRun {
+			p.log.Info("Dry run, not sending DELETE", "url", u, "headers", headerNames(p.headers))
+			continue
+		}
+		attempt := 0
+		err := p.retry.do(ctx, func() error {
+			attempt++
+			err := p.send(ctx, http.MethodDelete, u, nil)
+			if err != nil {
+				p.log.Warn("DELETE failed", "url", u, "attempt", attempt, "of", p.retry.attempts, "error", err)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		p.log.Info("Deleted document", "url", u)
+	}
+	return nil
+}
+
+// send makes a PUT of body, or a DELETE, to u, failing on anything but a 2xx,
+// or for a DELETE a 404.
+func (p *putSink) send(ctx context.Context, method, u string, body []byte) error {
+	op := "putting"
+	if method == http.MethodDelete {
+		op = "deleting"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building request for %s: %v", u, err)
+	}
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", op, u, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxBodySnippet+1))
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{op: op, url: u, status: resp.Status, code: resp.StatusCode, body: b}
+	}
+	return nil
+}
+
+// headerNames returns the names of h, for logging without the values, which
+// may be credentials.
+func headerNames(h http.Header) []string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	return names
+}
+
+// loadHeadersFile reads headers in "Name: value" form, one per line, from
+// path. Blank lines and lines starting with # are skipped.
+func loadHeadersFile(path string) (http.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := http.Header{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: must be in Name: value form", path, n)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return h, nil
+}
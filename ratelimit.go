@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultRateLimitExempt are the paths exempt from rate limiting unless
+// -rate-limit-exempt says otherwise: the probes and scrapes that come from
+// our own infrastructure rather than relying parties, and that would take us
+// out of rotation or blind monitoring if they were refused under load.
+const defaultRateLimitExempt = "/healthz,/readyz,/metrics"
+
+// rateLimiter sheds requests over a total rate with 429s, so a burst of
+// relying parties can't overwhelm us. A nil rateLimiter limits nothing.
+type rateLimiter struct {
+	limiter *rate.Limiter
+	// exempt are the paths served whatever the rate.
+	exempt map[string]bool
+}
+
+// newRateLimiter returns a limiter allowing perSecond requests a second on
+// average, and bursts of up to burst, with the comma separated exempt paths
+// never limited. A burst of 0 allows a second's worth.
+func newRateLimiter(perSecond float64, burst int, exempt string) (*rateLimiter, error) {
+	if perSecond <= 0 || math.IsInf(perSecond, 0) || math.IsNaN(perSecond) {
+		return nil, fmt.Errorf("rate must be positive, got %v", perSecond)
+	}
+	if burst < 0 {
+		return nil, fmt.Errorf("burst must not be negative, got %d", burst)
+	}
+	if burst == 0 {
+		burst = max(1, int(math.Ceil(perSecond)))
+	}
+	l := &rateLimiter{limiter: rate.NewLimiter(rate.Limit(perSecond), burst), exempt: map[string]bool{}}
+	if exempt == "" {
+		return l, nil
+	}
+	for p := range strings.SplitSeq(exempt, ",") {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("exempt path %q must start with /", p)
+		}
+		l.exempt[p] = true
+	}
+	return l, nil
+}
+
+// wrap refuses requests over the rate, other than to the exempt paths, with a
+// 429 telling the client when to retry.
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	// a token is added every 1/rate, so that's the soonest a refused client
+	// could be served.
+	retryAfter := strconv.Itoa(max(1, int(math.Ceil(1/float64(l.limiter.Limit())))))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.exempt[r.URL.Path] || l.limiter.Allow() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", retryAfter)
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limited"})
+	})
+}
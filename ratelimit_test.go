@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		perSecond float64
+		burst     int
+		exempt    string
+		wantBurst int
+		wantErr   bool
+	}{
+		{name: "defaults", perSecond: 10, exempt: defaultRateLimitExempt, wantBurst: 10},
+		{name: "explicit burst", perSecond: 10, burst: 50, wantBurst: 50},
+		{name: "fractional rate bursts one", perSecond: 0.5, wantBurst: 1},
+		{name: "no exemptions", perSecond: 1, wantBurst: 1},
+		{name: "zero rate", perSecond: 0, wantErr: true},
+		{name: "negative rate", perSecond: -1, wantErr: true},
+		{name: "negative burst", perSecond: 1, burst: -1, wantErr: true},
+		{name: "relative exempt path", perSecond: 1, exempt: "/healthz,readyz", wantErr: true},
+		{name: "empty exempt path", perSecond: 1, exempt: "/healthz,,/readyz", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := newRateLimiter(tc.perSecond, tc.burst, tc.exempt)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.limiter.Burst(); got != tc.wantBurst {
+				t.Errorf("burst = %d, want %d", got, tc.wantBurst)
+			}
+		})
+	}
+}
+
+func TestRateLimitExemptPaths(t *testing.T) {
+	const jwks = "/.well-known/jwks.json"
+	for _, tc := range []struct {
+		name   string
+		exempt string
+		// probes are requested under load, and must all be served.
+		probes []string
+		// limited are requested once the burst is spent, and must be
+		// refused.
+		limited []string
+	}{
+		{name: "default", exempt: defaultRateLimitExempt, probes: []string{"/healthz", "/readyz", "/metrics"}, limited: []string{jwks}},
+		{name: "configured", exempt: "/healthz," + jwks, probes: []string{"/healthz", jwks}, limited: []string{"/readyz", "/metrics"}},
+		{name: "nothing exempt", limited: []string{"/healthz", "/readyz", jwks}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a token every 1000s, so the burst can't be refilled during
+			// the test.
+			l, err := newRateLimiter(0.001, 5, tc.exempt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &httpServer{
+				clusters: []*cluster{newTestCluster(t, "default", "https://example.com", testKey(t, "a"))},
+				gatherer: prometheus.NewRegistry(),
+				limiter:  l,
+			}
+			h := s.handler()
+
+			// load the server with document requests from many clients
+			// at once, probing all the while.
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			codes := map[int]int{}
+			for range 50 {
+				wg.Go(func() {
+					w := get(h, "/.well-known/openid-configuration")
+					mu.Lock()
+					codes[w.Code]++
+					mu.Unlock()
+				})
+				for _, p := range tc.probes {
+					wg.Go(func() {
+						if w := get(h, p); w.Code != http.StatusOK {
+							t.Errorf("%s under load = %d, want 200: %s", p, w.Code, w.Body)
+						}
+					})
+				}
+			}
+			wg.Wait()
+			if codes[http.StatusTooManyRequests] == 0 {
+				t.Fatalf("load got %v, want some refused", codes)
+			}
+
+			for _, p := range tc.limited {
+				w := get(h, p)
+				if w.Code != http.StatusTooManyRequests {
+					t.Errorf("%s = %d, want 429", p, w.Code)
+					continue
+				}
+				if got := w.Header().Get("Retry-After"); got != "1000" {
+					t.Errorf("%s Retry-After = %q, want 1000", p, got)
+				}
+				if got := w.Header().Get("Cache-Control"); got != "no-store" {
+					t.Errorf("%s Cache-Control = %q, want no-store", p, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitAdminListener(t *testing.T) {
+	l, err := newRateLimiter(0.001, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &httpServer{
+		clusters:      []*cluster{newTestCluster(t, "default", "https://example.com", testKey(t, "a"))},
+		gatherer:      prometheus.NewRegistry(),
+		separateAdmin: true,
+		limiter:       l,
+	}
+	h := s.handler()
+	get(h, "/healthz")
+	if w := get(h, "/healthz"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("public listener = %d once the burst is spent, want 429", w.Code)
+	}
+	// the admin listener isn't limited, even under load on the public one.
+	admin := s.adminHandler()
+	for range 10 {
+		if w := get(admin, "/metrics"); w.Code != http.StatusOK {
+			t.Fatalf("admin listener = %d, want 200", w.Code)
+		}
+	}
+}
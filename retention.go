@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// retentionLimit caps the keys held in key set snapshots by every cluster's
+// -retain-key-sets retainer and -jwks-versions, so memory stays bounded however
+// many clusters and rotations there are. When over the cap, the oldest
+// snapshot held by any of them is evicted until it fits.
+type retentionLimit struct {
+	// max is the most keys to hold, 0 for no cap. Usage is still reported.
+	max int
+
+	mu      sync.Mutex
+	holders []retentionHolderEntry
+}
+
+type retentionHolderEntry struct {
+	cluster string
+	// flag is the flag the holder's snapshots are retained for, for logs.
+	flag string
+	h    retentionHolder
+}
+
+// retentionHolder holds key set snapshots counting towards a retentionLimit.
+// Its methods take its own locks, so a holder must not call enforce with them
+// held.
+type retentionHolder interface {
+	// retained returns the number of keys held, and when the oldest
+	// evictable snapshot was taken, zero if there is none.
+	retained() (keys int, oldest time.Time)
+	// evictOldest drops the oldest evictable snapshot, returning the number
+	// of keys it held.
+	evictOldest() int
+}
+
+func (l *retentionLimit) add(cluster, flag string, h retentionHolder) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holders = append(l.holders, retentionHolderEntry{cluster: cluster, flag: flag, h: h})
+}
+
+// enforce evicts snapshots, oldest first across all holders, until the keys
+// held are within the cap, and updates the usage metric.
+func (l *retentionLimit) enforce() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		var (
+			total    int
+			oldest   *retentionHolderEntry
+			oldestAt time.Time
+		)
+		for i, e := range l.holders {
+			n, at := e.h.retained()
+			total += n
+			if !at.IsZero() && (oldest == nil || at.Before(oldestAt)) {
+				oldest, oldestAt = &l.holders[i], at
+			}
+		}
+		retainedKeys.Set(float64(total))
+		if l.max == 0 || total <= l.max || oldest == nil {
+			return
+		}
+
+		n := oldest.h.evictOldest()
+		if n == 0 {
+			// the holder changed under us, and there was nothing to free.
+			return
+		}
+		slog.Info("Evicted oldest retained key set to stay under -max-retained-keys", "cluster", oldest.cluster, "retained-for", oldest.flag, "keys", n, "taken", oldestAt, "max", l.max)
+	}
+}
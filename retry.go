@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// retryPolicy is a bounded, jittered exponential backoff for retrying a
+// single fetch within a refresh.
+type retryPolicy struct {
+	// attempts is the total number of tries, including the first.
+	attempts int
+	// backoff is the delay before the first retry, doubling for each one
+	// after up to maxBackoff.
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// do calls fn until it succeeds, returns an error that isn't worth retrying,
+// or the attempts are used up. Each delay is jittered between half and all
+// of the backoff, so clients retrying against a shared upstream spread out.
+func (p retryPolicy) do(ctx context.Context, fn func() error) error {
+	backoff := p.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.attempts || !retryable(err) {
+			return err
+		}
+
+		d := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v (gave up retrying after %d attempts: %v)", err, attempt, ctx.Err())
+		case <-time.After(d):
+		}
+		backoff = min(backoff*2, p.maxBackoff)
+	}
+}
+
+// statusError is an HTTP response with an unexpected status.
+type statusError struct {
+	// op is what was being done, e.g. "getting".
+	op     string
+	url    string
+	status string
+	code   int
+	body   []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %s, body: %s", e.op, e.url, e.status, bodySnippet(e.body))
+}
+
+// retryable reports whether err may be transient. Statuses other than server
+// errors and rate limiting won't change by asking again, while anything else
+// failing a fetch is likely the network.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	unavailable := &statusError{op: "getting", url: "https://cdn.example.com/keys", status: "503 Service Unavailable", code: http.StatusServiceUnavailable}
+	notFound := &statusError{op: "getting", url: "https://cdn.example.com/keys", status: "404 Not Found", code: http.StatusNotFound}
+	for _, tc := range []struct {
+		name   string
+		policy retryPolicy
+		// errs are returned by each call in turn, then nil.
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "succeeds first time", policy: retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}, wantCalls: 1},
+		{name: "retries until it succeeds", policy: retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}, errs: []error{unavailable, io.ErrUnexpectedEOF}, wantCalls: 3},
+		{name: "gives up after the attempts", policy: retryPolicy{attempts: 2, backoff: time.Millisecond, maxBackoff: time.Millisecond}, errs: []error{unavailable, unavailable, unavailable}, wantCalls: 2, wantErr: unavailable},
+		{name: "a single attempt never retries", policy: retryPolicy{attempts: 1, backoff: time.Millisecond, maxBackoff: time.Millisecond}, errs: []error{unavailable}, wantCalls: 1, wantErr: unavailable},
+		{name: "permanent errors aren't retried", policy: retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}, errs: []error{notFound}, wantCalls: 1, wantErr: notFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := tc.policy.do(context.Background(), func() error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != tc.wantCalls {
+				t.Errorf("called %d times, want %d", calls, tc.wantCalls)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	const backoff, maxBackoff = 20 * time.Millisecond, 40 * time.Millisecond
+	p := retryPolicy{attempts: 5, backoff: backoff, maxBackoff: maxBackoff}
+	var calls []time.Time
+	_ = p.do(context.Background(), func() error {
+		calls = append(calls, time.Now())
+		return io.ErrUnexpectedEOF
+	})
+	if len(calls) != p.attempts {
+		t.Fatalf("called %d times, want %d", len(calls), p.attempts)
+	}
+	// each delay is jittered between half and all of the backoff, which
+	// doubles up to the cap.
+	want := []time.Duration{backoff, 2 * backoff, maxBackoff, maxBackoff}
+	for i, w := range want {
+		d := calls[i+1].Sub(calls[i])
+		if d < w/2 || d > w+50*time.Millisecond {
+			t.Errorf("retry %d after %s, want between %s and about %s", i+1, d, w/2, w)
+		}
+	}
+}
+
+func TestRetryPolicyCancelled(t *testing.T) {
+	p := retryPolicy{attempts: 3, backoff: time.Hour, maxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	err := p.do(ctx, func() error { return io.ErrUnexpectedEOF })
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("kept waiting %s after the context was cancelled", time.Since(start))
+	}
+	if err == nil || !strings.Contains(err.Error(), "gave up retrying after 1 attempts") {
+		t.Errorf("error = %v, want the last error and why we gave up", err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{err: &statusError{code: http.StatusInternalServerError}, want: true},
+		{err: &statusError{code: http.StatusBadGateway}, want: true},
+		{err: &statusError{code: http.StatusTooManyRequests}, want: true},
+		{err: &statusError{code: http.StatusNotFound}},
+		{err: &statusError{code: http.StatusForbidden}},
+		{err: fmt.Errorf("fetching: %w", &statusError{code: http.StatusServiceUnavailable}), want: true},
+		{err: io.ErrUnexpectedEOF, want: true},
+		{err: context.Canceled},
+		{err: fmt.Errorf("fetching: %w", context.DeadlineExceeded)},
+	} {
+		if got := retryable(tc.err); got != tc.want {
+			t.Errorf("retryable(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"lds.li/oauth2ext/oidc"
+)
+
+// jwtAlgs are the signature algorithms for the key types we publish, see
+// parseJWK.
+var jwtAlgs = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// captureSink captures the documents that would be published, without
+// publishing them anywhere.
+type captureSink struct {
+	md *oidc.ProviderMetadata
+	ks *jose.JSONWebKeySet
+}
+
+func (s *captureSink) Update(_ context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	s.md, s.ks = md, ks
+	return nil
+}
+
+// selftest discovers the documents p would publish, and checks the service
+// account token in tokenFile verifies against them. p's sinks are replaced, so
+// nothing is published.
+func selftest(ctx context.Context, p *publisher, tokenFile string, timeout time.Duration) error {
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("reading token: %v", err)
+	}
+
+	st := &captureSink{}
+	p.sinks = []namedSink{{name: "selftest", Sink: st}}
+	if err := p.warmup(ctx, timeout); err != nil {
+		return fmt.Errorf("discovering documents: %v", err)
+	}
+
+	claims, err := verifyToken(strings.TrimSpace(string(b)), st.md, st.ks)
+	if err != nil {
+		return err
+	}
+	slog.Info("Token verified against published keys", "issuer", claims.Issuer, "subject", claims.Subject)
+	return nil
+}
+
+// verifyToken checks that token is signed by a key in ks, and was issued by
+// md's issuer. Expiry is reported but not enforced, as a sample token just
+// needs to have been signed by a published key.
+func verifyToken(token string, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) (*jwt.Claims, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing token: %v", err)
+	}
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+	if len(ks.Key(kid)) == 0 {
+		return nil, fmt.Errorf("token is signed with kid %q, which is not in the published key set", kid)
+	}
+
+	var claims jwt.Claims
+	if err := tok.Claims(ks, &claims); err != nil {
+		return nil, fmt.Errorf("verifying token with published key %q: %v", kid, err)
+	}
+	if err := claims.Validate(jwt.Expected{Issuer: md.Issuer}); errors.Is(err, jwt.ErrExpired) {
+		slog.Warn("Token is expired", "expiry", claims.Expiry.Time())
+	} else if err != nil {
+		return nil, fmt.Errorf("validating token claims: %v", err)
+	}
+	return &claims, nil
+}
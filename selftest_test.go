@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testSigningKey returns a new EC private key.
+func testSigningKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// signToken returns a service account token with claims, signed by key as kid.
+func signToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.Claims) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: kid}}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSelftest(t *testing.T) {
+	key := testSigningKey(t)
+	up := newTestUpstream(t, jose.JSONWebKey{Key: &key.PublicKey, KeyID: "a", Algorithm: "ES256", Use: "sig"})
+	issuer := up.srv.URL
+	now := time.Now()
+	valid := jwt.Claims{
+		Issuer:   issuer,
+		Subject:  "system:serviceaccount:default:test",
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	expired := valid
+	expired.IssuedAt, expired.Expiry = jwt.NewNumericDate(now.Add(-2*time.Hour)), jwt.NewNumericDate(now.Add(-time.Hour))
+	otherIssuer := valid
+	otherIssuer.Issuer = "https://other.example.com"
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		// wantErr is part of the error, if the token doesn't verify.
+		wantErr string
+	}{
+		{name: "valid", token: signToken(t, key, "a", valid)},
+		// a sample token only needs to have been signed by a published key.
+		{name: "expired", token: signToken(t, key, "a", expired)},
+		{name: "unknown kid", token: signToken(t, key, "b", valid), wantErr: `kid "b", which is not in the published key set`},
+		{name: "wrong issuer", token: signToken(t, key, "a", otherIssuer), wantErr: "validating token claims"},
+		{name: "bad signature", token: signToken(t, testSigningKey(t), "a", valid), wantErr: `verifying token with published key "a"`},
+		{name: "not a token", token: "not.a.token", wantErr: "parsing token"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tokenFile := filepath.Join(t.TempDir(), "token")
+			// as projected, with a trailing newline.
+			if err := os.WriteFile(tokenFile, []byte(tc.token+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			p := &publisher{src: up.source(), log: slog.Default()}
+			err := selftest(context.Background(), p, tokenFile, 5*time.Second)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("error = %v, want the token verified", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("missing token", func(t *testing.T) {
+		p := &publisher{src: up.source(), log: slog.Default()}
+		if err := selftest(context.Background(), p, filepath.Join(t.TempDir(), "missing"), 5*time.Second); err == nil || !strings.Contains(err.Error(), "reading token") {
+			t.Errorf("error = %v, want the token file unreadable", err)
+		}
+	})
+}
@@ -0,0 +1,1238 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"lds.li/oauth2ext/oidc"
+)
+
+const (
+	staleModeFailClosed = "fail-closed"
+	staleModeFailOpen   = "fail-open"
+)
+
+// staleness decides when the documents are stale, the same way everywhere
+// readiness is reported.
+type staleness struct {
+	// staleAfter is how long after the last successful discovery the
+	// documents are considered stale. 0 disables the check.
+	staleAfter time.Duration
+	// clockSkew is extra tolerance on staleAfter, for clock differences
+	// between where the discovery time was recorded and where it's checked.
+	clockSkew time.Duration
+	// failOpen keeps serving stale documents, rather than returning a 503.
+	failOpen bool
+	// unreadyOnFailure reports not ready as soon as discovery fails, rather
+	// than once the documents go stale. They are still served.
+	unreadyOnFailure bool
+	// independent judges the metadata and key set separately, by when each
+	// was last confirmed current, rather than by the last discovery that
+	// succeeded for both.
+	independent bool
+}
+
+// isStale reports whether either of ds's documents is stale, see
+// documentsStale.
+func (s staleness) isStale(ds discoveryState) bool {
+	metadata, keys := s.documentsStale(ds)
+	return metadata || keys
+}
+
+// documentsStale reports whether ds's metadata and key set were last
+// confirmed current longer than staleAfter ago, allowing for clockSkew. Both
+// are stale if they were expired by an operator.
+func (s staleness) documentsStale(ds discoveryState) (metadata, keys bool) {
+	if ds.expired() {
+		return true, true
+	}
+	if s.staleAfter == 0 {
+		return false, false
+	}
+	if !s.independent {
+		st := s.staleSince(ds.lastSuccess())
+		return st, st
+	}
+	md, ks := ds.lastConfirmed()
+	return s.staleSince(md), s.staleSince(ks)
+}
+
+func (s staleness) staleSince(last time.Time) bool {
+	return time.Since(last) > s.staleAfter+s.clockSkew
+}
+
+// ready reports whether ds's documents should be served. Failing open, stale
+// documents still are. With unreadyOnFailure we're not ready while discovery
+// is failing, even if they're not stale yet.
+func (s staleness) ready(ds discoveryState) bool {
+	if s.unreadyOnFailure && ds.failing() {
+		return false
+	}
+	return !ds.lastSuccess().IsZero() && (s.failOpen || !s.isStale(ds))
+}
+
+// httpSink serves the most recently published documents over HTTP.
+type httpSink struct {
+	jwksContentType string
+
+	staleness
+	// state provides the publisher's discovery status.
+	state discoveryState
+	// cacheMaxAge is the max-age clients may cache the documents for.
+	cacheMaxAge time.Duration
+	// staleWhileRevalidate is how long past max-age caches may serve the
+	// documents while they revalidate in the background. 0 omits the
+	// directive.
+	staleWhileRevalidate time.Duration
+	// gzip serves compressed documents to clients that accept them.
+	gzip bool
+	// pretty indents the documents, for reading them by hand.
+	pretty bool
+	// prettyQuery serves the documents indented to requests with
+	// ?pretty=1, leaving the standard responses compact.
+	prettyQuery bool
+	// canonicalKeys serves the keys in canonical member order.
+	canonicalKeys bool
+	// initializingStatus is the status the documents and readiness are
+	// served with before discovery first succeeds, so a cold start can be
+	// told apart from documents that went stale.
+	initializingStatus int
+	// contentHashHeader adds the published content hash to the documents'
+	// responses, as X-Content-Hash.
+	contentHashHeader bool
+	// deprecation and sunset are the Deprecation and Sunset header values to
+	// serve the documents with, if set, see migrationHeaders.
+	deprecation string
+	sunset      string
+	// oldIssuer is an issuer whose documents are also served until its
+	// cutover, during an issuer migration. The deprecation and sunset
+	// headers then apply to it rather than the current issuer.
+	oldIssuer *oldIssuer
+	// spiffeBundle also serves the keys as a SPIFFE trust bundle, telling
+	// consumers to refresh it every spiffeRefreshHint, see spiffeBundleFor.
+	spiffeBundle      bool
+	spiffeRefreshHint time.Duration
+
+	mu       sync.RWMutex
+	metadata *oidc.ProviderMetadata
+	mdDoc    *document
+	ksDoc    *document
+	// keys is how many keys are in ksDoc, and keySet the set itself.
+	keys   int
+	keySet *jose.JSONWebKeySet
+	// spiffeDoc is the SPIFFE bundle, if served, and spiffeKeys how many
+	// keys it holds.
+	spiffeDoc  *document
+	spiffeKeys int
+	// keyVersions is how many key set versions to retain and serve, 0
+	// disables them. versions are the retained versions, newest first.
+	keyVersions int
+	versions    []keySetVersion
+	// retention caps the keys held in versions across clusters, if set.
+	retention *retentionLimit
+	// issuerDocs caches the metadata rewritten for issuers derived from
+	// forwarded headers, reset with each update.
+	issuerDocs map[string]*document
+}
+
+// maxIssuerDocs bounds the issuers derived from forwarded headers that have
+// their metadata cached. Past this they are still served, just encoded on
+// each request.
+const maxIssuerDocs = 16
+
+// document is an encoded document, ready to be served. Documents are built
+// once per change, so requests don't pay for encoding or compression.
+type document struct {
+	body []byte
+	etag string
+	// gzipped is the gzip compressed body, if compression is enabled.
+	gzipped []byte
+}
+
+// newDocument encodes v, indented if pretty is set. The ETag is of the encoded
+// body, so it changes along with the formatting.
+func newDocument(v any, pretty, compress bool) (*document, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if pretty {
+		b, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{body: b, etag: etagOf(b)}
+	if compress {
+		if doc.gzipped, err = gzipBytes(b); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// etagOf returns a strong ETag for body.
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// gzipBytes compresses b as small as gzip can.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *httpSink) Update(_ context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	mdDoc, err := newDocument(md, h.pretty, h.gzip)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata: %v", err)
+	}
+	ksDoc, err := newDocument(keySetJSON(ks, h.canonicalKeys), h.pretty, h.gzip)
+	if err != nil {
+		return fmt.Errorf("marshaling key set: %v", err)
+	}
+	var (
+		spiffeDoc  *document
+		spiffeKeys int
+	)
+	if h.spiffeBundle {
+		b := spiffeBundleFor(ks, h.spiffeRefreshHint)
+		if spiffeDoc, err = newDocument(b, h.pretty, h.gzip); err != nil {
+			return fmt.Errorf("marshaling SPIFFE bundle: %v", err)
+		}
+		spiffeKeys = len(b.Keys)
+	}
+
+	// the limit takes our lock to evict, so must run after it is released.
+	defer h.retention.enforce()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.metadata = md
+	h.mdDoc = mdDoc
+	h.ksDoc = ksDoc
+	h.keys = len(ks.Keys)
+	h.keySet = ks
+	h.spiffeDoc, h.spiffeKeys = spiffeDoc, spiffeKeys
+	h.issuerDocs = map[string]*document{}
+	if h.keyVersions > 0 {
+		h.addVersion(ksDoc, len(ks.Keys))
+	}
+
+	return nil
+}
+
+// clear drops the published documents, so they aren't served until the next
+// update.
+func (h *httpSink) clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.metadata = nil
+	h.mdDoc = nil
+	h.ksDoc = nil
+	h.keySet = nil
+	h.spiffeDoc = nil
+	h.issuerDocs = nil
+}
+
+// issuer returns the currently published issuer, or an empty string if
+// nothing has been published yet.
+func (h *httpSink) issuer() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.metadata == nil {
+		return ""
+	}
+	return h.metadata.Issuer
+}
+
+// route is an endpoint served over HTTP.
+type route struct {
+	method string
+	// cluster is the name of the cluster the route serves, if any.
+	cluster string
+	// host restricts the route to requests for it, if set.
+	host        string
+	path        string
+	description string
+	handler     http.HandlerFunc
+	// admin routes require the admin token, and are hidden from the route
+	// list for other callers.
+	admin bool
+	// internal routes are for operators rather than relying parties, and are
+	// moved to the admin listener when there is one.
+	internal bool
+}
+
+// documentPaths returns the paths the documents are served at, under
+// pathPrefix, or those mapped for the issuer if set.
+func documentPaths(pathPrefix string, mapped *issuerPaths) (metadataPath, jwksPath string) {
+	if mapped != nil {
+		return mapped.MetadataPath, mapped.JWKSPath
+	}
+	return pathPrefix + "/.well-known/openid-configuration", pathPrefix + "/.well-known/jwks.json"
+}
+
+// routes returns the endpoints serving the sink's documents, for host and
+// under pathPrefix, or at the paths mapped for the issuer if set.
+func (h *httpSink) routes(cluster, host, pathPrefix string, mapped *issuerPaths) []route {
+	metadataPath, jwksPath := documentPaths(pathPrefix, mapped)
+	metadataHandler := func(w http.ResponseWriter, r *http.Request) {
+		// a mapped issuer is given exactly, so there's nothing to derive
+		// from the request.
+		h.serveMetadata(w, r, pathPrefix, mapped == nil)
+	}
+	routes := []route{
+		{
+			method:      http.MethodGet,
+			cluster:     cluster,
+			host:        host,
+			path:        metadataPath,
+			description: "OIDC discovery document",
+			handler:     h.withMigrationHeaders(metadataHandler),
+		},
+		{
+			method:      http.MethodGet,
+			cluster:     cluster,
+			host:        host,
+			path:        jwksPath,
+			description: "JSON Web Key Set used to verify service account tokens",
+			handler:     h.withMigrationHeaders(h.serveJWKS),
+		},
+	}
+	if h.keyVersions > 0 {
+		routes = append(routes, h.versionRoutes(cluster, host, jwksPath)...)
+	}
+	if h.spiffeBundle {
+		routes = append(routes, h.spiffeBundleRoute(cluster, host, jwksPath))
+	}
+	if h.oldIssuer != nil {
+		routes = append(routes, h.oldIssuerRoutes(cluster)...)
+	}
+	return routes
+}
+
+// withMigrationHeaders adds the Deprecation and Sunset headers to next's
+// responses, if configured.
+func (h *httpSink) withMigrationHeaders(next http.HandlerFunc) http.HandlerFunc {
+	// during an issuer migration the headers are about the old issuer, so
+	// only its routes get them.
+	if h.oldIssuer != nil || (h.deprecation == "" && h.sunset == "") {
+		return next
+	}
+	return h.migrationHeaderHandler(next)
+}
+
+// migrationHeaderHandler adds the Deprecation and Sunset headers to next's
+// responses.
+func (h *httpSink) migrationHeaderHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.deprecation != "" {
+			w.Header().Set("Deprecation", h.deprecation)
+		}
+		if h.sunset != "" {
+			w.Header().Set("Sunset", h.sunset)
+		}
+		next(w, r)
+	}
+}
+
+// migrationHeaders returns the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// header values for an issuer deprecated at deprecation and going away at
+// sunset, both RFC 3339 timestamps. Either may be empty to omit its header.
+func migrationHeaders(deprecation, sunset string) (deprecationHeader, sunsetHeader string, _ error) {
+	var dt, st time.Time
+	if deprecation != "" {
+		t, err := time.Parse(time.RFC3339, deprecation)
+		if err != nil {
+			return "", "", fmt.Errorf("deprecation %q is not an RFC 3339 timestamp, e.g. 2025-01-02T15:04:05Z", deprecation)
+		}
+		dt = t
+		deprecationHeader = "@" + strconv.FormatInt(t.Unix(), 10)
+	}
+	if sunset != "" {
+		t, err := time.Parse(time.RFC3339, sunset)
+		if err != nil {
+			return "", "", fmt.Errorf("sunset %q is not an RFC 3339 timestamp, e.g. 2025-01-02T15:04:05Z", sunset)
+		}
+		st = t
+		sunsetHeader = t.UTC().Format(http.TimeFormat)
+	}
+	if !dt.IsZero() && !st.IsZero() && st.Before(dt) {
+		return "", "", fmt.Errorf("sunset %s is before deprecation %s", sunset, deprecation)
+	}
+	return deprecationHeader, sunsetHeader, nil
+}
+
+// httpServer serves each cluster's documents for its host and path prefix,
+// along with the process wide health, readiness and metrics endpoints.
+type httpServer struct {
+	clusters []*cluster
+	// adminToken is the bearer token required for admin routes. If empty,
+	// admin routes are not served.
+	adminToken string
+	// audit records access to admin routes, separately from the access log.
+	audit *slog.Logger
+	// separateAdmin moves the internal routes from handler to adminHandler.
+	separateAdmin bool
+	// trustForwarded takes the request's public host and scheme from the
+	// Forwarded or X-Forwarded-* headers, for routing and the served issuer.
+	trustForwarded bool
+	// debugEndpoints serves the read only /debug endpoints, and
+	// adminEndpoints the ones that change state. Both require adminToken.
+	debugEndpoints bool
+	adminEndpoints bool
+	// refreshTimeout bounds the discoveries triggered by /debug/refresh, if
+	// positive. They're cancelled along with the request either way.
+	refreshTimeout time.Duration
+	// openMetrics serves metrics in the OpenMetrics format whatever the
+	// scraper accepts. Otherwise it's negotiated from the Accept header.
+	openMetrics bool
+	// maintenance serves the documents and readiness as 503s, while
+	// discovery carries on. It's set by -maintenance and the admin
+	// endpoints. maintenanceRetryAfter is when clients are told to retry.
+	maintenance           atomic.Bool
+	maintenanceRetryAfter time.Duration
+	// shuttingDown reports not ready, so load balancers stop sending us
+	// requests before the server shuts down.
+	shuttingDown atomic.Bool
+	// combined serves every cluster's keys as one key set, if set.
+	combined *combinedJWKS
+	// statusPage serves an HTML status page at /, for operators.
+	statusPage bool
+	// errorBodies replaces the bodies of errors served to relying parties,
+	// if set.
+	errorBodies *errorBodies
+	// gatherer gathers the metrics served at /metrics.
+	gatherer prometheus.Gatherer
+	// limiter sheds requests to handler over -rate-limit. The admin
+	// listener isn't limited, it's only reachable by our infrastructure.
+	limiter *rateLimiter
+}
+
+// openMetricsAccept is the Accept header requesting the OpenMetrics format.
+const openMetricsAccept = "application/openmetrics-text; version=1.0.0"
+
+// metricsHandler serves the metrics, negotiating the OpenMetrics format or
+// forcing it if s.openMetrics is set.
+func (s *httpServer) metricsHandler() http.HandlerFunc {
+	h := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(s.gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	if !s.openMetrics {
+		return h.ServeHTTP
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept", openMetricsAccept)
+		h.ServeHTTP(w, r)
+	}
+}
+
+func (s *httpServer) routes() []route {
+	routes := []route{
+		{
+			method:      http.MethodGet,
+			path:        "/healthz",
+			description: "Liveness check",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+			},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/readyz",
+			description: "Readiness check, including the published issuer and JWKS URI",
+			handler:     s.serveReadyz,
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/metrics",
+			description: "Prometheus metrics",
+			handler:     s.metricsHandler(),
+			internal:    true,
+		},
+	}
+	if s.statusPage {
+		routes = append(routes, route{
+			method:      http.MethodGet,
+			path:        "/{$}",
+			description: "HTML status page, for operators",
+			handler:     s.serveStatusPage,
+			internal:    true,
+		})
+	}
+	if s.debugEndpoints {
+		routes = append(routes, s.debugRoutes()...)
+	}
+	if s.adminEndpoints {
+		routes = append(routes, s.adminRoutes()...)
+		routes = append(routes, s.maintenanceRoutes()...)
+	}
+	for _, c := range s.clusters {
+		for _, rt := range c.sink.routes(c.name, c.host, c.pathPrefix, c.mappedPaths) {
+			rt.handler = s.unlessMaintenance(rt.handler)
+			routes = append(routes, rt)
+		}
+	}
+	if s.combined != nil {
+		rt := s.combined.route()
+		rt.handler = s.unlessMaintenance(rt.handler)
+		routes = append(routes, rt)
+	}
+	return routes
+}
+
+// debugRoutes returns the read only endpoints for inspecting the publisher.
+func (s *httpServer) debugRoutes() []route {
+	return []route{
+		{
+			method:      http.MethodGet,
+			path:        "/debug/upstream",
+			description: "The API server's discovery document as last fetched, before rewriting. Select the cluster with ?cluster=name when serving several",
+			handler:     s.serveUpstream,
+			admin:       true,
+			internal:    true,
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/debug/validation",
+			description: "Problems found validating the published metadata against OpenID Connect Discovery, and which fields were injected by the -*-supported flags. Select the cluster with ?cluster=name when serving several",
+			handler:     s.serveValidation,
+			admin:       true,
+			internal:    true,
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/debug/errors",
+			description: "The most recent discovery errors, newest first, as many as -error-history keeps. Select the cluster with ?cluster=name when serving several",
+			handler:     s.serveErrors,
+			admin:       true,
+			internal:    true,
+		},
+	}
+}
+
+// adminRoutes returns the endpoints that change the publisher's state.
+func (s *httpServer) adminRoutes() []route {
+	return []route{
+		{
+			method:      http.MethodPost,
+			path:        "/debug/expire",
+			description: "Expire the served documents until the next successful refresh, for failure drills. ?mode=stale (the default) serves them as stale, ?mode=clear stops serving them. Select the cluster with ?cluster=name when serving several",
+			handler:     s.serveExpire,
+			admin:       true,
+			internal:    true,
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/debug/refresh",
+			description: "Discover and publish the documents now, rather than at the next scheduled refresh, responding with the result. Select the cluster with ?cluster=name when serving several",
+			handler:     s.serveRefresh,
+			admin:       true,
+			internal:    true,
+		},
+	}
+}
+
+// handler returns a handler serving the routes, plus an index of them at
+// /routes. Requests matching no cluster's host and path prefix get a 404.
+func (s *httpServer) handler() http.Handler {
+	routes := s.routes()
+	if s.separateAdmin {
+		routes = slices.DeleteFunc(routes, func(rt route) bool { return rt.internal })
+	}
+	return s.serve(routes, s.limiter)
+}
+
+// adminHandler returns a handler serving only the internal routes, for the
+// admin listener.
+func (s *httpServer) adminHandler() http.Handler {
+	routes := slices.DeleteFunc(s.routes(), func(rt route) bool { return !rt.internal })
+	return s.serve(routes, nil)
+}
+
+func (s *httpServer) serve(routes []route, limiter *rateLimiter) http.Handler {
+	routes = append(routes, route{
+		method:      http.MethodGet,
+		path:        "/routes",
+		description: "This list of routes",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			serveRoutes(w, routes, s.isAdmin(r))
+		},
+	})
+	if s.adminToken == "" {
+		routes = slices.DeleteFunc(routes, func(rt route) bool { return rt.admin })
+	}
+
+	mux := http.NewServeMux()
+	clusters := map[string]string{}
+	internal := map[string]bool{}
+	var paths []string
+	allowed := map[string][]string{}
+	for _, rt := range routes {
+		handler := rt.handler
+		if rt.admin {
+			handler = s.requireAdmin(handler)
+		}
+		pattern := rt.method + " " + muxPath(rt.host, rt.path)
+		mux.HandleFunc(pattern, handler)
+		clusters[pattern] = rt.cluster
+		internal[pattern] = rt.internal
+
+		p := muxPath(rt.host, rt.path)
+		if _, ok := allowed[p]; !ok {
+			paths = append(paths, p)
+		}
+		allowed[p] = append(allowed[p], rt.method)
+		if rt.method == http.MethodGet {
+			// the mux serves HEAD with GET handlers.
+			allowed[p] = append(allowed[p], http.MethodHead)
+		}
+	}
+	// answer OPTIONS with the methods each path supports, as the mux
+	// already does in the Allow header of its 405s.
+	for _, p := range paths {
+		allow := strings.Join(append(allowed[p], http.MethodOptions), ", ")
+		pattern := http.MethodOptions + " " + p
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		})
+		clusters[pattern] = clusters[http.MethodGet+" "+p]
+		internal[pattern] = internal[http.MethodGet+" "+p]
+	}
+
+	eb := s.errorBodies
+	if eb == nil {
+		eb = &errorBodies{}
+	}
+	var handler http.Handler = eb.wrap(internal, limiter.wrap(mux))
+	if s.trustForwarded {
+		handler = forwarded(handler)
+	}
+
+	return requestID(instrument(clusters, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the documents themselves are cacheable, and they opt in once
+		// there is real data to serve. Everything else, including the
+		// mux's 404 and 405 responses, must not be cached by a CDN.
+		w.Header().Set("Cache-Control", "no-store")
+		handler.ServeHTTP(w, r)
+	})))
+}
+
+// muxPath returns the part of a ServeMux pattern matching host and p exactly.
+// Each of p's segments is escaped, so e.g. an issuer path holding braces is
+// matched literally rather than registered as a wildcard, which the mux would
+// reject or panic on. The mux unescapes them again when matching.
+func muxPath(host, p string) string {
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return host + strings.Join(segs, "/")
+}
+
+// isAdmin reports whether r carries the admin bearer token.
+func (s *httpServer) isAdmin(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(s.adminToken)) == 1
+}
+
+// requireAdmin rejects requests without the admin token, and records an audit
+// event for every request either way.
+func (s *httpServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authenticated := s.isAdmin(r)
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		if authenticated {
+			next(rw, r)
+		} else {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(rw, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		}
+
+		outcome := "success"
+		switch {
+		case !authenticated:
+			outcome = "denied"
+		case rw.status >= 400:
+			outcome = "failure"
+		}
+		sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			sourceIP = r.RemoteAddr
+		}
+		// the token is never logged, only whether it was accepted.
+		s.audit.Info("admin access",
+			"request-id", requestIDFromContext(r.Context()),
+			"source-ip", sourceIP,
+			"authenticated", authenticated,
+			"action", r.Pattern,
+			"status", rw.status,
+			"outcome", outcome,
+		)
+	}
+}
+
+func serveRoutes(w http.ResponseWriter, routes []route, admin bool) {
+	type routeJSON struct {
+		Method      string `json:"method"`
+		Host        string `json:"host,omitempty"`
+		Path        string `json:"path"`
+		Description string `json:"description"`
+	}
+	resp := struct {
+		Routes []routeJSON `json:"routes"`
+	}{}
+	for _, rt := range routes {
+		if rt.admin && !admin {
+			continue
+		}
+		resp.Routes = append(resp.Routes, routeJSON{Method: rt.method, Host: rt.host, Path: rt.path, Description: rt.description})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// stale reports whether the documents are stale, see staleness.
+func (h *httpSink) stale() bool {
+	return h.isStale(h.state)
+}
+
+// serveMetadata serves the metadata document. If the request came through a
+// trusted proxy and deriveIssuer is set, the issuer is derived from its public
+// origin and pathPrefix.
+func (h *httpSink) serveMetadata(w http.ResponseWriter, r *http.Request, pathPrefix string, deriveIssuer bool) {
+	h.mu.RLock()
+	doc, md := h.mdDoc, h.metadata
+	h.mu.RUnlock()
+
+	if origin := publicOriginFromContext(r.Context()); deriveIssuer && origin != "" && md != nil && origin+pathPrefix != md.Issuer {
+		d, err := h.issuerDocument(md, origin+pathPrefix)
+		if err != nil {
+			slog.Error("Failed to build metadata for forwarded issuer", "issuer", origin+pathPrefix, "error", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		doc = d
+	}
+	stale, _ := h.documentsStale(h.state)
+	h.serveDocument(w, r, "application/json", doc, stale)
+}
+
+// issuerDocument returns md rewritten for issuer.
+func (h *httpSink) issuerDocument(md *oidc.ProviderMetadata, issuer string) (*document, error) {
+	h.mu.RLock()
+	doc, ok := h.issuerDocs[issuer]
+	h.mu.RUnlock()
+	if ok {
+		return doc, nil
+	}
+
+	imd := *md
+	imd.Issuer = issuer
+	rewritten, err := publicMetadata(&imd)
+	if err != nil {
+		return nil, err
+	}
+	doc, err = newDocument(rewritten, h.pretty, h.gzip)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	// don't cache against metadata that has since been replaced.
+	if h.metadata == md && len(h.issuerDocs) < maxIssuerDocs {
+		h.issuerDocs[issuer] = doc
+	}
+	h.mu.Unlock()
+	return doc, nil
+}
+
+func (h *httpSink) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	doc, keys := h.ksDoc, h.keys
+	h.mu.RUnlock()
+
+	// judged on its own, a key set that can't verify anything isn't fit to
+	// serve.
+	if h.independent && doc != nil && keys == 0 {
+		h.setRetryAfter(w)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no keys"})
+		return
+	}
+	_, stale := h.documentsStale(h.state)
+	h.serveDocument(w, r, h.jwksContentType, doc, stale)
+}
+
+// The states reported when the documents can't be served: initializing until
+// discovery first succeeds, and stale once they've been served but no longer
+// can be.
+const (
+	documentStateInitializing = "initializing"
+	documentStateStale        = "stale"
+)
+
+// serveDocument writes a published document, or an error if it hasn't been
+// published yet or is stale and we're failing closed. Before discovery has
+// ever succeeded that's -initializing-status, otherwise a 503.
+func (h *httpSink) serveDocument(w http.ResponseWriter, r *http.Request, contentType string, doc *document, stale bool) {
+	if doc == nil {
+		h.setRetryAfter(w)
+		if h.state.lastSuccess().IsZero() {
+			writeJSON(w, h.initializingStatus, map[string]string{"error": "not ready", "state": documentStateInitializing})
+			return
+		}
+		// cleared by an operator, which counts as stale.
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "not ready", "state": documentStateStale})
+		return
+	}
+	if !h.failOpen && stale {
+		h.setRetryAfter(w)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "stale", "state": documentStateStale})
+		return
+	}
+	var hash string
+	if h.contentHashHeader {
+		hash = h.state.contentHash()
+	}
+	h.writeDocument(w, r, contentType, doc, hash)
+}
+
+// writeDocument writes doc with the sink's caching and encoding, and hash as
+// the X-Content-Hash if set.
+func (h *httpSink) writeDocument(w http.ResponseWriter, r *http.Request, contentType string, doc *document, hash string) {
+	if h.prettyQuery && prettyRequested(r) {
+		servePretty(w, contentType, doc)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", h.cacheControl())
+	if hash != "" {
+		w.Header().Set("X-Content-Hash", hash)
+	}
+	serveEncoded(w, r, doc, strings.TrimSuffix(doc.etag, `"`)+`-gzip"`)
+}
+
+// serveEncoded writes doc's body, or its gzipped body tagged gzipETag to
+// clients that accept it.
+func serveEncoded(w http.ResponseWriter, r *http.Request, doc *document, gzipETag string) {
+	body, etag := doc.body, doc.etag
+	if doc.gzipped != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			// the representation differs, so must the tag.
+			body, etag = doc.gzipped, gzipETag
+		}
+	}
+	w.Header().Set("ETag", etag)
+	// handles If-None-Match for us.
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// minRetryAfter is the shortest Retry-After sent with a 503, for when a
+// refresh is already due.
+const minRetryAfter = time.Second
+
+// setRetryAfter sets the Retry-After for a 503 to when the next refresh is
+// due, as that's when there may be something to serve, so clients don't retry
+// any sooner.
+func (h *httpSink) setRetryAfter(w http.ResponseWriter) {
+	wait := max(time.Until(h.state.nextRefresh()), minRetryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// prettyRequested reports whether r asks for an indented document with
+// ?pretty=1.
+func prettyRequested(r *http.Request) bool {
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
+
+// servePretty writes doc indented, for reading by hand. It's indented per
+// request, and isn't cached so these responses can't be confused with the
+// standard ones.
+func servePretty(w http.ResponseWriter, contentType string, doc *document) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, doc.body, "", "  "); err != nil {
+		slog.Error("Failed to indent document", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	buf.WriteByte('\n')
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
+
+// cacheControl returns the Cache-Control header for the documents.
+func (h *httpSink) cacheControl() string {
+	cc := fmt.Sprintf("public, max-age=%d", int(h.cacheMaxAge.Seconds()))
+	if h.staleWhileRevalidate > 0 {
+		cc += fmt.Sprintf(", stale-while-revalidate=%d", int(h.staleWhileRevalidate.Seconds()))
+	}
+	return cc
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for enc := range strings.SplitSeq(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestCluster returns the cluster named by the request's cluster query
+// parameter, which may be omitted when there is only one. If there is no such
+// cluster a 404 is written and nil returned.
+func (s *httpServer) requestCluster(w http.ResponseWriter, r *http.Request) *cluster {
+	name := r.URL.Query().Get("cluster")
+	if name == "" && len(s.clusters) == 1 {
+		return s.clusters[0]
+	}
+	for _, c := range s.clusters {
+		if c.name == name {
+			return c
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown cluster %q", name)})
+	return nil
+}
+
+func (s *httpServer) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	if c := s.requestCluster(w, r); c != nil {
+		c.sink.serveUpstream(w, r)
+	}
+}
+
+func (s *httpServer) serveValidation(w http.ResponseWriter, r *http.Request) {
+	c := s.requestCluster(w, r)
+	if c == nil {
+		return
+	}
+	problems := c.sink.state.validationProblems()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"valid":    len(problems) == 0,
+		"problems": problems,
+		// so it's clear which fields the upstream didn't provide.
+		"injected": c.sink.state.injectedFields(),
+	})
+}
+
+func (s *httpServer) serveErrors(w http.ResponseWriter, r *http.Request) {
+	c := s.requestCluster(w, r)
+	if c == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"errors": c.sink.state.recentErrors()})
+}
+
+// expire modes, see serveExpire.
+const (
+	expireModeStale = "stale"
+	expireModeClear = "clear"
+)
+
+// serveExpire expires a cluster's documents as if discovery had been failing,
+// so operators can check how relying parties handle it without breaking the
+// API server connection. Normal service resumes with the next successful
+// refresh.
+func (s *httpServer) serveExpire(w http.ResponseWriter, r *http.Request) {
+	c := s.requestCluster(w, r)
+	if c == nil {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = expireModeStale
+	}
+	switch mode {
+	case expireModeStale:
+	case expireModeClear:
+		c.sink.clear()
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("mode must be %s or %s, got %q", expireModeStale, expireModeClear, mode)})
+		return
+	}
+	c.pub.expire()
+	c.pub.log.Warn("Documents expired by operator, until the next successful refresh", "mode", mode)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "expired", "mode": mode})
+}
+
+// serveRefresh refreshes the cluster's documents under the request's context,
+// so a discovery that outlives the admin client, or refreshTimeout, is
+// cancelled rather than left running.
+func (s *httpServer) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	c := s.requestCluster(w, r)
+	if c == nil {
+		return
+	}
+	ctx := r.Context()
+	if s.refreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.refreshTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := c.pub.refresh(ctx)
+	switch {
+	case err == nil:
+		c.pub.log.Info("Documents refreshed by operator", "duration", time.Since(start))
+		writeJSON(w, http.StatusOK, map[string]string{"status": "refreshed", "content_hash": c.pub.contentHash()})
+	case r.Context().Err() != nil:
+		// there's no one left to tell.
+		c.pub.log.Warn("Refresh by operator cancelled, the admin client went away", "duration", time.Since(start), "error", err)
+	case ctx.Err() != nil:
+		c.pub.log.Error("Refresh by operator timed out", "timeout", s.refreshTimeout, "error", err)
+		writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": fmt.Sprintf("refresh timed out after %s: %v", s.refreshTimeout, err)})
+	default:
+		c.pub.log.Error("Refresh by operator failed", "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+	}
+}
+
+func (h *httpSink) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	b := h.state.lastUpstream()
+	if b == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "not ready"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
+
+// readiness is a sink's status, as reported by /readyz.
+type readiness struct {
+	Status  string `json:"status"`
+	Issuer  string `json:"issuer,omitempty"`
+	JWKSURI string `json:"jwks_uri,omitempty"`
+}
+
+// readiness reports whether the sink is ready to serve, along with the issuer
+// and JWKS URI that are being published so they can be checked without
+// fetching the full discovery document.
+func (h *httpSink) readiness() (readiness, bool) {
+	h.mu.RLock()
+	md := h.metadata
+	h.mu.RUnlock()
+
+	if md == nil {
+		if h.state.lastSuccess().IsZero() {
+			return readiness{Status: documentStateInitializing}, false
+		}
+		return readiness{Status: "not ready"}, false
+	}
+
+	rd := readiness{Status: "ok", Issuer: md.Issuer, JWKSURI: md.JWKSURI}
+	if h.stale() {
+		// when failing open we're still serving, so stay ready.
+		rd.Status = "stale"
+	}
+	if h.unreadyOnFailure && h.state.failing() {
+		rd.Status = "failing"
+	}
+	return rd, h.ready(h.state)
+}
+
+// outOfRotation returns why we're out of rotation regardless of the
+// documents, "maintenance" or "shutting down", or "" if we aren't. A nil
+// server, when nothing is served over HTTP, never is.
+func (s *httpServer) outOfRotation() string {
+	switch {
+	case s == nil:
+		return ""
+	case s.shuttingDown.Load():
+		return "shutting down"
+	case s.maintenance.Load():
+		return "maintenance"
+	}
+	return ""
+}
+
+// readyToServe reports whether we're ready to serve, the one predicate behind
+// both /readyz and -ready-file: never while out of rotation, and otherwise only
+// when every cluster's documents are ready, as judged by st.
+func (s *httpServer) readyToServe(clusters []*cluster, st staleness) bool {
+	if s.outOfRotation() != "" {
+		return false
+	}
+	for _, c := range clusters {
+		if !st.ready(c.pub) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveReadyz reports readiness. With a single cluster its status is reported
+// directly, otherwise we're only ready when every cluster is, and each is
+// reported by name. We're never ready in maintenance mode or when shutting
+// down.
+func (s *httpServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	switch s.outOfRotation() {
+	case "shutting down":
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	case "maintenance":
+		// out of rotation until maintenance is over.
+		s.serveMaintenanceResponse(w)
+		return
+	}
+	if len(s.clusters) == 1 {
+		h := s.clusters[0].sink
+		rd, ok := h.readiness()
+		writeJSON(w, h.readyzCode(ok, rd.Status == documentStateInitializing), rd)
+		return
+	}
+
+	resp := struct {
+		Status   string               `json:"status"`
+		Clusters map[string]readiness `json:"clusters"`
+	}{Status: "ok", Clusters: map[string]readiness{}}
+	allOK, initializing := true, true
+	for _, c := range s.clusters {
+		rd, ok := c.sink.readiness()
+		resp.Clusters[c.name] = rd
+		allOK = allOK && ok
+		// we're only initializing if that's all that's keeping us from
+		// being ready.
+		initializing = initializing && (ok || rd.Status == documentStateInitializing)
+	}
+	if !allOK {
+		resp.Status = "not ready"
+		if initializing {
+			resp.Status = documentStateInitializing
+		}
+	}
+	writeJSON(w, s.clusters[0].sink.readyzCode(allOK, initializing), resp)
+}
+
+// readyzCode returns the /readyz status, -initializing-status if we're not
+// ready only because discovery has yet to succeed.
+func (h *httpSink) readyzCode(ok, initializing bool) int {
+	switch {
+	case ok:
+		return http.StatusOK
+	case initializing:
+		return h.initializingStatus
+	}
+	return http.StatusServiceUnavailable
+}
+
+// issuerPath returns the path component of the issuer URL, without a trailing
+// slash. This is where relying parties will look for the discovery document,
+// e.g. https://example.com/clusters/foo is discovered at
+// /clusters/foo/.well-known/openid-configuration. A root issuer returns an empty
+// string.
+func issuerPath(issuer string) (string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "", fmt.Errorf("parsing issuer %q: %v", issuer, err)
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	// requests are cleaned before they're routed, so anything else could
+	// never be matched.
+	if p != "" && path.Clean(p) != p {
+		return "", fmt.Errorf("issuer %q has path %q, which isn't clean so can't be served", issuer, u.Path)
+	}
+	return p, nil
+}
+
+// defaultAdminListen is where /metrics and the admin endpoints are served
+// unless -admin-on-listen moves them to -listen. It's loopback only, so
+// exposing them beyond the host has to be asked for.
+const defaultAdminListen = "127.0.0.1:9090"
+
+// adminListenAddr resolves the admin listener's address. An address without a
+// host, e.g. :9090 or 9090, binds to loopback so the operational endpoints are
+// only exposed when asked for explicitly. exposed reports whether the address
+// is reachable off the host.
+func adminListenAddr(addr string) (_ string, exposed bool, _ error) {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	loopback := host == "localhost" || (ip != nil && ip.IsLoopback())
+	return net.JoinHostPort(host, port), !loopback, nil
+}
+
+// validateMIMEType checks that s is a well-formed type/subtype media type,
+// optionally with parameters.
+func validateMIMEType(s string) error {
+	mt, _, err := mime.ParseMediaType(s)
+	if err != nil {
+		return fmt.Errorf("parsing %q: %v", s, err)
+	}
+	if typ, sub, ok := strings.Cut(mt, "/"); !ok || typ == "" || sub == "" || strings.Contains(sub, "/") {
+		return fmt.Errorf("%q is not of the form type/subtype", s)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
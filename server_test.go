@@ -0,0 +1,949 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"lds.li/oauth2ext/oidc"
+)
+
+// newTestCluster returns a cluster serving documents for issuer, published as
+// if discovery just succeeded.
+func newTestCluster(t testing.TB, name, issuer string, keys ...jose.JSONWebKey) *cluster {
+	t.Helper()
+	p := &publisher{cluster: name, lastDiscovery: time.Now()}
+	sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable}
+	md, err := publicMetadata(&oidc.ProviderMetadata{Issuer: issuer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Update(context.Background(), md, &jose.JSONWebKeySet{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+	return &cluster{name: name, pub: p, sink: sink}
+}
+
+// get makes a GET request for target to h, returning the response.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestIssuerPath(t *testing.T) {
+	for _, tc := range []struct {
+		issuer    string
+		want      string
+		wantError bool
+	}{
+		{issuer: "https://example.com", want: ""},
+		{issuer: "https://example.com/", want: ""},
+		{issuer: "https://example.com/clusters/foo", want: "/clusters/foo"},
+		{issuer: "https://example.com/clusters/foo/", want: "/clusters/foo"},
+		{issuer: "https://example.com/a/b/c/d", want: "/a/b/c/d"},
+		{issuer: "https://example.com/team/{name}", want: "/team/{name}"},
+		{issuer: "https://example.com/clusters/a%20b", want: "/clusters/a b"},
+		{issuer: "https://example.com/a//b", wantError: true},
+		{issuer: "https://example.com/a/../b", wantError: true},
+		{issuer: "https://example.com/a/./b", wantError: true},
+	} {
+		t.Run(tc.issuer, func(t *testing.T) {
+			got, err := issuerPath(tc.issuer)
+			if tc.wantError {
+				if err == nil {
+					t.Fatalf("issuerPath = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("issuerPath = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServeIssuerPath(t *testing.T) {
+	for _, issuer := range []string{
+		"https://example.com/clusters/foo",
+		"https://example.com/a/b/c/d",
+		"https://example.com/team/{name}",
+		"https://example.com/team/{name...}",
+		"https://example.com/{$}",
+		"https://example.com/100%25/x",
+		"https://example.com/clusters/a%20b",
+	} {
+		t.Run(issuer, func(t *testing.T) {
+			c := newTestCluster(t, "default", issuer, testKey(t, "a"))
+			p, err := issuerPath(issuer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.pathPrefix = p
+			h := (&httpServer{clusters: []*cluster{c}}).handler()
+
+			u, err := url.Parse(issuer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := get(h, u.EscapedPath()+"/.well-known/openid-configuration")
+			if w.Code != http.StatusOK {
+				t.Fatalf("discovery document served with status %d, want 200: %s", w.Code, w.Body)
+			}
+			var md oidc.ProviderMetadata
+			if err := json.Unmarshal(w.Body.Bytes(), &md); err != nil {
+				t.Fatal(err)
+			}
+			if md.Issuer != issuer {
+				t.Errorf("issuer = %q, want %q", md.Issuer, issuer)
+			}
+
+			// the published jwks_uri must be where the key set is served.
+			ju, err := url.Parse(md.JWKSURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := u.Path + "/.well-known/jwks.json"; ju.Host != u.Host || ju.Path != want {
+				t.Errorf("jwks_uri %q isn't at %s%s", md.JWKSURI, u.Host, want)
+			}
+			if w := get(h, ju.EscapedPath()); w.Code != http.StatusOK {
+				t.Errorf("key set at %s served with status %d, want 200", ju.EscapedPath(), w.Code)
+			}
+			if err := checkJWKSURIServed([]*cluster{c}); err != nil {
+				t.Errorf("checkJWKSURIServed: %v", err)
+			}
+
+			// only the issuer's path serves the documents.
+			if w := get(h, "/.well-known/openid-configuration"); w.Code != http.StatusNotFound {
+				t.Errorf("root discovery document served with status %d, want 404", w.Code)
+			}
+			if w := get(h, "/other"+u.EscapedPath()+"/.well-known/openid-configuration"); w.Code != http.StatusNotFound {
+				t.Errorf("discovery document under another path served with status %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestServeIssuerPathsSideBySide(t *testing.T) {
+	var clusters []*cluster
+	for _, name := range []string{"a", "b"} {
+		c := newTestCluster(t, name, "https://example.com/clusters/"+name, testKey(t, name))
+		c.pathPrefix = "/clusters/" + name
+		clusters = append(clusters, c)
+	}
+	if err := checkClusterRoutes(clusters); err != nil {
+		t.Fatal(err)
+	}
+	h := (&httpServer{clusters: clusters}).handler()
+
+	for _, name := range []string{"a", "b"} {
+		w := get(h, "/clusters/"+name+"/.well-known/jwks.json")
+		if w.Code != http.StatusOK {
+			t.Fatalf("cluster %s key set served with status %d", name, w.Code)
+		}
+		var ks jose.JSONWebKeySet
+		if err := json.Unmarshal(w.Body.Bytes(), &ks); err != nil {
+			t.Fatal(err)
+		}
+		if len(ks.Key(name)) != 1 {
+			t.Errorf("cluster %s served the wrong key set: %s", name, w.Body)
+		}
+	}
+}
+
+func TestStaleMode(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failOpen  bool
+		age       time.Duration
+		wantDocs  int
+		wantReady int
+	}{
+		{name: "fail-closed fresh", age: time.Minute, wantDocs: http.StatusOK, wantReady: http.StatusOK},
+		{name: "fail-closed stale", age: 2 * time.Hour, wantDocs: http.StatusServiceUnavailable, wantReady: http.StatusServiceUnavailable},
+		{name: "fail-open fresh", failOpen: true, age: time.Minute, wantDocs: http.StatusOK, wantReady: http.StatusOK},
+		{name: "fail-open stale", failOpen: true, age: 2 * time.Hour, wantDocs: http.StatusOK, wantReady: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+			c.sink.staleness = staleness{staleAfter: time.Hour, failOpen: tc.failOpen}
+			// as if discovery last succeeded age ago.
+			c.pub.lastDiscovery = time.Now().Add(-tc.age)
+			h := (&httpServer{clusters: []*cluster{c}}).handler()
+
+			for _, p := range []string{"/.well-known/openid-configuration", "/.well-known/jwks.json"} {
+				w := get(h, p)
+				if w.Code != tc.wantDocs {
+					t.Errorf("%s served with status %d, want %d", p, w.Code, tc.wantDocs)
+				}
+				if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+					t.Errorf("%s stale 503 has no Retry-After", p)
+				}
+			}
+			w := get(h, "/readyz")
+			if w.Code != tc.wantReady {
+				t.Errorf("/readyz = %d, want %d", w.Code, tc.wantReady)
+			}
+			var rd readiness
+			if err := json.Unmarshal(w.Body.Bytes(), &rd); err != nil {
+				t.Fatal(err)
+			}
+			if wantStale := tc.age > time.Hour; (rd.Status == documentStateStale) != wantStale {
+				t.Errorf("/readyz status %q, want stale reported: %t", rd.Status, wantStale)
+			}
+		})
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	const (
+		mdPath   = "/.well-known/openid-configuration"
+		jwksPath = "/.well-known/jwks.json"
+	)
+	for _, tc := range []struct {
+		name string
+		// setup adjusts a cluster that has published its documents.
+		setup    func(c *cluster)
+		path     string
+		wantCode int
+		wantCC   string
+	}{
+		{name: "metadata", path: mdPath, wantCode: http.StatusOK, wantCC: "public, max-age=300"},
+		{name: "key set", path: jwksPath, wantCode: http.StatusOK, wantCC: "public, max-age=300"},
+		{
+			name:     "stale-while-revalidate",
+			setup:    func(c *cluster) { c.sink.staleWhileRevalidate = time.Minute },
+			path:     jwksPath,
+			wantCode: http.StatusOK,
+			wantCC:   "public, max-age=300, stale-while-revalidate=60",
+		},
+		{
+			name: "initializing",
+			setup: func(c *cluster) {
+				c.pub.lastDiscovery = time.Time{}
+				c.sink.mdDoc, c.sink.ksDoc = nil, nil
+			},
+			path:     jwksPath,
+			wantCode: http.StatusServiceUnavailable,
+			wantCC:   "no-store",
+		},
+		{
+			name: "stale",
+			setup: func(c *cluster) {
+				c.sink.staleAfter = time.Hour
+				c.pub.lastDiscovery = time.Now().Add(-2 * time.Hour)
+			},
+			path:     mdPath,
+			wantCode: http.StatusServiceUnavailable,
+			wantCC:   "no-store",
+		},
+		{name: "not found", path: "/.well-known/other", wantCode: http.StatusNotFound, wantCC: "no-store"},
+		{name: "readyz", path: "/readyz", wantCode: http.StatusOK, wantCC: "no-store"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+			c.sink.cacheMaxAge = 5 * time.Minute
+			if tc.setup != nil {
+				tc.setup(c)
+			}
+			w := get((&httpServer{clusters: []*cluster{c}}).handler(), tc.path)
+			if w.Code != tc.wantCode {
+				t.Fatalf("%s served with status %d, want %d", tc.path, w.Code, tc.wantCode)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tc.wantCC {
+				t.Errorf("Cache-Control = %q, want %q", got, tc.wantCC)
+			}
+			// only real documents are tagged, so an error can't be
+			// revalidated in to a CDN's cache.
+			if etag := w.Header().Get("ETag"); (etag != "") != (tc.wantCode == http.StatusOK && tc.path != "/readyz") {
+				t.Errorf("ETag = %q on a %d response", etag, w.Code)
+			}
+		})
+	}
+}
+
+// BenchmarkServeJWKS compares encoding the key set for every request, as was
+// done before the encoded documents were cached, against serving the cached
+// bytes.
+func BenchmarkServeJWKS(b *testing.B) {
+	var keys []jose.JSONWebKey
+	for i := range 4 {
+		keys = append(keys, testKey(b, fmt.Sprintf("key-%d", i)))
+	}
+	ks := &jose.JSONWebKeySet{Keys: keys}
+	for _, enc := range []struct {
+		name     string
+		compress bool
+	}{{name: "identity"}, {name: "gzip", compress: true}} {
+		name, compress := enc.name, enc.compress
+		h := &httpSink{cacheMaxAge: time.Minute}
+		r := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+		r.Header.Set("Accept-Encoding", name)
+
+		b.Run(name+"/encode per request", func(b *testing.B) {
+			for b.Loop() {
+				doc, err := newDocument(ks, false, compress)
+				if err != nil {
+					b.Fatal(err)
+				}
+				h.writeDocument(httptest.NewRecorder(), r, "application/json", doc, "")
+			}
+		})
+		b.Run(name+"/cached", func(b *testing.B) {
+			doc, err := newDocument(ks, false, compress)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for b.Loop() {
+				h.writeDocument(httptest.NewRecorder(), r, "application/json", doc, "")
+			}
+		})
+	}
+}
+
+func TestAdminListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr        string
+		want        string
+		wantExposed bool
+	}{
+		{addr: defaultAdminListen, want: "127.0.0.1:9090"},
+		{addr: ":9090", want: "127.0.0.1:9090"},
+		{addr: "9090", want: "127.0.0.1:9090"},
+		{addr: "localhost:9090", want: "localhost:9090"},
+		{addr: "[::1]:9090", want: "[::1]:9090"},
+		{addr: "0.0.0.0:9090", want: "0.0.0.0:9090", wantExposed: true},
+		{addr: "10.0.0.1:9090", want: "10.0.0.1:9090", wantExposed: true},
+	} {
+		got, exposed, err := adminListenAddr(tc.addr)
+		if err != nil {
+			t.Errorf("adminListenAddr(%q): %v", tc.addr, err)
+			continue
+		}
+		if got != tc.want || exposed != tc.wantExposed {
+			t.Errorf("adminListenAddr(%q) = %q, exposed %t, want %q, exposed %t", tc.addr, got, exposed, tc.want, tc.wantExposed)
+		}
+	}
+}
+
+func TestAdminRoutesOffPublicListener(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		separateAdmin bool
+		// wantPublic and wantAdmin are the /metrics status on each listener.
+		wantPublic int
+		wantAdmin  int
+	}{
+		{name: "admin listener", separateAdmin: true, wantPublic: http.StatusNotFound, wantAdmin: http.StatusOK},
+		{name: "admin on listen", wantPublic: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+			s := &httpServer{clusters: []*cluster{c}, separateAdmin: tc.separateAdmin, gatherer: prometheus.NewRegistry()}
+			public := s.handler()
+			if w := get(public, "/metrics"); w.Code != tc.wantPublic {
+				t.Errorf("/metrics on -listen = %d, want %d", w.Code, tc.wantPublic)
+			}
+			// the documents and probes stay public either way.
+			for _, p := range []string{"/.well-known/jwks.json", "/healthz", "/readyz"} {
+				if w := get(public, p); w.Code != http.StatusOK {
+					t.Errorf("%s on -listen = %d, want 200", p, w.Code)
+				}
+			}
+			if !tc.separateAdmin {
+				return
+			}
+			admin := s.adminHandler()
+			if w := get(admin, "/metrics"); w.Code != tc.wantAdmin {
+				t.Errorf("/metrics on -admin-listen = %d, want %d", w.Code, tc.wantAdmin)
+			}
+			if w := get(admin, "/.well-known/jwks.json"); w.Code != http.StatusNotFound {
+				t.Errorf("key set on -admin-listen = %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	c := newTestCluster(t, "default", "https://example.com/clusters/foo", testKey(t, "a"))
+	c.pathPrefix = "/clusters/foo"
+	h := (&httpServer{clusters: []*cluster{c}, adminToken: "token", adminEndpoints: true}).handler()
+
+	for _, tc := range []struct {
+		path      string
+		wantAllow string
+	}{
+		{path: "/clusters/foo/.well-known/openid-configuration", wantAllow: "GET, HEAD, OPTIONS"},
+		{path: "/clusters/foo/.well-known/jwks.json", wantAllow: "GET, HEAD, OPTIONS"},
+		{path: "/healthz", wantAllow: "GET, HEAD, OPTIONS"},
+		{path: "/readyz", wantAllow: "GET, HEAD, OPTIONS"},
+		{path: "/routes", wantAllow: "GET, HEAD, OPTIONS"},
+		{path: "/debug/maintenance", wantAllow: "POST, DELETE, OPTIONS"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, tc.path, nil))
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("OPTIONS = %d, want 204", w.Code)
+			}
+			if got := w.Header().Get("Allow"); got != tc.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tc.wantAllow)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("OPTIONS has a body: %s", w.Body)
+			}
+
+			// other methods are refused, listing the same ones the mux
+			// supports.
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, tc.path, nil))
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("PUT = %d, want 405", w.Code)
+			}
+			if w.Header().Get("Allow") == "" {
+				t.Error("405 has no Allow header")
+			}
+		})
+	}
+
+	// paths we don't serve aren't answered either.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("OPTIONS for an unserved path = %d, want 404", w.Code)
+	}
+}
+
+func TestStaleIndependently(t *testing.T) {
+	const fresh, stale = time.Minute, 2 * time.Hour
+	for _, tc := range []struct {
+		name                 string
+		independent          bool
+		metadataAge, keysAge time.Duration
+		noKeys               bool
+		wantMetadata         int
+		wantKeys             int
+		wantReady            int
+	}{
+		{name: "both fresh", independent: true, metadataAge: fresh, keysAge: fresh, wantMetadata: http.StatusOK, wantKeys: http.StatusOK, wantReady: http.StatusOK},
+		{name: "stale keys", independent: true, metadataAge: fresh, keysAge: stale, wantMetadata: http.StatusOK, wantKeys: http.StatusServiceUnavailable, wantReady: http.StatusServiceUnavailable},
+		{name: "stale metadata", independent: true, metadataAge: stale, keysAge: fresh, wantMetadata: http.StatusServiceUnavailable, wantKeys: http.StatusOK, wantReady: http.StatusServiceUnavailable},
+		{name: "both stale", independent: true, metadataAge: stale, keysAge: stale, wantMetadata: http.StatusServiceUnavailable, wantKeys: http.StatusServiceUnavailable, wantReady: http.StatusServiceUnavailable},
+		{name: "no keys", independent: true, metadataAge: fresh, keysAge: fresh, noKeys: true, wantMetadata: http.StatusOK, wantKeys: http.StatusServiceUnavailable, wantReady: http.StatusOK},
+		// otherwise both follow the last discovery that fully succeeded,
+		// which was fresh.
+		{name: "together", metadataAge: fresh, keysAge: stale, wantMetadata: http.StatusOK, wantKeys: http.StatusOK, wantReady: http.StatusOK},
+		{name: "together with no keys", metadataAge: fresh, keysAge: fresh, noKeys: true, wantMetadata: http.StatusOK, wantKeys: http.StatusOK, wantReady: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var keys []jose.JSONWebKey
+			if !tc.noKeys {
+				keys = append(keys, testKey(t, "a"))
+			}
+			c := newTestCluster(t, "default", "https://example.com", keys...)
+			c.sink.staleness = staleness{staleAfter: time.Hour, independent: tc.independent}
+			now := time.Now()
+			c.pub.lastDiscovery = now.Add(-fresh)
+			c.pub.lastMetadata, c.pub.lastKeys = now.Add(-tc.metadataAge), now.Add(-tc.keysAge)
+			h := (&httpServer{clusters: []*cluster{c}}).handler()
+
+			if w := get(h, "/.well-known/openid-configuration"); w.Code != tc.wantMetadata {
+				t.Errorf("metadata served with status %d, want %d", w.Code, tc.wantMetadata)
+			}
+			if w := get(h, "/.well-known/jwks.json"); w.Code != tc.wantKeys {
+				t.Errorf("key set served with status %d, want %d", w.Code, tc.wantKeys)
+			}
+			if w := get(h, "/readyz"); w.Code != tc.wantReady {
+				t.Errorf("/readyz = %d, want %d", w.Code, tc.wantReady)
+			}
+		})
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "A test counter."}))
+	const (
+		text        = "text/plain; version=0.0.4"
+		openMetrics = "application/openmetrics-text; version=1.0.0"
+	)
+	for _, tc := range []struct {
+		name        string
+		openMetrics bool
+		accept      string
+		want        string
+	}{
+		{name: "default", want: text},
+		{name: "text requested", accept: "text/plain", want: text},
+		{name: "OpenMetrics requested", accept: openMetricsAccept, want: openMetrics},
+		{name: "OpenMetrics preferred", accept: "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5", want: openMetrics},
+		{name: "forced", openMetrics: true, want: openMetrics},
+		{name: "forced over text", openMetrics: true, accept: "text/plain", want: openMetrics},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := (&httpServer{gatherer: reg, openMetrics: tc.openMetrics}).metricsHandler()
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.want) {
+				t.Errorf("Content-Type = %q, want %q", got, tc.want)
+			}
+			if !strings.Contains(w.Body.String(), "test_total") {
+				t.Errorf("metrics don't include the test counter:\n%s", w.Body)
+			}
+			// only OpenMetrics marks the end of the exposition.
+			if got := strings.HasSuffix(w.Body.String(), "# EOF\n"); got != (tc.want == openMetrics) {
+				t.Errorf("body ends with # EOF: %t, want %t", got, tc.want == openMetrics)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// next is when the next refresh is due, relative to now.
+		next time.Duration
+		// initializing serves before discovery has succeeded, rather than
+		// stale documents.
+		initializing bool
+		want         string
+	}{
+		{name: "stale", next: 90 * time.Second, want: "90"},
+		{name: "initializing", next: 90 * time.Second, initializing: true, want: "90"},
+		{name: "rounded up", next: 10*time.Second + 200*time.Millisecond, want: "11"},
+		{name: "overdue", next: -time.Minute, want: "1"},
+		{name: "not scheduled", want: "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+			c.sink.staleness = staleness{staleAfter: time.Hour}
+			c.pub.lastDiscovery = time.Now().Add(-2 * time.Hour)
+			if tc.initializing {
+				c.pub.lastDiscovery = time.Time{}
+				c.sink.mdDoc, c.sink.ksDoc = nil, nil
+			}
+			if tc.next != 0 {
+				c.pub.scheduleNext(tc.next)
+			}
+			h := (&httpServer{clusters: []*cluster{c}}).handler()
+			for _, p := range []string{"/.well-known/openid-configuration", "/.well-known/jwks.json"} {
+				w := get(h, p)
+				if w.Code != http.StatusServiceUnavailable {
+					t.Fatalf("%s served with status %d, want 503", p, w.Code)
+				}
+				if got := w.Header().Get("Retry-After"); got != tc.want {
+					t.Errorf("%s Retry-After = %q, want %q", p, got, tc.want)
+				}
+			}
+		})
+	}
+
+	// the refresh loop keeps it up to date with its schedule.
+	t.Run("refresh schedule", func(t *testing.T) {
+		up := newTestUpstream(t, testKey(t, "a"))
+		up.fail.Store(true)
+		p := &publisher{src: up.source(), log: slog.Default()}
+		sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable}
+		p.addSink("http", sink)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.run(ctx, time.Hour, 0)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+		waitFor(t, "the next refresh to be scheduled", func() bool { return !p.nextRefresh().IsZero() })
+
+		w := get((&httpServer{clusters: []*cluster{{name: "default", pub: p, sink: sink}}}).handler(), "/.well-known/jwks.json")
+		got, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		if err != nil {
+			t.Fatalf("Retry-After %q: %v", w.Header().Get("Retry-After"), err)
+		}
+		if got < 3590 || got > 3600 {
+			t.Errorf("Retry-After = %d, want the hour until the next refresh", got)
+		}
+	})
+}
+
+func TestInitializingAndStaleStates(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		initializingStatus int
+		// setup puts a cluster that has published its documents in to the
+		// state.
+		setup      func(c *cluster)
+		wantCode   int
+		wantState  string
+		wantReadyz int
+	}{
+		{
+			name:               "initializing",
+			initializingStatus: http.StatusServiceUnavailable,
+			setup: func(c *cluster) {
+				c.pub.lastDiscovery = time.Time{}
+				c.sink.mdDoc, c.sink.ksDoc, c.sink.metadata = nil, nil, nil
+			},
+			wantCode:   http.StatusServiceUnavailable,
+			wantState:  documentStateInitializing,
+			wantReadyz: http.StatusServiceUnavailable,
+		},
+		{
+			name:               "initializing with -initializing-status",
+			initializingStatus: http.StatusTooEarly,
+			setup: func(c *cluster) {
+				c.pub.lastDiscovery = time.Time{}
+				c.sink.mdDoc, c.sink.ksDoc, c.sink.metadata = nil, nil, nil
+			},
+			wantCode:   http.StatusTooEarly,
+			wantState:  documentStateInitializing,
+			wantReadyz: http.StatusTooEarly,
+		},
+		{
+			// stale documents are always a 503, whatever the cold start
+			// status.
+			name:               "stale",
+			initializingStatus: http.StatusTooEarly,
+			setup:              func(c *cluster) { c.pub.lastDiscovery = time.Now().Add(-2 * time.Hour) },
+			wantCode:           http.StatusServiceUnavailable,
+			wantState:          documentStateStale,
+			wantReadyz:         http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, "default", "https://example.com", testKey(t, "a"))
+			c.sink.staleness = staleness{staleAfter: time.Hour}
+			c.sink.initializingStatus = tc.initializingStatus
+			tc.setup(c)
+			h := (&httpServer{clusters: []*cluster{c}}).handler()
+
+			for _, p := range []string{"/.well-known/openid-configuration", "/.well-known/jwks.json"} {
+				w := get(h, p)
+				if w.Code != tc.wantCode {
+					t.Errorf("%s served with status %d, want %d", p, w.Code, tc.wantCode)
+				}
+				var body struct {
+					State string `json:"state"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.State != tc.wantState {
+					t.Errorf("%s state %q, want %q", p, body.State, tc.wantState)
+				}
+			}
+			w := get(h, "/readyz")
+			if w.Code != tc.wantReadyz {
+				t.Errorf("/readyz = %d, want %d", w.Code, tc.wantReadyz)
+			}
+			var rd readiness
+			if err := json.Unmarshal(w.Body.Bytes(), &rd); err != nil {
+				t.Fatal(err)
+			}
+			if rd.Status != tc.wantState {
+				t.Errorf("/readyz status %q, want %q", rd.Status, tc.wantState)
+			}
+		})
+	}
+}
+
+// blockingUpstream returns an issuer whose discovery blocks until it's
+// cancelled, signalling inflight when it starts and cancelled when it ends.
+func blockingUpstream(t *testing.T) (src *issuerSource, inflight, cancelled chan struct{}) {
+	t.Helper()
+	inflight, cancelled = make(chan struct{}, 1), make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inflight <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+		select {
+		case cancelled <- struct{}{}:
+		default:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &issuerSource{client: srv.Client(), issuer: srv.URL, path: defaultDiscoveryPath, accept: defaultDiscoveryAccept}, inflight, cancelled
+}
+
+// newRefreshServer returns an admin server refreshing from src, and the
+// publisher it refreshes.
+func newRefreshServer(t *testing.T, src discoverySource, timeout time.Duration) (*httptest.Server, *httpServer) {
+	t.Helper()
+	p := &publisher{cluster: "default", src: src, log: slog.Default()}
+	sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable}
+	p.addSink("http", sink)
+	hs := &httpServer{
+		clusters:       []*cluster{{name: "default", pub: p, sink: sink}},
+		adminToken:     "token",
+		adminEndpoints: true,
+		separateAdmin:  true,
+		audit:          slog.New(slog.DiscardHandler),
+		gatherer:       prometheus.NewRegistry(),
+		refreshTimeout: timeout,
+	}
+	srv := httptest.NewServer(hs.adminHandler())
+	t.Cleanup(srv.Close)
+	return srv, hs
+}
+
+// postRefresh requests a refresh of srv under ctx.
+func postRefresh(ctx context.Context, srv *httptest.Server) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/debug/refresh", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer token")
+	return srv.Client().Do(r)
+}
+
+func TestServeRefresh(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  func(t *testing.T) discoverySource
+		// timeout is how long the refresh may take.
+		timeout    time.Duration
+		wantStatus int
+		// wantBody is part of the response body.
+		wantBody string
+	}{
+		{
+			name:       "discovered",
+			src:        func(t *testing.T) discoverySource { return newTestUpstream(t, testKey(t, "a")).source() },
+			timeout:    time.Minute,
+			wantStatus: http.StatusOK,
+			wantBody:   `"status":"refreshed"`,
+		},
+		{
+			name: "upstream failing",
+			src: func(t *testing.T) discoverySource {
+				u := newTestUpstream(t, testKey(t, "a"))
+				u.fail.Store(true)
+				return u.source()
+			},
+			timeout:    time.Minute,
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "503",
+		},
+		{
+			name: "timing out",
+			src: func(t *testing.T) discoverySource {
+				src, _, _ := blockingUpstream(t)
+				return src
+			},
+			timeout:    50 * time.Millisecond,
+			wantStatus: http.StatusGatewayTimeout,
+			wantBody:   "refresh timed out after 50ms",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, hs := newRefreshServer(t, tc.src(t), tc.timeout)
+			resp, err := postRefresh(context.Background(), srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var body strings.Builder
+			if _, err := io.Copy(&body, resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.wantStatus || !strings.Contains(body.String(), tc.wantBody) {
+				t.Errorf("refresh = %s %s, want %d containing %s", resp.Status, body.String(), tc.wantStatus, tc.wantBody)
+			}
+
+			w := get(hs.handler(), "/.well-known/jwks.json")
+			if got := w.Code == http.StatusOK; got != (tc.wantStatus == http.StatusOK) {
+				t.Errorf("key set = %d after the refresh answered %d", w.Code, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestServeRefreshClientCancelled(t *testing.T) {
+	src, inflight, cancelled := blockingUpstream(t)
+	// long enough that only the client can cancel it.
+	srv, hs := newRefreshServer(t, src, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := postRefresh(ctx, srv)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	select {
+	case <-inflight:
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovery didn't start")
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("request error = %v, want it cancelled", err)
+	}
+
+	// the discovery goes with the admin client, rather than running on.
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovery still running after the admin client disconnected")
+	}
+	// and its refresh has finished, so the next one can start.
+	done := make(chan struct{})
+	go func() {
+		hs.clusters[0].pub.refreshMu.Lock()
+		hs.clusters[0].pub.refreshMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh still holding its lock after the admin client disconnected")
+	}
+}
+
+func TestSPIFFEBundle(t *testing.T) {
+	const (
+		jwks   = "/.well-known/jwks.json"
+		bundle = "/.well-known/spiffe-bundle.json"
+	)
+	noKID := testKey(t, "")
+	enc := testKey(t, "enc")
+	enc.Use = "enc"
+	unmarked := testKey(t, "unmarked")
+	unmarked.Use = ""
+	certified := addCertThumbprints(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{testCertKey(t, "certified")}}).Keys[0]
+
+	for _, tc := range []struct {
+		name        string
+		off         bool
+		keys        []jose.JSONWebKey
+		refreshHint time.Duration
+		wantStatus  int
+		// wantKIDs are the keys in the bundle, in order.
+		wantKIDs []string
+		wantHint float64
+	}{
+		{name: "signing keys", keys: []jose.JSONWebKey{testKey(t, "a"), unmarked}, refreshHint: 90 * time.Second, wantStatus: http.StatusOK, wantKIDs: []string{"a", "unmarked"}, wantHint: 90},
+		{name: "certificates stripped", keys: []jose.JSONWebKey{certified}, refreshHint: time.Minute, wantStatus: http.StatusOK, wantKIDs: []string{"certified"}, wantHint: 60},
+		{name: "hint rounded up to a second", keys: []jose.JSONWebKey{testKey(t, "a")}, refreshHint: 1500 * time.Millisecond, wantStatus: http.StatusOK, wantKIDs: []string{"a"}, wantHint: 2},
+		{name: "keys without a kid or for encryption dropped", keys: []jose.JSONWebKey{noKID, enc, testKey(t, "a")}, refreshHint: time.Minute, wantStatus: http.StatusOK, wantKIDs: []string{"a"}, wantHint: 60},
+		{name: "no JWT-SVID authorities", keys: []jose.JSONWebKey{noKID, enc}, refreshHint: time.Minute, wantStatus: http.StatusServiceUnavailable},
+		{name: "no keys", refreshHint: time.Minute, wantStatus: http.StatusServiceUnavailable},
+		{name: "off", off: true, keys: []jose.JSONWebKey{testKey(t, "a")}, wantStatus: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &publisher{cluster: "default", lastDiscovery: time.Now()}
+			sink := &httpSink{state: p, initializingStatus: http.StatusServiceUnavailable, spiffeBundle: !tc.off, spiffeRefreshHint: tc.refreshHint}
+			md, err := publicMetadata(&oidc.ProviderMetadata{Issuer: "https://example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Update(context.Background(), md, &jose.JSONWebKeySet{Keys: tc.keys}); err != nil {
+				t.Fatal(err)
+			}
+			h := (&httpServer{clusters: []*cluster{{name: "default", pub: p, sink: sink}}}).handler()
+
+			w := get(h, bundle)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != spiffeBundleContentType {
+				t.Errorf("Content-Type = %q, want %q", got, spiffeBundleContentType)
+			}
+
+			var got struct {
+				Keys        []map[string]any `json:"keys"`
+				RefreshHint float64          `json:"spiffe_refresh_hint"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			var kids []string
+			for _, k := range got.Keys {
+				kids = append(kids, fmt.Sprint(k["kid"]))
+				if k["use"] != spiffeJWTSVIDUse {
+					t.Errorf("key %v use = %v, want %s", k["kid"], k["use"], spiffeJWTSVIDUse)
+				}
+				for _, member := range []string{"x5c", "x5u", "x5t", "x5t#S256"} {
+					if _, ok := k[member]; ok {
+						t.Errorf("key %v has %s, want certificates stripped", k["kid"], member)
+					}
+				}
+			}
+			if !slices.Equal(kids, tc.wantKIDs) {
+				t.Errorf("bundle keys = %v, want %v", kids, tc.wantKIDs)
+			}
+			if got.RefreshHint != tc.wantHint {
+				t.Errorf("spiffe_refresh_hint = %v, want %v", got.RefreshHint, tc.wantHint)
+			}
+
+			// the key set itself is served unchanged alongside it.
+			if w := get(h, jwks); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"use":"sig"`) {
+				t.Errorf("key set = %d %s, want the keys as published", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestServeMappedPaths(t *testing.T) {
+	const issuer = "https://example.com/clusters/a"
+	c := newTestCluster(t, "a", issuer, testKey(t, "a"))
+	pathMap := map[string]issuerPaths{issuer: {Issuer: issuer, MetadataPath: "/a/openid-configuration", JWKSPath: "/a/keys"}}
+	if err := mapIssuerPaths([]*cluster{c}, pathMap); err != nil {
+		t.Fatal(err)
+	}
+	h := (&httpServer{clusters: []*cluster{c}}).handler()
+
+	for _, tc := range []struct {
+		path       string
+		wantStatus int
+		// wantBody is part of the document served, if it's found.
+		wantBody string
+	}{
+		{path: "/a/openid-configuration", wantStatus: http.StatusOK, wantBody: `"issuer":"` + issuer + `"`},
+		{path: "/a/keys", wantStatus: http.StatusOK, wantBody: `"kid":"a"`},
+		// not at the paths derived from the issuer, nor the root.
+		{path: "/clusters/a/.well-known/openid-configuration", wantStatus: http.StatusNotFound},
+		{path: "/clusters/a/.well-known/jwks.json", wantStatus: http.StatusNotFound},
+		{path: "/.well-known/openid-configuration", wantStatus: http.StatusNotFound},
+		{path: "/.well-known/jwks.json", wantStatus: http.StatusNotFound},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := get(h, tc.path)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tc.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", w.Body, tc.wantBody)
+			}
+		})
+	}
+}
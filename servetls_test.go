@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate for name, for usage, and its key.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes blocks of typ to a file in dir, returning its path.
+func writePEM(t *testing.T, dir, name, typ string, blocks ...[]byte) string {
+	t.Helper()
+	var b []byte
+	for _, der := range blocks {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})...)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeKeyPair writes cert and its key to files in dir, returning their paths.
+func writeKeyPair(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, name+".crt", "CERTIFICATE", cert.Certificate...), writePEM(t, dir, name+".key", "PRIVATE KEY", key)
+}
+
+func TestServingTLSClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "serving")
+	clientCA := newTestCA(t, "clients")
+	otherCA := newTestCA(t, "other")
+	certFile, keyFile := writeKeyPair(t, dir, "server", ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth))
+	clientCAFile := writePEM(t, dir, "client-ca.crt", "CERTIFICATE", clientCA.cert.Raw)
+
+	trusted := clientCA.issue(t, "relying-party", x509.ExtKeyUsageClientAuth)
+	untrusted := otherCA.issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+	for _, tc := range []struct {
+		name         string
+		clientCAFile string
+		// clientCert is presented by the client, if set.
+		clientCert *tls.Certificate
+		wantErr    bool
+	}{
+		{name: "public without a client certificate"},
+		{name: "public with a client certificate", clientCert: &untrusted},
+		{name: "mTLS with a trusted client certificate", clientCAFile: clientCAFile, clientCert: &trusted},
+		{name: "mTLS without a client certificate", clientCAFile: clientCAFile, wantErr: true},
+		{name: "mTLS with a certificate from another CA", clientCAFile: clientCAFile, clientCert: &untrusted, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := servingTLS(certFile, keyFile, tc.clientCAFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &httpServer{clusters: []*cluster{newTestCluster(t, "default", "https://example.com", testKey(t, "a"))}}
+			srv := httptest.NewUnstartedServer(s.handler())
+			srv.TLS = config
+			srv.StartTLS()
+			defer srv.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			clientTLS := &tls.Config{RootCAs: roots}
+			if tc.clientCert != nil {
+				clientTLS.Certificates = []tls.Certificate{*tc.clientCert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+
+			resp, err := client.Get(srv.URL + "/.well-known/jwks.json")
+			if tc.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got %s, want the handshake refused", resp.Status)
+				}
+				if !strings.Contains(err.Error(), "certificate") {
+					t.Errorf("error = %v, want a certificate error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %s, want 200", resp.Status)
+			}
+		})
+	}
+}
+
+func TestServingTLSInvalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "serving")
+	certFile, keyFile := writeKeyPair(t, dir, "server", ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth))
+	notPEM := filepath.Join(dir, "not-pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name                            string
+		certFile, keyFile, clientCAFile string
+		wantErr                         string
+	}{
+		{name: "missing certificate", certFile: filepath.Join(dir, "missing"), keyFile: keyFile, wantErr: "loading certificate"},
+		{name: "invalid key", certFile: certFile, keyFile: notPEM, wantErr: "loading certificate"},
+		{name: "missing client CA bundle", certFile: certFile, keyFile: keyFile, clientCAFile: filepath.Join(dir, "missing"), wantErr: "reading client CA bundle"},
+		{name: "client CA bundle without certificates", certFile: certFile, keyFile: keyFile, clientCAFile: notPEM, wantErr: "no certificates found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := servingTLS(tc.certFile, tc.keyFile, tc.clientCAFile)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/iofs"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/go-jose/go-jose/v4"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"lds.li/oauth2ext/oidc"
+)
+
+// seedSource is a Sink whose last published documents can be read back, to
+// seed the other sinks when discovery isn't possible at startup.
+type seedSource interface {
+	// load returns the documents as last published, and when they were.
+	load(ctx context.Context) (*oidc.ProviderMetadata, *jose.JSONWebKeySet, time.Time, error)
+}
+
+// wrappedSink is a Sink that passes updates on to another, under some
+// condition.
+type wrappedSink interface {
+	unwrap() Sink
+}
+
+// asSeedSource returns s as a seedSource, if it is one, looking through
+// wrapping sinks such as leaderSink, as followers can still read what the
+// leader published.
+func asSeedSource(s Sink) (seedSource, bool) {
+	for {
+		ws, ok := s.(wrappedSink)
+		if !ok {
+			break
+		}
+		s = ws.unwrap()
+	}
+	ss, ok := s.(seedSource)
+	return ss, ok
+}
+
+// deleter is a Sink whose published documents can be deleted, for when they've
+// gone stale, see publisher.deleteStale. Deleting documents that are already
+// gone succeeds.
+type deleter interface {
+	delete(ctx context.Context) error
+}
+
+// asDeleter returns s as a deleter, if it is one, looking through wrapping
+// sinks. A leaderSink is a deleter itself, only deleting while leading.
+func asDeleter(s Sink) (deleter, bool) {
+	for {
+		if d, ok := s.(deleter); ok {
+			return d, true
+		}
+		ws, ok := s.(wrappedSink)
+		if !ok {
+			return nil, false
+		}
+		s = ws.unwrap()
+	}
+}
+
+// parseDocuments parses the documents as written by documentFiles.
+func parseDocuments(mdJSON, ksJSON []byte) (*oidc.ProviderMetadata, *jose.JSONWebKeySet, error) {
+	var md oidc.ProviderMetadata
+	if err := json.Unmarshal(mdJSON, &md); err != nil {
+		return nil, nil, fmt.Errorf("unmarshaling metadata: %v", err)
+	}
+	var raw rawJWKS
+	if err := json.Unmarshal(ksJSON, &raw); err != nil {
+		return nil, nil, fmt.Errorf("unmarshaling key set: %v", err)
+	}
+	ks, err := parseJWKS(raw, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing key set: %v", err)
+	}
+	return &md, ks, nil
+}
+
+// fileSink writes the documents in to a directory, laid out as they are
+// served under the issuer's path so the directory can be used as the root of
+// a static site.
+type fileSink struct {
+	dir string
+	// canonicalKeys writes the keys in canonical member order.
+	canonicalKeys bool
+}
+
+func (f *fileSink) Update(_ context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	files, err := issuerFiles(md, ks, f.canonicalKeys)
+	if err != nil {
+		return err
+	}
+	for _, df := range files {
+		if err := writeFileAtomic(filepath.Join(f.dir, filepath.FromSlash(df.path)), df.body); err != nil {
+			return err
+		}
+	}
+	// documents left under an issuer path that has since changed would be
+	// read back rather than these.
+	return f.remove(metadataFile(files))
+}
+
+// delete removes the documents.
+func (f *fileSink) delete(_ context.Context) error {
+	return f.remove("")
+}
+
+// remove removes every copy of the documents but the one with its metadata at
+// keep, the metadata first so it never points at keys that are gone.
+func (f *fileSink) remove(keep string) error {
+	found, err := findDocuments(os.DirFS(f.dir))
+	if err != nil {
+		return fmt.Errorf("finding documents in %s: %v", f.dir, err)
+	}
+	for _, mdPath := range found {
+		if mdPath == keep {
+			continue
+		}
+		for _, p := range []string{mdPath, keySetFile(mdPath)} {
+			if err := os.Remove(filepath.Join(f.dir, filepath.FromSlash(p))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load reads the documents back, as published when the older of the two was
+// written.
+func (f *fileSink) load(_ context.Context) (*oidc.ProviderMetadata, *jose.JSONWebKeySet, time.Time, error) {
+	found, err := findDocuments(os.DirFS(f.dir))
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("finding documents in %s: %v", f.dir, err)
+	}
+	mdPath, err := onlyDocuments(found)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("%s: %w", f.dir, err)
+	}
+	var (
+		bodies    [][]byte
+		published time.Time
+	)
+	for _, p := range []string{mdPath, keySetFile(mdPath)} {
+		fp := filepath.Join(f.dir, filepath.FromSlash(p))
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		if published.IsZero() || fi.ModTime().Before(published) {
+			published = fi.ModTime()
+		}
+		bodies = append(bodies, b)
+	}
+	md, ks, err := parseDocuments(bodies[0], bodies[1])
+	return md, ks, published, err
+}
+
+// documentFile is a document at the path it is served from, relative to the
+// root.
+type documentFile struct {
+	path string
+	body []byte
+}
+
+// issuerFiles returns the documents laid out under md's issuer path, as
+// -serve-issuer-path serves them, which is where relying parties look for them
+// on a static site.
+func issuerFiles(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet, canonical bool) ([]documentFile, error) {
+	prefix, err := issuerPath(md.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return documentFiles(md, ks, canonical, prefix)
+}
+
+// metadataFile returns the path of the discovery document in files.
+func metadataFile(files []documentFile) string {
+	for _, df := range files {
+		if path.Base(df.path) == "openid-configuration" {
+			return df.path
+		}
+	}
+	return ""
+}
+
+// keySetFile returns the path of the key set laid out alongside the
+// discovery document at mdPath.
+func keySetFile(mdPath string) string {
+	return path.Join(path.Dir(mdPath), "jwks.json")
+}
+
+// findDocuments returns the paths of the discovery documents laid out in fsys
+// by documentFiles, under whatever issuer path they were published for. The
+// key set of each is at keySetFile. A missing root holds none.
+func findDocuments(fsys fs.FS) ([]string, error) {
+	var found []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil && p == "." && errors.Is(err, fs.ErrNotExist):
+			return fs.SkipAll
+		case err != nil:
+			return err
+		case d.IsDir() && d.Name() == ".git":
+			return fs.SkipDir
+		case !d.IsDir() && d.Name() == "openid-configuration" && path.Base(path.Dir(p)) == ".well-known":
+			found = append(found, p)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// onlyDocuments returns the one discovery document in found, to be read back.
+// Several means stale documents were left behind, and which to trust isn't
+// known.
+func onlyDocuments(found []string) (string, error) {
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no published documents found: %w", fs.ErrNotExist)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("documents found under several paths, %s, remove the stale ones", strings.Join(found, ", "))
+}
+
+// documentFiles returns the documents laid out as they are served under
+// pathPrefix, see documentPaths. The keys come first, so written in order the
+// metadata never references keys that aren't there yet. canonical orders the
+// keys' members, see canonicalKeySet.
+func documentFiles(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet, canonical bool, pathPrefix string) ([]documentFile, error) {
+	mdJSON, err := json.Marshal(md)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling metadata: %v", err)
+	}
+	ksJSON, err := json.Marshal(keySetJSON(ks, canonical))
+	if err != nil {
+		return nil, fmt.Errorf("marshaling key set: %v", err)
+	}
+	mdPath, ksPath := documentPaths(pathPrefix, nil)
+	return []documentFile{
+		{path: strings.TrimPrefix(ksPath, "/"), body: ksJSON},
+		{path: strings.TrimPrefix(mdPath, "/"), body: mdJSON},
+	}, nil
+}
+
+// writeFileAtomic replaces the file at path with b, such that readers see
+// either the old or new content but never a partial write.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating %s: %v", filepath.Dir(path), err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating temp file for %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("setting mode on %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing %s: %v", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("renaming %s to %s: %v", tmp.Name(), path, err)
+	}
+	return nil
+}
+
+const (
+	configMapMetadataKey = "openid-configuration"
+	configMapJWKSKey     = "jwks.json"
+)
+
+// configMapSink stores the documents in a ConfigMap, e.g. for mounting in to
+// another workload that serves them. Other keys in the ConfigMap are left
+// alone.
+type configMapSink struct {
+	client corev1client.ConfigMapInterface
+	name   string
+	// canonicalKeys writes the keys in canonical member order.
+	canonicalKeys bool
+}
+
+func (c *configMapSink) Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	mdJSON, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("marshaling metadata: %v", err)
+	}
+	ksJSON, err := json.Marshal(keySetJSON(ks, c.canonicalKeys))
+	if err != nil {
+		return fmt.Errorf("marshaling key set: %v", err)
+	}
+
+	cm, err := c.client.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name},
+			Data: map[string]string{
+				configMapMetadataKey: string(mdJSON),
+				configMapJWKSKey:     string(ksJSON),
+			},
+		}
+		if _, err := c.client.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating configmap %s: %v", c.name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting configmap %s: %v", c.name, err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[configMapMetadataKey] = string(mdJSON)
+	cm.Data[configMapJWKSKey] = string(ksJSON)
+
+	if _, err := c.client.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating configmap %s: %v", c.name, err)
+	}
+	return nil
+}
+
+// delete removes the documents from the ConfigMap, leaving it and any other
+// keys in place.
+func (c *configMapSink) delete(ctx context.Context) error {
+	cm, err := c.client.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting configmap %s: %v", c.name, err)
+	}
+	_, hasMetadata := cm.Data[configMapMetadataKey]
+	_, hasJWKS := cm.Data[configMapJWKSKey]
+	if !hasMetadata && !hasJWKS {
+		return nil
+	}
+	delete(cm.Data, configMapMetadataKey)
+	delete(cm.Data, configMapJWKSKey)
+	if _, err := c.client.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating configmap %s: %v", c.name, err)
+	}
+	return nil
+}
+
+// load reads the documents back from the ConfigMap, as published when it was
+// last written.
+func (c *configMapSink) load(ctx context.Context) (*oidc.ProviderMetadata, *jose.JSONWebKeySet, time.Time, error) {
+	cm, err := c.client.Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("getting configmap %s: %v", c.name, err)
+	}
+	mdJSON, ok := cm.Data[configMapMetadataKey]
+	if !ok {
+		return nil, nil, time.Time{}, fmt.Errorf("configmap %s has no %s", c.name, configMapMetadataKey)
+	}
+	ksJSON, ok := cm.Data[configMapJWKSKey]
+	if !ok {
+		return nil, nil, time.Time{}, fmt.Errorf("configmap %s has no %s", c.name, configMapJWKSKey)
+	}
+
+	// the last write is the latest managed fields entry.
+	published := cm.CreationTimestamp.Time
+	for _, mf := range cm.ManagedFields {
+		if mf.Time != nil && mf.Time.After(published) {
+			published = mf.Time.Time
+		}
+	}
+	md, ks, err := parseDocuments([]byte(mdJSON), []byte(ksJSON))
+	return md, ks, published, err
+}
+
+const (
+	gitAuthorName  = "k8soidcpublisher"
+	gitAuthorEmail = "k8soidcpublisher@localhost"
+	// gitPushAttempts bounds how many times we re-apply our change on top of
+	// a branch that moved while we were pushing.
+	gitPushAttempts = 3
+)
+
+// errGitBranchMoved is returned when a push is rejected because the branch
+// was updated since we cloned it.
+var errGitBranchMoved = errors.New("branch was updated concurrently")
+
+// gitSink commits the documents to a branch of a git repository and pushes
+// them, for setups that serve them from a repo. Each update works on a fresh
+// shallow clone in memory, so there is no local state to go out of sync.
+type gitSink struct {
+	url    string
+	branch string
+	// dir is the directory in the repo the documents are laid out under, as
+	// they are served.
+	dir  string
+	auth transport.AuthMethod
+	// canonicalKeys writes the keys in canonical member order.
+	canonicalKeys bool
+}
+
+func (g *gitSink) Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	files, err := issuerFiles(md, ks, g.canonicalKeys)
+	if err != nil {
+		return err
+	}
+
+	kids := make([]string, 0, len(ks.Keys))
+	for _, k := range ks.Keys {
+		kids = append(kids, k.KeyID)
+	}
+	msg := fmt.Sprintf("Update OIDC discovery documents for %s\n\nPublished key IDs: %s\n", md.Issuer, strings.Join(kids, ", "))
+
+	return g.push(ctx, files, msg)
+}
+
+// delete commits the removal of the documents and pushes it.
+func (g *gitSink) delete(ctx context.Context) error {
+	return g.push(ctx, nil, "Delete stale OIDC discovery documents\n\nDiscovery failed for longer than -delete-stale-after.\n")
+}
+
+// docsFS returns the part of the worktree fs the documents are laid out in.
+func (g *gitSink) docsFS(wt billy.Filesystem) (fs.FS, error) {
+	dir := strings.TrimPrefix(path.Clean("/"+g.dir), "/")
+	if dir == "" {
+		return iofs.New(wt), nil
+	}
+	return fs.Sub(iofs.New(wt), dir)
+}
+
+// push commits files with msg and pushes them, retrying if the branch moves.
+func (g *gitSink) push(ctx context.Context, files []documentFile, msg string) error {
+	// our change is the full content of the files, so rebasing it on to the
+	// updated branch is just applying it to a fresh clone.
+	for attempt := 1; ; attempt++ {
+		err := g.commitAndPush(ctx, files, msg)
+		if !errors.Is(err, errGitBranchMoved) || attempt == gitPushAttempts {
+			return err
+		}
+		slog.Info("Git branch was updated while pushing, retrying on top of it", "branch", g.branch, "attempt", attempt)
+	}
+}
+
+// commitAndPush commits files to a fresh clone and pushes it. Files without a
+// body are removed, as are documents found under any other issuer path, so
+// the branch only ever holds the latest.
+func (g *gitSink) commitAndPush(ctx context.Context, files []documentFile, msg string) error {
+	ref := plumbing.NewBranchReferenceName(g.branch)
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), memfs.New(), &git.CloneOptions{
+		URL:           g.url,
+		Auth:          g.auth,
+		ReferenceName: ref,
+		SingleBranch:  true,
+		Depth:         1,
+	})
+	if err != nil {
+		return fmt.Errorf("cloning %s branch %s: %v", g.url, g.branch, err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("resolving %s: %v", g.branch, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("getting worktree: %v", err)
+	}
+
+	docs, err := g.docsFS(wt.Filesystem)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", g.dir, err)
+	}
+	found, err := findDocuments(docs)
+	if err != nil {
+		return fmt.Errorf("finding documents: %v", err)
+	}
+	keep := metadataFile(files)
+	for _, mdPath := range found {
+		if mdPath != keep {
+			files = append(files, documentFile{path: mdPath}, documentFile{path: keySetFile(mdPath)})
+		}
+	}
+
+	for _, df := range files {
+		p := path.Join(g.dir, df.path)
+		if df.body == nil {
+			if _, err := wt.Filesystem.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if _, err := wt.Remove(p); err != nil {
+				return fmt.Errorf("removing %s: %v", p, err)
+			}
+			continue
+		}
+		if err := util.WriteFile(wt.Filesystem, p, df.body, 0o644); err != nil {
+			return fmt.Errorf("writing %s: %v", p, err)
+		}
+		if _, err := wt.Add(p); err != nil {
+			return fmt.Errorf("adding %s: %v", p, err)
+		}
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return fmt.Errorf("getting worktree status: %v", err)
+	}
+	if status.IsClean() {
+		// the repo already has this content, e.g. from a previous run.
+		return nil
+	}
+
+	if _, err := wt.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{Name: gitAuthorName, Email: gitAuthorEmail, When: time.Now()},
+	}); err != nil {
+		return fmt.Errorf("committing: %v", err)
+	}
+
+	err = repo.PushContext(ctx, &git.PushOptions{
+		Auth:     g.auth,
+		RefSpecs: []config.RefSpec{config.RefSpec(ref + ":" + ref)},
+	})
+	if err == nil {
+		return nil
+	}
+	// the push error doesn't reliably distinguish a rejection, so check
+	// whether the branch moved from under us.
+	if moved, lerr := g.branchMoved(ctx, repo, ref, head.Hash()); lerr == nil && moved {
+		return fmt.Errorf("pushing to %s: %w", g.branch, errGitBranchMoved)
+	}
+	return fmt.Errorf("pushing to %s: %v", g.branch, err)
+}
+
+// load reads the documents back from the branch, as published when its head
+// was committed.
+func (g *gitSink) load(ctx context.Context) (*oidc.ProviderMetadata, *jose.JSONWebKeySet, time.Time, error) {
+	fs := memfs.New()
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), fs, &git.CloneOptions{
+		URL:           g.url,
+		Auth:          g.auth,
+		ReferenceName: plumbing.NewBranchReferenceName(g.branch),
+		SingleBranch:  true,
+		Depth:         1,
+	})
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("cloning %s branch %s: %v", g.url, g.branch, err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("resolving %s: %v", g.branch, err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("reading %s head commit: %v", g.branch, err)
+	}
+
+	docs, err := g.docsFS(fs)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("opening %s: %v", g.dir, err)
+	}
+	found, err := findDocuments(docs)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("finding documents: %v", err)
+	}
+	mdPath, err := onlyDocuments(found)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	mdJSON, err := util.ReadFile(fs, path.Join(g.dir, mdPath))
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("reading metadata: %v", err)
+	}
+	ksJSON, err := util.ReadFile(fs, path.Join(g.dir, keySetFile(mdPath)))
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("reading key set: %v", err)
+	}
+	md, ks, err := parseDocuments(mdJSON, ksJSON)
+	return md, ks, commit.Committer.When, err
+}
+
+// branchMoved reports whether the remote's ref no longer points at base.
+func (g *gitSink) branchMoved(ctx context.Context, repo *git.Repository, ref plumbing.ReferenceName, base plumbing.Hash) (bool, error) {
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return false, err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: g.auth})
+	if err != nil {
+		return false, err
+	}
+	for _, r := range refs {
+		if r.Name() == ref {
+			return r.Hash() != base, nil
+		}
+	}
+	return true, nil
+}
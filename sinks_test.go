@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-jose/go-jose/v4"
+	"k8s.io/client-go/kubernetes/fake"
+	"lds.li/oauth2ext/oidc"
+)
+
+// testDocuments returns the documents published for issuer.
+func testDocuments(t testing.TB, issuer string, keys ...jose.JSONWebKey) (*oidc.ProviderMetadata, *jose.JSONWebKeySet) {
+	t.Helper()
+	md, err := publicMetadata(&oidc.ProviderMetadata{Issuer: issuer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md, &jose.JSONWebKeySet{Keys: keys}
+}
+
+// treeFiles returns the paths of the files under dir, relative to it.
+func treeFiles(t testing.TB, dir string) []string {
+	t.Helper()
+	var files []string
+	err := fs.WalkDir(os.DirFS(dir), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDocumentFiles(t *testing.T) {
+	md, ks := testDocuments(t, "https://example.com/clusters/foo", testKey(t, "a"))
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "", want: []string{".well-known/jwks.json", ".well-known/openid-configuration"}},
+		{prefix: "/clusters/foo", want: []string{"clusters/foo/.well-known/jwks.json", "clusters/foo/.well-known/openid-configuration"}},
+	} {
+		files, err := documentFiles(md, ks, false, tc.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, df := range files {
+			got = append(got, df.path)
+		}
+		// the key set must come first.
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("documentFiles(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestFileSinkIssuerPath(t *testing.T) {
+	for _, tc := range []struct {
+		issuer string
+		want   []string
+	}{
+		{issuer: "https://example.com", want: []string{".well-known/jwks.json", ".well-known/openid-configuration"}},
+		{issuer: "https://example.com/cluster-a", want: []string{"cluster-a/.well-known/jwks.json", "cluster-a/.well-known/openid-configuration"}},
+		{issuer: "https://example.com/a/b/c/", want: []string{"a/b/c/.well-known/jwks.json", "a/b/c/.well-known/openid-configuration"}},
+	} {
+		t.Run(tc.issuer, func(t *testing.T) {
+			dir := t.TempDir()
+			f := &fileSink{dir: dir}
+			md, ks := testDocuments(t, tc.issuer, testKey(t, "a"))
+			if err := f.Update(context.Background(), md, ks); err != nil {
+				t.Fatal(err)
+			}
+			if got := treeFiles(t, dir); !slices.Equal(got, tc.want) {
+				t.Errorf("wrote %q, want %q", got, tc.want)
+			}
+
+			lmd, lks, published, err := f.load(context.Background())
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if lmd.Issuer != md.Issuer || lmd.JWKSURI != md.JWKSURI || len(lks.Key("a")) != 1 {
+				t.Errorf("loaded %+v %+v, want what was written", lmd, lks)
+			}
+			if time.Since(published) > time.Minute {
+				t.Errorf("loaded documents published at %s, want about now", published)
+			}
+
+			if err := f.delete(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := treeFiles(t, dir); len(got) != 0 {
+				t.Errorf("delete left %q", got)
+			}
+			if _, _, _, err := f.load(context.Background()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("load after delete = %v, want not exist", err)
+			}
+		})
+	}
+}
+
+func TestFileSinkIssuerPathChanged(t *testing.T) {
+	dir := t.TempDir()
+	f := &fileSink{dir: dir}
+	for _, issuer := range []string{"https://example.com/old", "https://example.com/new"} {
+		md, ks := testDocuments(t, issuer, testKey(t, "a"))
+		if err := f.Update(context.Background(), md, ks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"new/.well-known/jwks.json", "new/.well-known/openid-configuration"}
+	if got := treeFiles(t, dir); !slices.Equal(got, want) {
+		t.Errorf("directory holds %q, want only %q", got, want)
+	}
+	md, _, _, err := f.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Issuer != "https://example.com/new" {
+		t.Errorf("loaded issuer %q, want the latest", md.Issuer)
+	}
+}
+
+func TestFileSinkLoadAmbiguous(t *testing.T) {
+	dir := t.TempDir()
+	for _, issuer := range []string{"https://example.com/a", "https://example.com/b"} {
+		md, ks := testDocuments(t, issuer, testKey(t, "a"))
+		files, err := issuerFiles(md, ks, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, df := range files {
+			if err := writeFileAtomic(filepath.Join(dir, df.path), df.body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_, _, _, err := (&fileSink{dir: dir}).load(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "several paths") {
+		t.Fatalf("load = %v, want an error about several copies", err)
+	}
+}
+
+func TestFileSinkLoadMissingDir(t *testing.T) {
+	_, _, _, err := (&fileSink{dir: filepath.Join(t.TempDir(), "missing")}).load(context.Background())
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("load = %v, want not exist", err)
+	}
+}
+
+// newTestGitRemote returns the path of a bare repository with a main branch.
+func newTestGitRemote(t *testing.T) string {
+	t.Helper()
+	remote := t.TempDir()
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+	work := t.TempDir()
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "README.md"), []byte("site\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("README.md"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := wt.Commit("initial", &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@localhost", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{RefSpecs: []config.RefSpec{config.RefSpec(head.String() + ":refs/heads/main")}}); err != nil {
+		t.Fatal(err)
+	}
+	return remote
+}
+
+// gitTree returns the paths of the files on branch in the repository at url.
+func gitTree(t *testing.T, url, branch string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: url, ReferenceName: plumbing.NewBranchReferenceName(branch)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	_ = tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, f.Name)
+		return nil
+	})
+	return files
+}
+
+func TestGitSinkIssuerPath(t *testing.T) {
+	remote := newTestGitRemote(t)
+	g := &gitSink{url: remote, branch: "main", dir: "site"}
+	ctx := context.Background()
+
+	md, ks := testDocuments(t, "https://example.com/old", testKey(t, "a"))
+	if err := g.Update(ctx, md, ks); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	md, ks = testDocuments(t, "https://example.com/clusters/foo", testKey(t, "b"))
+	if err := g.Update(ctx, md, ks); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	want := []string{"README.md", "site/clusters/foo/.well-known/jwks.json", "site/clusters/foo/.well-known/openid-configuration"}
+	got := gitTree(t, remote, "main")
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("branch holds %q, want %q", got, want)
+	}
+
+	lmd, lks, _, err := g.load(ctx)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if lmd.Issuer != md.Issuer || len(lks.Key("b")) != 1 {
+		t.Errorf("loaded %+v %+v, want the latest documents", lmd, lks)
+	}
+
+	if err := g.delete(ctx); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := gitTree(t, remote, "main"); !slices.Equal(got, []string{"README.md"}) {
+		t.Errorf("branch holds %q after delete, want only the README", got)
+	}
+}
+
+func TestConfigMapSink(t *testing.T) {
+	cs := fake.NewClientset()
+	c := &configMapSink{client: cs.CoreV1().ConfigMaps("default"), name: "oidc"}
+	ctx := context.Background()
+
+	md, ks := testDocuments(t, "https://example.com/clusters/foo", testKey(t, "a"))
+	if err := c.Update(ctx, md, ks); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	md, ks = testDocuments(t, "https://example.com/clusters/foo", testKey(t, "b"))
+	if err := c.Update(ctx, md, ks); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	lmd, lks, _, err := c.load(ctx)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if lmd.Issuer != md.Issuer || len(lks.Key("b")) != 1 {
+		t.Errorf("loaded %+v %+v, want the latest documents", lmd, lks)
+	}
+	if err := c.delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.load(ctx); err == nil {
+		t.Error("load succeeded after delete")
+	}
+}
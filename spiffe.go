@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// The SPIFFE bundle's details, see
+// https://github.com/spiffe/spiffe/blob/main/standards/SPIFFE_Trust_Domain_and_Bundle.md
+const (
+	spiffeBundleContentType = "application/json"
+	// spiffeJWTSVIDUse marks a bundle key as verifying JWT-SVIDs.
+	spiffeJWTSVIDUse = "jwt-svid"
+)
+
+// spiffeBundle is a SPIFFE trust bundle. spiffe_sequence is left out, as
+// replicas publishing independently couldn't agree on one.
+type spiffeBundle struct {
+	Keys []jose.JSONWebKey `json:"keys"`
+	// RefreshHint is how often, in seconds, consumers should check for a new
+	// bundle.
+	RefreshHint int64 `json:"spiffe_refresh_hint,omitempty"`
+}
+
+// spiffeBundleFor returns the keys in ks as a SPIFFE trust bundle for
+// JWT-SVIDs. Keys without a kid or marked for encryption aren't valid JWT-SVID
+// authorities, so are left out with a warning. Certificates are dropped, as
+// they're only used for X.509-SVID authorities.
+func spiffeBundleFor(ks *jose.JSONWebKeySet, refreshHint time.Duration) spiffeBundle {
+	b := spiffeBundle{
+		Keys:        []jose.JSONWebKey{},
+		RefreshHint: int64(math.Ceil(refreshHint.Seconds())),
+	}
+	for _, k := range ks.Keys {
+		if k.KeyID == "" || (k.Use != "" && k.Use != "sig") {
+			slog.Warn("Leaving key out of the SPIFFE bundle, JWT-SVID authorities need a kid and to be for signing", "kid", k.KeyID, "use", k.Use)
+			continue
+		}
+		k.Use = spiffeJWTSVIDUse
+		k.Certificates = nil
+		k.CertificatesURL = nil
+		k.CertificateThumbprintSHA1 = nil
+		k.CertificateThumbprintSHA256 = nil
+		b.Keys = append(b.Keys, k)
+	}
+	return b
+}
+
+// spiffeBundlePath returns the path the SPIFFE bundle is served at, alongside
+// the key set at jwksPath.
+func spiffeBundlePath(jwksPath string) string {
+	return path.Join(path.Dir(jwksPath), "spiffe-bundle.json")
+}
+
+// spiffeBundleRoute returns the endpoint serving the sink's keys as a SPIFFE
+// bundle, alongside the key set at jwksPath.
+func (h *httpSink) spiffeBundleRoute(cluster, host, jwksPath string) route {
+	return route{
+		method:      http.MethodGet,
+		cluster:     cluster,
+		host:        host,
+		path:        spiffeBundlePath(jwksPath),
+		description: "SPIFFE trust bundle of the keys, for federating with SPIRE",
+		handler:     h.withMigrationHeaders(h.serveSPIFFEBundle),
+	}
+}
+
+func (h *httpSink) serveSPIFFEBundle(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	doc, keys := h.spiffeDoc, h.spiffeKeys
+	h.mu.RUnlock()
+
+	// consumers replace their bundle with what we serve, so an empty one would
+	// stop them verifying anything.
+	if doc != nil && keys == 0 {
+		h.setRetryAfter(w)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no keys"})
+		return
+	}
+	_, stale := h.documentsStale(h.state)
+	h.serveDocument(w, r, spiffeBundleContentType, doc, stale)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusPage is the HTML status page, for operators looking at us in a
+// browser. The JSON endpoints are for machines.
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>k8soidcpublisher</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.25em 1em 0.25em 0; vertical-align: top; }
+.ok { color: green; }
+.bad { color: darkred; }
+</style>
+</head>
+<body>
+<h1>k8soidcpublisher</h1>
+<p>As of {{.Now.Format "2006-01-02T15:04:05Z07:00"}}.</p>
+{{if .Maintenance}}<p class="bad">In maintenance mode, the documents are served as 503s.</p>{{end}}
+{{range .Clusters}}
+<h2>{{if .Name}}{{.Name}}{{else}}Status{{end}}</h2>
+<table>
+<tr><th>Health</th><td class="{{if .Ready}}ok{{else}}bad{{end}}">{{.Status}}</td></tr>
+<tr><th>Issuer</th><td>{{.Issuer}}</td></tr>
+<tr><th>Last discovery</th><td>{{if .LastSuccess.IsZero}}never{{else}}{{.LastSuccess.Format "2006-01-02T15:04:05Z07:00"}} ({{.Age}} ago){{end}}</td></tr>
+<tr><th>Keys</th><td>{{len .KeyIDs}}</td></tr>
+<tr><th>Key IDs</th><td>{{range .KeyIDs}}{{.}}<br>{{end}}</td></tr>
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+type statusPageCluster struct {
+	Name        string
+	Status      string
+	Ready       bool
+	Issuer      string
+	LastSuccess time.Time
+	Age         time.Duration
+	KeyIDs      []string
+}
+
+// serveStatusPage renders the status page. Like every other non-document
+// response it's served with no-store, so it always shows the current state.
+func (s *httpServer) serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Now         time.Time
+		Maintenance bool
+		Clusters    []statusPageCluster
+	}{Now: time.Now(), Maintenance: s.maintenance.Load()}
+	for _, c := range s.clusters {
+		rd, ok := c.sink.readiness()
+		sc := statusPageCluster{
+			Status:      rd.Status,
+			Ready:       ok,
+			Issuer:      rd.Issuer,
+			LastSuccess: c.pub.lastSuccess(),
+		}
+		if len(s.clusters) > 1 {
+			sc.Name = c.name
+		}
+		if !sc.LastSuccess.IsZero() {
+			sc.Age = time.Since(sc.LastSuccess).Round(time.Second)
+		}
+		c.sink.mu.RLock()
+		if c.sink.keySet != nil {
+			for _, k := range c.sink.keySet.Keys {
+				sc.KeyIDs = append(sc.KeyIDs, k.KeyID)
+			}
+		}
+		c.sink.mu.RUnlock()
+		data.Clusters = append(data.Clusters, sc)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPage.Execute(w, data); err != nil {
+		slog.Error("Failed to render status page", "error", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"lds.li/oauth2ext/oidc"
+)
+
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+var (
+	// discoveryRequired are the metadata fields that must be present.
+	discoveryRequired = []string{
+		"issuer",
+		"authorization_endpoint",
+		"token_endpoint",
+		"jwks_uri",
+		"response_types_supported",
+		"subject_types_supported",
+		"id_token_signing_alg_values_supported",
+	}
+	// discoveryURLs are the fields that must be URLs, if present.
+	discoveryURLs = []string{
+		"issuer",
+		"authorization_endpoint",
+		"token_endpoint",
+		"userinfo_endpoint",
+		"jwks_uri",
+		"registration_endpoint",
+		"service_documentation",
+		"op_policy_uri",
+		"op_tos_uri",
+	}
+	// discoveryBools are the fields that must be booleans, if present.
+	discoveryBools = []string{
+		"claims_parameter_supported",
+		"request_parameter_supported",
+		"request_uri_parameter_supported",
+		"require_request_uri_registration",
+	}
+)
+
+// validateDiscovery checks md against the OpenID Connect Discovery metadata
+// requirements, returning a description of each problem found. It works on the
+// encoded document, so it checks what relying parties will actually see.
+func validateDiscovery(md *oidc.ProviderMetadata) ([]string, error) {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling metadata: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("unmarshaling metadata: %v", err)
+	}
+
+	var problems []string
+	for _, f := range discoveryRequired {
+		if v, ok := doc[f]; !ok || v == nil || v == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", f))
+		}
+	}
+
+	for _, f := range discoveryURLs {
+		v, ok := doc[f]
+		if !ok || v == nil || v == "" {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s must be a string", f))
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s %q is not an absolute URL", f, s))
+			continue
+		}
+		if f == "issuer" && (u.Scheme != "https" || u.RawQuery != "" || u.Fragment != "") {
+			problems = append(problems, fmt.Sprintf("issuer %q must be an https URL without a query or fragment", s))
+		}
+	}
+
+	for f, v := range doc {
+		if !strings.HasSuffix(f, "_supported") || slices.Contains(discoveryBools, f) || v == nil {
+			continue
+		}
+		arr, ok := v.([]any)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s must be an array", f))
+			continue
+		}
+		for _, e := range arr {
+			if _, ok := e.(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s must only contain strings", f))
+				break
+			}
+		}
+		if slices.Contains(discoveryRequired, f) && len(arr) == 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be empty", f))
+		}
+	}
+	if algs, ok := doc["id_token_signing_alg_values_supported"].([]any); ok && !slices.Contains(algs, any("RS256")) {
+		problems = append(problems, "id_token_signing_alg_values_supported must include RS256")
+	}
+
+	for _, f := range discoveryBools {
+		if v, ok := doc[f]; ok && v != nil {
+			if _, ok := v.(bool); !ok {
+				problems = append(problems, fmt.Sprintf("%s must be a boolean", f))
+			}
+		}
+	}
+
+	// map iteration is random, keep the output stable.
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checkJWKSOrigin checks that jwksURI has the same origin (scheme and host) as
+// issuer, so the discovery document can't point verification at keys on an
+// unrelated host.
+func checkJWKSOrigin(issuer, jwksURI string) error {
+	iu, err := url.Parse(issuer)
+	if err != nil {
+		return fmt.Errorf("parsing issuer %q: %v", issuer, err)
+	}
+	ju, err := url.Parse(jwksURI)
+	if err != nil {
+		return fmt.Errorf("parsing jwks_uri %q: %v", jwksURI, err)
+	}
+	if !strings.EqualFold(iu.Scheme, ju.Scheme) || !strings.EqualFold(iu.Host, ju.Host) {
+		return fmt.Errorf("jwks_uri %q is not on the issuer's origin %s://%s", jwksURI, iu.Scheme, iu.Host)
+	}
+	return nil
+}
+
+// validSink only passes documents that validate on to the wrapped sink, so a
+// broken upstream document isn't propagated to a destination many relying
+// parties read from. Invalid documents are logged and skipped, leaving the
+// previously published ones in place.
+type validSink struct {
+	Sink
+	name string
+	log  *slog.Logger
+}
+
+func (s *validSink) unwrap() Sink { return s.Sink }
+
+func (s *validSink) Update(ctx context.Context, md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) error {
+	problems, err := publishProblems(md, ks)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		s.log.Warn("Not publishing invalid documents, keeping the previous ones", "sink", s.name, "issuer", md.Issuer, "problems", problems)
+		return nil
+	}
+	return s.Sink.Update(ctx, md, ks)
+}
+
+// publishProblems returns the reasons md and ks aren't fit to publish: the
+// metadata must pass validateDiscovery, and the key set must hold a signing
+// key. The keys themselves were already checked as they were parsed.
+func publishProblems(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) ([]string, error) {
+	problems, err := validateDiscovery(md)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(ks.Keys, func(k jose.JSONWebKey) bool { return k.Use == "" || k.Use == "sig" }) {
+		problems = append(problems, "key set has no signing keys")
+	}
+	return problems, nil
+}
+
+const (
+	suspectReject = "reject"
+	suspectAccept = "accept"
+)
+
+// suspectRequired are the array fields a working upstream always fills in.
+var suspectRequired = []string{
+	"response_types_supported",
+	"subject_types_supported",
+	"id_token_signing_alg_values_supported",
+}
+
+// suspectReasons returns why the discovery document md and the key set ks to
+// be published, though they parsed, look degraded: required lists that are
+// missing or empty, other lists present but empty, or no keys if emptyKeys.
+// These are more likely a broken upstream than a deliberate change. md is
+// judged as published, so the gaps filled by -*-supported aren't counted.
+func suspectReasons(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet, emptyKeys bool) ([]string, error) {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling metadata: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("unmarshaling metadata: %v", err)
+	}
+
+	var reasons []string
+	for _, f := range suspectRequired {
+		if v, ok := doc[f]; !ok || v == nil {
+			reasons = append(reasons, fmt.Sprintf("%s is missing", f))
+		}
+	}
+	for f, v := range doc {
+		if arr, ok := v.([]any); ok && strings.HasSuffix(f, "_supported") && len(arr) == 0 {
+			reasons = append(reasons, fmt.Sprintf("%s is empty", f))
+		}
+	}
+	if emptyKeys && len(ks.Keys) == 0 {
+		reasons = append(reasons, "key set has no keys")
+	}
+	sort.Strings(reasons)
+	return reasons, nil
+}
+
+// validate discovers the documents p would publish, which validates them with
+// validateDiscovery and logs any problems. p's sinks are replaced, so nothing
+// is published.
+func validate(ctx context.Context, p *publisher, timeout time.Duration) error {
+	st := &captureSink{}
+	p.sinks = []namedSink{{name: "validate", Sink: st}}
+	if err := p.warmup(ctx, timeout); err != nil {
+		return fmt.Errorf("discovering documents: %v", err)
+	}
+
+	if problems := p.validationProblems(); len(problems) > 0 {
+		return fmt.Errorf("%d problems found with the discovery document for %s", len(problems), st.md.Issuer)
+	}
+	slog.Info("Discovery document is valid", "issuer", st.md.Issuer)
+	return nil
+}
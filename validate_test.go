@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"lds.li/oauth2ext/oidc"
+)
+
+func TestCheckJWKSOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		issuer, jwksURI string
+		wantErr         bool
+	}{
+		{issuer: "https://example.com", jwksURI: "https://example.com/openid/v1/jwks"},
+		{issuer: "https://example.com/clusters/foo", jwksURI: "https://example.com/other/keys"},
+		{issuer: "https://Example.com", jwksURI: "HTTPS://example.COM/keys"},
+		{issuer: "https://example.com:8443", jwksURI: "https://example.com:8443/keys"},
+		{issuer: "https://example.com", jwksURI: "https://cdn.example.com/keys", wantErr: true},
+		{issuer: "https://example.com", jwksURI: "https://attacker.example/keys", wantErr: true},
+		{issuer: "https://example.com", jwksURI: "http://example.com/keys", wantErr: true},
+		{issuer: "https://example.com", jwksURI: "https://example.com:8443/keys", wantErr: true},
+		{issuer: "https://example.com", jwksURI: "https://example.com.attacker.example/keys", wantErr: true},
+		{issuer: "https://example.com", jwksURI: "https://example.com@attacker.example/keys", wantErr: true},
+		{issuer: "https://example.com", jwksURI: "/keys", wantErr: true},
+	} {
+		err := checkJWKSOrigin(tc.issuer, tc.jwksURI)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("checkJWKSOrigin(%q, %q) = %v, want error %t", tc.issuer, tc.jwksURI, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPublisherSameOriginJWKS(t *testing.T) {
+	cdn := httptest.NewServer(serveJSON(testKeySetJSON(t, testKey(t, "a"))))
+	defer cdn.Close()
+	for _, tc := range []struct {
+		name       string
+		sameOrigin bool
+		wantErr    bool
+	}{
+		{name: "allowed by default"},
+		{name: "rejected when required", sameOrigin: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, src := newTestIssuer(t, func(string) string { return cdn.URL + "/keys" })
+			st := &captureSink{}
+			p := &publisher{src: src, log: slog.Default(), sameOriginJWKS: tc.sameOrigin}
+			p.addSink("capture", st)
+			err := p.refresh(context.Background())
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("refresh: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "is not on the issuer's origin") {
+				t.Fatalf("refresh error = %v, want the key set's origin rejected", err)
+			}
+			if st.ks != nil {
+				t.Error("key set from another origin was published")
+			}
+		})
+	}
+}
+
+// testValidDocuments returns documents for issuer that pass publishProblems.
+func testValidDocuments(t *testing.T, issuer string, keys ...jose.JSONWebKey) (*oidc.ProviderMetadata, *jose.JSONWebKeySet) {
+	t.Helper()
+	var upstream oidc.ProviderMetadata
+	if err := json.Unmarshal(testMetadataJSON(t, issuer, issuer+"/keys"), &upstream); err != nil {
+		t.Fatal(err)
+	}
+	// the spec requires RS256 be among them.
+	upstream.IDTokenSigningAlgValuesSupported = []string{"RS256", "ES256"}
+	md, err := publicMetadata(&upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md, &jose.JSONWebKeySet{Keys: keys}
+}
+
+func TestValidSinkSkipsInvalid(t *testing.T) {
+	encKey := testKey(t, "enc")
+	encKey.Use = "enc"
+	for _, tc := range []struct {
+		name string
+		// invalidate breaks the documents from the second update.
+		invalidate  func(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet)
+		wantProblem string
+	}{
+		{name: "no signing keys", invalidate: func(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) {
+			ks.Keys = []jose.JSONWebKey{encKey}
+		}, wantProblem: "key set has no signing keys"},
+		{name: "no keys", invalidate: func(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) {
+			ks.Keys = nil
+		}, wantProblem: "key set has no signing keys"},
+		{name: "missing required field", invalidate: func(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) {
+			md.ResponseTypesSupported = nil
+		}, wantProblem: "response_types_supported is required"},
+		{name: "plain HTTP issuer", invalidate: func(md *oidc.ProviderMetadata, ks *jose.JSONWebKeySet) {
+			md.Issuer = "http://example.com"
+		}, wantProblem: "must be an https URL"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var logs bytes.Buffer
+			s := &validSink{Sink: &fileSink{dir: dir}, name: "file", log: slog.New(slog.NewTextHandler(&logs, nil))}
+			ctx := context.Background()
+
+			md, ks := testValidDocuments(t, "https://example.com", testKey(t, "a"))
+			if err := s.Update(ctx, md, ks); err != nil {
+				t.Fatal(err)
+			}
+			published, err := os.ReadFile(filepath.Join(dir, ".well-known", "jwks.json"))
+			if err != nil {
+				t.Fatalf("valid documents weren't published: %v\n%s", err, logs.String())
+			}
+
+			md, ks = testValidDocuments(t, "https://example.com", testKey(t, "b"))
+			tc.invalidate(md, ks)
+			// skipping isn't a failure to publish.
+			if err := s.Update(ctx, md, ks); err != nil {
+				t.Fatalf("update with invalid documents: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, ".well-known", "jwks.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, published) {
+				t.Errorf("invalid documents replaced the published ones:\n%s", got)
+			}
+			if !strings.Contains(logs.String(), "Not publishing invalid documents") || !strings.Contains(logs.String(), tc.wantProblem) {
+				t.Errorf("skip logged as %q, want the problem %q", logs.String(), tc.wantProblem)
+			}
+
+			// the wrapped sink is still found for seeding and deletion.
+			_, seeds := asSeedSource(s)
+			_, deletes := asDeleter(s)
+			if !seeds || !deletes {
+				t.Error("wrapped file sink isn't found through validSink")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// verifyPublished publishes the documents with p, then fetches them back from
+// their public URLs as a relying party would, checking they're served over
+// HTTPS with a valid certificate and match what was published. This catches
+// bucket policies, CDN caching and the like getting in the way. Each check is
+// logged, and an error returned if any failed.
+func verifyPublished(ctx context.Context, p *publisher, client *http.Client, timeout time.Duration) error {
+	st := &captureSink{}
+	p.sinks = append(p.sinks, namedSink{name: "verify", Sink: st})
+	if err := p.warmup(ctx, timeout); err != nil {
+		return fmt.Errorf("discovering documents: %v", err)
+	}
+
+	mdURL, err := url.JoinPath(st.md.Issuer, "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("building discovery document URL for issuer %q: %v", st.md.Issuer, err)
+	}
+	failed := 0
+	check := func(name, u string, fn func(body []byte) error) {
+		err := fetchPublished(ctx, client, u, fn)
+		if err != nil {
+			failed++
+			slog.Error("Published document check failed", "document", name, "url", u, "error", err)
+			return
+		}
+		slog.Info("Published document check passed", "document", name, "url", u)
+	}
+
+	check("metadata", mdURL, func(body []byte) error {
+		want, err := json.Marshal(st.md)
+		if err != nil {
+			return fmt.Errorf("marshaling published metadata: %v", err)
+		}
+		// compare the values, not bytes, as pretty printing or a
+		// re-encoding store may lay them out differently.
+		var got, exp map[string]any
+		if err := json.Unmarshal(body, &got); err != nil {
+			return fmt.Errorf("parsing: %v", err)
+		}
+		if err := json.Unmarshal(want, &exp); err != nil {
+			return err
+		}
+		var differ []string
+		for k := range mapKeys(got, exp) {
+			if !reflect.DeepEqual(got[k], exp[k]) {
+				differ = append(differ, k)
+			}
+		}
+		if len(differ) > 0 {
+			slices.Sort(differ)
+			return fmt.Errorf("doesn't match the published discovery document, %s differ", strings.Join(differ, ", "))
+		}
+		return nil
+	})
+	check("jwks", st.md.JWKSURI, func(body []byte) error {
+		var got jose.JSONWebKeySet
+		if err := json.Unmarshal(body, &got); err != nil {
+			return fmt.Errorf("parsing: %v", err)
+		}
+		return compareKeySets(&got, st.ks)
+	})
+
+	if failed > 0 {
+		return fmt.Errorf("%d of 2 published document checks failed for %s", failed, st.md.Issuer)
+	}
+	return nil
+}
+
+// fetchPublished GETs u, which must be https, and passes the body to check.
+func fetchPublished(ctx context.Context, client *http.Client, u string, check func(body []byte) error) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if pu.Scheme != "https" {
+		return fmt.Errorf("isn't served over https")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	// we want what the origin is serving, though a CDN may not listen.
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes+1))
+	if err != nil {
+		return fmt.Errorf("reading body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{op: "getting", url: u, status: resp.Status, code: resp.StatusCode, body: body}
+	}
+	if len(body) > maxJWKSBytes {
+		return fmt.Errorf("response is over %d bytes", maxJWKSBytes)
+	}
+	return check(body)
+}
+
+// compareKeySets checks got serves the same keys as want, by kid and key
+// material.
+func compareKeySets(got, want *jose.JSONWebKeySet) error {
+	for _, k := range want.Keys {
+		gk := got.Key(k.KeyID)
+		if len(gk) == 0 {
+			return fmt.Errorf("key %q is missing", k.KeyID)
+		}
+		if !sameKeyMaterial(gk[0], k) {
+			return fmt.Errorf("key %q doesn't match the published key", k.KeyID)
+		}
+	}
+	if len(got.Keys) != len(want.Keys) {
+		return fmt.Errorf("serves %d keys, %d were published", len(got.Keys), len(want.Keys))
+	}
+	return nil
+}
+
+// mapKeys returns the set of keys in any of ms.
+func mapKeys(ms ...map[string]any) map[string]bool {
+	keys := map[string]bool{}
+	for _, m := range ms {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	return keys
+}
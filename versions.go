@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// keySetVersion is a snapshot of a published key set, served at its own path
+// so relying parties can pin to it during a migration.
+type keySetVersion struct {
+	// id identifies the key set by its content, so replicas publishing the
+	// same key set agree on it.
+	id        string
+	published time.Time
+	keys      int
+	doc       *document
+}
+
+// keySetVersionID returns the version ID for a key set document.
+func keySetVersionID(doc *document) string {
+	return strings.Trim(doc.etag, `"`)[:12]
+}
+
+// addVersion records doc as the latest key set version, keeping at most
+// h.keyVersions. A key set that was published before moves back to the
+// front, keeping its ID. Must be called with h.mu held.
+func (h *httpSink) addVersion(doc *document, keys int) {
+	id := keySetVersionID(doc)
+	if len(h.versions) > 0 && h.versions[0].id == id {
+		return
+	}
+	h.versions = slices.DeleteFunc(h.versions, func(v keySetVersion) bool { return v.id == id })
+	h.versions = slices.Insert(h.versions, 0, keySetVersion{id: id, published: time.Now(), keys: keys, doc: doc})
+	if len(h.versions) > h.keyVersions {
+		h.versions = h.versions[:h.keyVersions]
+	}
+}
+
+// retained returns the keys held in key set versions, for the retention
+// limit. The newest version is the one being served, so is never evicted.
+func (h *httpSink) retained() (int, time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, v := range h.versions {
+		n += v.keys
+	}
+	if len(h.versions) < 2 {
+		return n, time.Time{}
+	}
+	return n, h.versions[len(h.versions)-1].published
+}
+
+func (h *httpSink) evictOldest() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.versions) < 2 {
+		return 0
+	}
+	last := len(h.versions) - 1
+	n := h.versions[last].keys
+	h.versions = slices.Delete(h.versions, last, last+1)
+	return n
+}
+
+// versionRoutes returns the endpoints serving the key set versions, under
+// jwksPath.
+func (h *httpSink) versionRoutes(cluster, host, jwksPath string) []route {
+	return []route{
+		{
+			method:      http.MethodGet,
+			cluster:     cluster,
+			host:        host,
+			path:        jwksPath + "/versions",
+			description: "Index of the retained key set versions, newest first",
+			handler:     h.serveVersions,
+		},
+		{
+			method:      http.MethodGet,
+			cluster:     cluster,
+			host:        host,
+			path:        jwksPath + "/versions/{version}",
+			description: "A retained key set version, as listed in the index",
+			handler:     h.withMigrationHeaders(h.serveVersion),
+		},
+	}
+}
+
+func (h *httpSink) serveVersions(w http.ResponseWriter, r *http.Request) {
+	type versionJSON struct {
+		Version   string    `json:"version"`
+		Published time.Time `json:"published"`
+		Keys      int       `json:"keys"`
+	}
+	resp := struct {
+		Latest   string        `json:"latest,omitempty"`
+		Versions []versionJSON `json:"versions"`
+	}{Versions: []versionJSON{}}
+
+	h.mu.RLock()
+	for _, v := range h.versions {
+		resp.Versions = append(resp.Versions, versionJSON{Version: v.id, Published: v.published, Keys: v.keys})
+	}
+	h.mu.RUnlock()
+	if len(resp.Versions) > 0 {
+		resp.Latest = resp.Versions[0].Version
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *httpSink) serveVersion(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("version")
+	h.mu.RLock()
+	i := slices.IndexFunc(h.versions, func(v keySetVersion) bool { return v.id == id })
+	var doc *document
+	if i >= 0 {
+		doc = h.versions[i].doc
+	}
+	h.mu.RUnlock()
+
+	if doc == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown key set version"})
+		return
+	}
+	_, stale := h.documentsStale(h.state)
+	h.serveDocument(w, r, h.jwksContentType, doc, stale)
+}
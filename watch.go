@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	refreshModePoll  = "poll"
+	refreshModeWatch = "watch"
+)
+
+// watchableSource is a discoverySource whose documents can be checked for
+// changes with conditional requests, which is much cheaper than a refresh.
+type watchableSource interface {
+	discoverySource
+	// watchTargets returns the client to make conditional requests with,
+	// and the URLs of the discovery document and the key set at jwksURI.
+	watchTargets(jwksURI string) (*http.Client, []string)
+}
+
+func (s *apiServerSource) watchTargets(jwksURI string) (*http.Client, []string) {
+	return s.cl.Client, []string{
+		s.cl.Get().RequestURI(s.path).URL().String(),
+		s.cl.Get().RequestURI(jwksURI).URL().String(),
+	}
+}
+
+func (s *issuerSource) watchTargets(jwksURI string) (*http.Client, []string) {
+	u, _ := url.JoinPath(s.issuer, s.path)
+	if jwksURI == "" {
+		// the keys are inline in the discovery document.
+		return s.client, []string{u}
+	}
+	return s.client, []string{u, jwksURI}
+}
+
+// validators are the response headers a conditional request is made with.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// changeChecker checks URLs for changes with conditional requests, tracking
+// the validators from the last response for each.
+type changeChecker struct {
+	client     *http.Client
+	validators map[string]validators
+}
+
+// check reports whether any of urls changed since they were last checked. A
+// URL that hasn't been checked before counts as changed. supported is false if
+// a response carried no ETag or Last-Modified, so there is no way to make
+// conditional requests for it.
+func (c *changeChecker) check(ctx context.Context, urls []string) (changed, supported bool, _ error) {
+	if c.validators == nil {
+		c.validators = map[string]validators{}
+	}
+
+	supported = true
+	for _, u := range urls {
+		v, known := c.validators[u]
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return false, false, fmt.Errorf("building request for %s: %v", u, err)
+		}
+		if v.etag != "" {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if v.lastModified != "" {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return false, false, fmt.Errorf("checking %s: %v", u, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusNotModified:
+			continue
+		case http.StatusOK:
+		default:
+			return false, false, fmt.Errorf("checking %s: unexpected status %s", u, resp.Status)
+		}
+
+		nv := validators{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+		if nv == (validators{}) {
+			supported = false
+		}
+		c.validators[u] = nv
+		// a 200 to a conditional request means it changed. Otherwise this
+		// is the first check, which counts as changed too.
+		changed = changed || !known || v != (validators{})
+	}
+	return changed, supported, nil
+}
+
+// watch checks the upstream documents for changes every interval, refreshing
+// only when they have. Unchanged documents count as a successful discovery, so
+// they don't go stale. If the source or upstream doesn't support conditional
+// requests, this falls back to polling every pollInterval, see run.
+func (p *publisher) watch(ctx context.Context, interval, pollInterval, delay time.Duration) {
+	ws, ok := p.src.(watchableSource)
+	if !ok {
+		p.log.Warn("Source doesn't support watching, falling back to polling")
+		p.run(ctx, pollInterval, delay)
+		return
+	}
+
+	p.catchUp(ctx)
+	p.scheduleNext(delay + interval)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	var cc *changeChecker
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		p.scheduleNext(interval)
+
+		p.refreshMu.Lock()
+		resync := p.resyncDue()
+		p.refreshMu.Unlock()
+		if p.lastSuccess().IsZero() || p.publishForced() || resync {
+			// nothing has been discovered yet so there's nothing to watch,
+			// or the documents must be published even if unchanged, as
+			// they were expired or deleted or are due a resync, which only
+			// a refresh does.
+			if err := p.refresh(ctx); err != nil {
+				p.log.Error("Failed to refresh discovery documents", "error", err)
+			}
+			continue
+		}
+		client, urls := ws.watchTargets(p.upstreamJWKSURI())
+		if cc == nil || cc.client != client {
+			cc = &changeChecker{client: client}
+		}
+		changed, supported, err := cc.check(ctx, urls)
+		if err != nil {
+			p.log.Error("Failed to check discovery documents for changes", "error", err)
+			p.checkFailed(ctx, err)
+			continue
+		}
+		if !supported {
+			p.log.Warn("Upstream doesn't support conditional requests, falling back to polling", "interval", pollInterval)
+			p.run(ctx, pollInterval, 0)
+			return
+		}
+		if !changed {
+			p.markFresh()
+			continue
+		}
+
+		if err := p.refresh(ctx); err != nil {
+			p.log.Error("Failed to refresh discovery documents", "error", err)
+		}
+	}
+}
+
+// checkFailed records a failed change check as a failed discovery, deleting
+// the documents if discovery has been failing too long, as a failed refresh
+// does.
+func (p *publisher) checkFailed(ctx context.Context, err error) {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	p.recordResult(err)
+	p.deleteStale(ctx)
+}